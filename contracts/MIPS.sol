@@ -15,8 +15,20 @@ import "./MIPSMemory.sol";
 // If you are using the Preimage oracle, you call AddPreimage
 // Then, you call Step. Step will revert if state is missing. If all state is present, it will return the next hash
 
+// A syscall beyond the builtin ones, the on chain side of a handler passed to
+// RegisterSyscall in mlvm. It has to do exactly what the Go handler does: read
+// and write the state through m, with the registers at REG_OFFSET+4*n, and
+// return the new state and $v0.
+interface ISyscall {
+  function handle(MIPSMemory m, bytes32 stateHash) external returns (bytes32, uint32);
+}
+
 contract MIPS {
   MIPSMemory public immutable m;
+  address public immutable owner;
+
+  // syscalls registered with RegisterSyscall, by number
+  mapping(uint32 => ISyscall) public syscalls;
 
   uint32 constant public REG_OFFSET = 0xc0000000;
   uint32 constant public REG_ZERO = REG_OFFSET;
@@ -25,12 +37,28 @@ contract MIPS {
   uint32 constant public REG_HI = REG_OFFSET + 0x21*4;
   uint32 constant public REG_LO = REG_OFFSET + 0x22*4;
   uint32 constant public REG_HEAP = REG_OFFSET + 0x23*4;
+  uint32 constant public REG_BRK = REG_OFFSET + 0x24*4;
 
   uint32 constant public HEAP_START = 0x20000000;
   uint32 constant public BRK_START = 0x40000000;
 
   constructor() {
     m = new MIPSMemory();
+    owner = msg.sender;
+  }
+
+  function isBuiltinSyscall(uint32 syscall_no) public pure returns (bool) {
+    return syscall_no == 4004 || syscall_no == 4020 || syscall_no == 4045 ||
+           syscall_no == 4090 || syscall_no == 4120 || syscall_no == 4246;
+  }
+
+  // a registered syscall can't be changed, steps proven against it would
+  // prove something else afterwards
+  function RegisterSyscall(uint32 syscall_no, ISyscall handler) external {
+    require(msg.sender == owner, "only the owner registers syscalls");
+    require(!isBuiltinSyscall(syscall_no), "syscall is builtin");
+    require(address(syscalls[syscall_no]) == address(0), "syscall already registered");
+    syscalls[syscall_no] = handler;
   }
 
   bool constant public debug = true;
@@ -97,14 +125,22 @@ contract MIPS {
         v0 = a0;
       }
     } else if (syscall_no == 4045) {
-      // brk
-      v0 = BRK_START;
+      // brk, moves the break when a0 is in the brk heap and returns it
+      uint32 a0 = ReadMemory(stateHash, REG_OFFSET+4*4);
+      if (a0 < BRK_START) {
+        v0 = BRK_START + ReadMemory(stateHash, REG_BRK);
+      } else {
+        stateHash = WriteMemory(stateHash, REG_BRK, a0-BRK_START);
+        v0 = a0;
+      }
     } else if (syscall_no == 4120) {
       // clone (not supported)
       v0 = 1;
     } else if (syscall_no == 4246) {
       // exit group
       exit = true;
+    } else if (address(syscalls[syscall_no]) != address(0)) {
+      (stateHash, v0) = syscalls[syscall_no].handle(m, stateHash);
     }
 
     stateHash = WriteMemory(stateHash, REG_OFFSET+2*4, v0);
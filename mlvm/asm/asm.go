@@ -0,0 +1,488 @@
+// Package asm is a small MIPS32 assembler, enough to write the test programs
+// for mlvm without a cross compiler. It knows the instructions MIPS.sol can
+// step, a few pseudo instructions, labels and .word. Nothing is reordered or
+// filled in, so delay slots are the writer's business.
+package asm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var regNames = []string{
+	"zero", "at", "v0", "v1", "a0", "a1", "a2", "a3",
+	"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7",
+	"s0", "s1", "s2", "s3", "s4", "s5", "s6", "s7",
+	"t8", "t9", "k0", "k1", "gp", "sp", "fp", "ra",
+}
+
+// RegName is the conventional name of register r, without the $
+func RegName(r uint32) string {
+	return regNames[r&0x1f]
+}
+
+func parseReg(s string) (uint32, error) {
+	if !strings.HasPrefix(s, "$") {
+		return 0, fmt.Errorf("bad register %q", s)
+	}
+	s = s[1:]
+	if n, err := strconv.ParseUint(s, 10, 5); err == nil {
+		return uint32(n), nil
+	}
+	if s == "s8" {
+		return 30, nil
+	}
+	for i, name := range regNames {
+		if s == name {
+			return uint32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("bad register $%s", s)
+}
+
+func parseImm(s string) (int64, error) {
+	return strconv.ParseInt(s, 0, 64)
+}
+
+// format of the operands, which also picks how they're encoded
+const (
+	fmtR3       = iota // rd, rs, rt
+	fmtShiftV          // rd, rt, rs
+	fmtShift           // rd, rt, shamt
+	fmtMulDiv          // rs, rt
+	fmtMoveFrom        // rd
+	fmtMoveTo          // rs
+	fmtJr              // rs
+	fmtJalr            // [rd,] rs
+	fmtNone            // syscall, sync
+	fmtI               // rt, rs, imm
+	fmtLui             // rt, imm
+	fmtMem             // rt, off(base)
+	fmtBranch2         // rs, rt, label
+	fmtBranch1         // rs, label
+	fmtJump            // label
+	fmtCount           // rd, rs
+)
+
+type opInfo struct {
+	format int
+	opcode uint32
+	fn     uint32 // func, or rt for regimm
+}
+
+var ops = map[string]opInfo{
+	"sll":     {fmtShift, 0, 0x00},
+	"srl":     {fmtShift, 0, 0x02},
+	"sra":     {fmtShift, 0, 0x03},
+	"sllv":    {fmtShiftV, 0, 0x04},
+	"srlv":    {fmtShiftV, 0, 0x06},
+	"srav":    {fmtShiftV, 0, 0x07},
+	"jr":      {fmtJr, 0, 0x08},
+	"jalr":    {fmtJalr, 0, 0x09},
+	"movz":    {fmtR3, 0, 0x0a},
+	"movn":    {fmtR3, 0, 0x0b},
+	"syscall": {fmtNone, 0, 0x0c},
+	"sync":    {fmtNone, 0, 0x0f},
+	"mfhi":    {fmtMoveFrom, 0, 0x10},
+	"mthi":    {fmtMoveTo, 0, 0x11},
+	"mflo":    {fmtMoveFrom, 0, 0x12},
+	"mtlo":    {fmtMoveTo, 0, 0x13},
+	"mult":    {fmtMulDiv, 0, 0x18},
+	"multu":   {fmtMulDiv, 0, 0x19},
+	"div":     {fmtMulDiv, 0, 0x1a},
+	"divu":    {fmtMulDiv, 0, 0x1b},
+	"add":     {fmtR3, 0, 0x20},
+	"addu":    {fmtR3, 0, 0x21},
+	"sub":     {fmtR3, 0, 0x22},
+	"subu":    {fmtR3, 0, 0x23},
+	"and":     {fmtR3, 0, 0x24},
+	"or":      {fmtR3, 0, 0x25},
+	"xor":     {fmtR3, 0, 0x26},
+	"nor":     {fmtR3, 0, 0x27},
+	"slt":     {fmtR3, 0, 0x2a},
+	"sltu":    {fmtR3, 0, 0x2b},
+
+	"bltz": {fmtBranch1, 1, 0},
+	"bgez": {fmtBranch1, 1, 1},
+	"j":    {fmtJump, 2, 0},
+	"jal":  {fmtJump, 3, 0},
+	"beq":  {fmtBranch2, 4, 0},
+	"bne":  {fmtBranch2, 5, 0},
+	"blez": {fmtBranch1, 6, 0},
+	"bgtz": {fmtBranch1, 7, 0},
+
+	"addi":  {fmtI, 0x08, 0},
+	"addiu": {fmtI, 0x09, 0},
+	"slti":  {fmtI, 0x0a, 0},
+	"sltiu": {fmtI, 0x0b, 0},
+	"andi":  {fmtI, 0x0c, 0},
+	"ori":   {fmtI, 0x0d, 0},
+	"xori":  {fmtI, 0x0e, 0},
+	"lui":   {fmtLui, 0x0f, 0},
+
+	"mul": {fmtR3, 0x1c, 0x02},
+	"clz": {fmtCount, 0x1c, 0x20},
+	"clo": {fmtCount, 0x1c, 0x21},
+
+	"lb":  {fmtMem, 0x20, 0},
+	"lh":  {fmtMem, 0x21, 0},
+	"lwl": {fmtMem, 0x22, 0},
+	"lw":  {fmtMem, 0x23, 0},
+	"lbu": {fmtMem, 0x24, 0},
+	"lhu": {fmtMem, 0x25, 0},
+	"lwr": {fmtMem, 0x26, 0},
+	"sb":  {fmtMem, 0x28, 0},
+	"sh":  {fmtMem, 0x29, 0},
+	"swl": {fmtMem, 0x2a, 0},
+	"sw":  {fmtMem, 0x2b, 0},
+	"swr": {fmtMem, 0x2e, 0},
+	"ll":  {fmtMem, 0x30, 0},
+	"sc":  {fmtMem, 0x38, 0},
+}
+
+type line struct {
+	num  int
+	op   string
+	args []string
+	addr uint32
+}
+
+// size is the number of words a line takes, known before labels are
+func (l *line) size() (int, error) {
+	switch l.op {
+	case ".word":
+		return len(l.args), nil
+	case "la":
+		return 2, nil
+	case "li":
+		if len(l.args) != 2 {
+			return 0, fmt.Errorf("li needs 2 operands")
+		}
+		imm, err := parseImm(l.args[1])
+		if err != nil {
+			return 0, err
+		}
+		if imm >= -0x8000 && imm < 0x8000 {
+			return 1, nil
+		}
+		return 2, nil
+	}
+	return 1, nil
+}
+
+// Assemble turns src into big endian machine code to be loaded at base.
+// Lines are `label: op operands # comment`, operands comma separated.
+func Assemble(base uint32, src string) ([]byte, error) {
+	words, _, err := AssembleWords(base, src)
+	if err != nil {
+		return nil, err
+	}
+	dat := make([]byte, 4*len(words))
+	for i, w := range words {
+		binary.BigEndian.PutUint32(dat[4*i:], w)
+	}
+	return dat, nil
+}
+
+// AssembleWords is Assemble, but returns the words and where each label is
+func AssembleWords(base uint32, src string) ([]uint32, map[string]uint32, error) {
+	labels := make(map[string]uint32)
+	var lines []*line
+
+	addr := base
+	for num, text := range strings.Split(src, "\n") {
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		for {
+			i := strings.Index(text, ":")
+			if i < 0 {
+				break
+			}
+			label := strings.TrimSpace(text[:i])
+			if _, ok := labels[label]; ok {
+				return nil, nil, fmt.Errorf("line %d: label %s defined twice", num+1, label)
+			}
+			labels[label] = addr
+			text = strings.TrimSpace(text[i+1:])
+		}
+		if text == "" {
+			continue
+		}
+
+		l := &line{num: num + 1, addr: addr}
+		fields := strings.SplitN(text, " ", 2)
+		l.op = strings.ToLower(fields[0])
+		if len(fields) > 1 {
+			for _, arg := range strings.Split(fields[1], ",") {
+				l.args = append(l.args, strings.TrimSpace(arg))
+			}
+		}
+		n, err := l.size()
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", l.num, err)
+		}
+		lines = append(lines, l)
+		addr += uint32(4 * n)
+	}
+
+	var words []uint32
+	for _, l := range lines {
+		w, err := encode(l, labels)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s: %v", l.num, l.op, err)
+		}
+		words = append(words, w...)
+	}
+	return words, labels, nil
+}
+
+func rtype(opcode, rs, rt, rd, shamt, fn uint32) uint32 {
+	return opcode<<26 | rs<<21 | rt<<16 | rd<<11 | shamt<<6 | fn
+}
+
+func itype(opcode, rs, rt, imm uint32) uint32 {
+	return opcode<<26 | rs<<21 | rt<<16 | imm&0xffff
+}
+
+// value is a number, or the address of a label
+func value(s string, labels map[string]uint32) (int64, error) {
+	if addr, ok := labels[s]; ok {
+		return int64(addr), nil
+	}
+	imm, err := parseImm(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	return imm, nil
+}
+
+func encode(l *line, labels map[string]uint32) ([]uint32, error) {
+	regs := func(n int) ([]uint32, error) {
+		if len(l.args) != n {
+			return nil, fmt.Errorf("needs %d operands", n)
+		}
+		var r []uint32
+		for _, arg := range l.args {
+			reg, err := parseReg(arg)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, reg)
+		}
+		return r, nil
+	}
+	// regs followed by one value
+	regsValue := func(n int) ([]uint32, int64, error) {
+		if len(l.args) != n+1 {
+			return nil, 0, fmt.Errorf("needs %d operands", n+1)
+		}
+		val, err := value(l.args[n], labels)
+		if err != nil {
+			return nil, 0, err
+		}
+		saved := l.args
+		l.args = l.args[:n]
+		r, err := regs(n)
+		l.args = saved
+		return r, val, err
+	}
+	branch := func(target int64) (uint32, error) {
+		off := (target - int64(l.addr) - 4) >> 2
+		if target&3 != 0 || off < -0x8000 || off >= 0x8000 {
+			return 0, fmt.Errorf("can't branch to %x", target)
+		}
+		return uint32(off) & 0xffff, nil
+	}
+
+	switch l.op {
+	case ".word":
+		var words []uint32
+		for _, arg := range l.args {
+			val, err := value(arg, labels)
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, uint32(val))
+		}
+		return words, nil
+	case "nop":
+		return []uint32{0}, nil
+	case "move":
+		r, err := regs(2)
+		if err != nil {
+			return nil, err
+		}
+		return []uint32{rtype(0, r[1], 0, r[0], 0, 0x21)}, nil
+	case "b":
+		_, target, err := regsValue(0)
+		if err != nil {
+			return nil, err
+		}
+		off, err := branch(target)
+		return []uint32{itype(4, 0, 0, off)}, err
+	case "li", "la":
+		r, val, err := regsValue(1)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := l.size(); n == 1 {
+			return []uint32{itype(9, 0, r[0], uint32(val))}, nil
+		}
+		return []uint32{itype(0xf, 0, r[0], uint32(val)>>16), itype(0xd, r[0], r[0], uint32(val))}, nil
+	}
+
+	info, ok := ops[l.op]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction")
+	}
+	var w uint32
+	switch info.format {
+	case fmtR3:
+		r, err := regs(3)
+		if err != nil {
+			return nil, err
+		}
+		w = rtype(info.opcode, r[1], r[2], r[0], 0, info.fn)
+	case fmtShiftV:
+		r, err := regs(3)
+		if err != nil {
+			return nil, err
+		}
+		w = rtype(0, r[2], r[1], r[0], 0, info.fn)
+	case fmtShift:
+		r, shamt, err := regsValue(2)
+		if err != nil {
+			return nil, err
+		}
+		if shamt < 0 || shamt > 31 {
+			return nil, fmt.Errorf("bad shift %d", shamt)
+		}
+		w = rtype(0, 0, r[1], r[0], uint32(shamt), info.fn)
+	case fmtMulDiv:
+		r, err := regs(2)
+		if err != nil {
+			return nil, err
+		}
+		w = rtype(0, r[0], r[1], 0, 0, info.fn)
+	case fmtMoveFrom:
+		r, err := regs(1)
+		if err != nil {
+			return nil, err
+		}
+		w = rtype(0, 0, 0, r[0], 0, info.fn)
+	case fmtMoveTo, fmtJr:
+		r, err := regs(1)
+		if err != nil {
+			return nil, err
+		}
+		w = rtype(0, r[0], 0, 0, 0, info.fn)
+	case fmtJalr:
+		if len(l.args) == 1 {
+			l.args = append([]string{"$ra"}, l.args...)
+		}
+		r, err := regs(2)
+		if err != nil {
+			return nil, err
+		}
+		w = rtype(0, r[1], 0, r[0], 0, info.fn)
+	case fmtNone:
+		if len(l.args) != 0 {
+			return nil, fmt.Errorf("takes no operands")
+		}
+		w = info.fn
+	case fmtI:
+		r, imm, err := regsValue(2)
+		if err != nil {
+			return nil, err
+		}
+		if imm < -0x8000 || imm > 0xffff {
+			return nil, fmt.Errorf("immediate %d out of range", imm)
+		}
+		w = itype(info.opcode, r[1], r[0], uint32(imm))
+	case fmtLui:
+		r, imm, err := regsValue(1)
+		if err != nil {
+			return nil, err
+		}
+		w = itype(info.opcode, 0, r[0], uint32(imm))
+	case fmtMem:
+		if len(l.args) != 2 {
+			return nil, fmt.Errorf("needs 2 operands")
+		}
+		rt, err := parseReg(l.args[0])
+		if err != nil {
+			return nil, err
+		}
+		mem := l.args[1]
+		open := strings.Index(mem, "(")
+		if open < 0 || !strings.HasSuffix(mem, ")") {
+			return nil, fmt.Errorf("bad memory operand %q", mem)
+		}
+		base, err := parseReg(mem[open+1 : len(mem)-1])
+		if err != nil {
+			return nil, err
+		}
+		var off int64
+		if s := strings.TrimSpace(mem[:open]); s != "" {
+			if off, err = value(s, labels); err != nil {
+				return nil, err
+			}
+		}
+		if off < -0x8000 || off >= 0x8000 {
+			return nil, fmt.Errorf("offset %d out of range", off)
+		}
+		w = itype(info.opcode, base, rt, uint32(off))
+	case fmtBranch2:
+		r, target, err := regsValue(2)
+		if err != nil {
+			return nil, err
+		}
+		off, err := branch(target)
+		if err != nil {
+			return nil, err
+		}
+		w = itype(info.opcode, r[0], r[1], off)
+	case fmtBranch1:
+		r, target, err := regsValue(1)
+		if err != nil {
+			return nil, err
+		}
+		off, err := branch(target)
+		if err != nil {
+			return nil, err
+		}
+		w = itype(info.opcode, r[0], info.fn, off)
+	case fmtJump:
+		_, target, err := regsValue(0)
+		if err != nil {
+			return nil, err
+		}
+		// MIPS.sol sign extends the target instead of taking the top of pc,
+		// the two only agree on the bottom 128MB
+		if target&3 != 0 || target < 0 || target >= 0x08000000 || (l.addr+4)&0xf0000000 != 0 {
+			return nil, fmt.Errorf("can't jump to %x", target)
+		}
+		w = info.opcode<<26 | (uint32(target)>>2)&0x3ffffff
+	case fmtCount:
+		r, err := regs(2)
+		if err != nil {
+			return nil, err
+		}
+		// rt has to be the same as rd
+		w = rtype(info.opcode, r[1], r[0], r[0], 0, info.fn)
+	}
+	return []uint32{w}, nil
+}
+
+// MustAssemble is Assemble for tests, it panics on a bad program
+func MustAssemble(base uint32, src string) []byte {
+	dat, err := Assemble(base, src)
+	if err != nil {
+		panic(err)
+	}
+	return dat
+}
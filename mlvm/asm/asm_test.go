@@ -0,0 +1,91 @@
+package asm
+
+import (
+	"testing"
+)
+
+func TestEncodings(t *testing.T) {
+	for src, want := range map[string]uint32{
+		"addiu $sp, $sp, -32": 0x27bdffe0,
+		"lw $ra, 28($sp)":     0x8fbf001c,
+		"sw $ra, 28($sp)":     0xafbf001c,
+		"sb $t0, -1($s0)":     0xa208ffff,
+		"jr $ra":              0x03e00008,
+		"jalr $t9":            0x0320f809,
+		"addu $v0, $a0, $a1":  0x00851021,
+		"sll $t0, $t1, 4":     0x00094100,
+		"srav $t0, $t1, $t2":  0x01494007,
+		"lui $at, 0x1234":     0x3c011234,
+		"mul $v0, $a0, $a1":   0x70851002,
+		"clz $v0, $a0":        0x70821020,
+		"mult $a0, $a1":       0x00850018,
+		"mflo $v0":            0x00001012,
+		"syscall":             0x0000000c,
+		"nop":                 0x00000000,
+		"move $s8, $sp":       0x03a0f021,
+		"li $v0, 4246":        0x24021096,
+		"bgez $a0, 0x10":      0x04810003,
+		"jal 0x400":           0x0c000100,
+		".word 0xdeadbeef":    0xdeadbeef,
+	} {
+		words, _, err := AssembleWords(0, src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if len(words) != 1 || words[0] != want {
+			t.Fatalf("%s: %08x, want %08x", src, words, want)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	words, labels, err := AssembleWords(0x1000, `
+start:	li $t0, 0x12345678   # two words
+loop:	addiu $t0, $t0, -1
+	bne $t0, $zero, loop
+	nop
+	j start
+	la $t1, data
+data:	.word 1, 2, loop
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{
+		0x3c081234, 0x35085678,
+		0x2508ffff,
+		0x1500fffe,
+		0x00000000,
+		0x08000400,
+		0x3c090000, 0x35291020,
+		1, 2, 0x1008,
+	}
+	if len(words) != len(want) {
+		t.Fatalf("%d words, want %d", len(words), len(want))
+	}
+	for i := range want {
+		if words[i] != want[i] {
+			t.Fatalf("word %d is %08x, want %08x", i, words[i], want[i])
+		}
+	}
+	if labels["data"] != 0x1020 {
+		t.Fatalf("data is at %x", labels["data"])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, src := range []string{
+		"frob $t0",
+		"addiu $t0, $t0",
+		"addiu $t0, $t9x, 1",
+		"lw $t0, 4",
+		"beq $t0, $t1, nowhere",
+		"sll $t0, $t1, 32",
+		"x: nop\nx: nop",
+		"j 0x10000000",
+	} {
+		if _, err := Assemble(0, src); err == nil {
+			t.Fatalf("%q assembled", src)
+		}
+	}
+}
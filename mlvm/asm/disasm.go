@@ -0,0 +1,110 @@
+package asm
+
+import (
+	"fmt"
+)
+
+type opName struct {
+	name string
+	info opInfo
+}
+
+// decoding tables, built from ops: SPECIAL and SPECIAL2 by func, REGIMM by rt
+// and everything else by opcode
+var special, special2, regimm, byOpcode = map[uint32]opName{}, map[uint32]opName{}, map[uint32]opName{}, map[uint32]opName{}
+
+func init() {
+	for name, info := range ops {
+		switch {
+		case info.opcode == 0:
+			special[info.fn] = opName{name, info}
+		case info.opcode == 0x1c:
+			special2[info.fn] = opName{name, info}
+		case info.opcode == 1:
+			regimm[info.fn] = opName{name, info}
+		default:
+			byOpcode[info.opcode] = opName{name, info}
+		}
+	}
+}
+
+func reg(r uint32) string {
+	return "$" + RegName(r)
+}
+
+// Disassemble renders the instruction word at pc in the syntax Assemble
+// takes, with branch and jump targets as absolute addresses. Anything it
+// doesn't know comes out as .word.
+func Disassemble(pc uint32, word uint32) string {
+	opcode := word >> 26
+	rs := (word >> 21) & 0x1f
+	rt := (word >> 16) & 0x1f
+	rd := (word >> 11) & 0x1f
+	shamt := (word >> 6) & 0x1f
+	fn := word & 0x3f
+	imm := int32(int16(word))
+
+	if word == 0 {
+		return "nop"
+	}
+
+	var op opName
+	var ok bool
+	switch opcode {
+	case 0:
+		op, ok = special[fn]
+	case 0x1c:
+		op, ok = special2[fn]
+	case 1:
+		op, ok = regimm[rt]
+	default:
+		op, ok = byOpcode[opcode]
+	}
+	if !ok {
+		return fmt.Sprintf(".word 0x%08x", word)
+	}
+
+	branch := pc + 4 + uint32(imm<<2)
+	switch op.info.format {
+	case fmtR3:
+		return fmt.Sprintf("%s %s, %s, %s", op.name, reg(rd), reg(rs), reg(rt))
+	case fmtShiftV:
+		return fmt.Sprintf("%s %s, %s, %s", op.name, reg(rd), reg(rt), reg(rs))
+	case fmtShift:
+		return fmt.Sprintf("%s %s, %s, %d", op.name, reg(rd), reg(rt), shamt)
+	case fmtMulDiv:
+		return fmt.Sprintf("%s %s, %s", op.name, reg(rs), reg(rt))
+	case fmtMoveFrom:
+		return fmt.Sprintf("%s %s", op.name, reg(rd))
+	case fmtMoveTo, fmtJr:
+		return fmt.Sprintf("%s %s", op.name, reg(rs))
+	case fmtJalr:
+		if rd == 31 {
+			return fmt.Sprintf("%s %s", op.name, reg(rs))
+		}
+		return fmt.Sprintf("%s %s, %s", op.name, reg(rd), reg(rs))
+	case fmtNone:
+		return op.name
+	case fmtI:
+		if opcode >= 0xc {
+			// andi, ori and xori zero extend
+			return fmt.Sprintf("%s %s, %s, 0x%x", op.name, reg(rt), reg(rs), word&0xffff)
+		}
+		return fmt.Sprintf("%s %s, %s, %d", op.name, reg(rt), reg(rs), imm)
+	case fmtLui:
+		return fmt.Sprintf("%s %s, 0x%x", op.name, reg(rt), word&0xffff)
+	case fmtMem:
+		return fmt.Sprintf("%s %s, %d(%s)", op.name, reg(rt), imm, reg(rs))
+	case fmtBranch2:
+		return fmt.Sprintf("%s %s, %s, 0x%x", op.name, reg(rs), reg(rt), branch)
+	case fmtBranch1:
+		return fmt.Sprintf("%s %s, 0x%x", op.name, reg(rs), branch)
+	case fmtJump:
+		// the target the way MIPS.sol takes it, sign extended and not from
+		// the top of pc
+		return fmt.Sprintf("%s 0x%x", op.name, uint32(int32(word<<6)>>4))
+	case fmtCount:
+		return fmt.Sprintf("%s %s, %s", op.name, reg(rd), reg(rs))
+	}
+	return fmt.Sprintf(".word 0x%08x", word)
+}
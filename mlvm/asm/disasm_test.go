@@ -0,0 +1,84 @@
+package asm
+
+import (
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	for _, c := range []struct {
+		pc   uint32
+		word uint32
+		want string
+	}{
+		{0, 0x27bdffe0, "addiu $sp, $sp, -32"},
+		{0, 0x8fbf001c, "lw $ra, 28($sp)"},
+		{0, 0x0320f809, "jalr $t9"},
+		{0, 0x3c011234, "lui $at, 0x1234"},
+		{0, 0x3508ffff, "ori $t0, $t0, 0xffff"},
+		{0x100c, 0x1500fffe, "bne $t0, $zero, 0x1008"},
+		{0x1000, 0x0c000100, "jal 0x400"},
+		{0x10000000, 0x0c000100, "jal 0x400"},
+		{0, 0x0a000001, "j 0xf8000004"},
+		{0, 0x70821020, "clz $v0, $a0"},
+		{0, 0x00000000, "nop"},
+		{0, 0x0000000c, "syscall"},
+		{0, 0xfc000000, ".word 0xfc000000"},
+	} {
+		if got := Disassemble(c.pc, c.word); got != c.want {
+			t.Fatalf("%08x at %x is %q, want %q", c.word, c.pc, got, c.want)
+		}
+	}
+}
+
+// everything the assembler knows has to come back out the same
+func TestDisassembleRoundTrip(t *testing.T) {
+	src := ""
+	for name, info := range ops {
+		switch info.format {
+		case fmtR3:
+			src += name + " $t0, $t1, $t2\n"
+		case fmtShiftV:
+			src += name + " $t0, $t1, $t2\n"
+		case fmtShift:
+			src += name + " $t0, $t1, 7\n"
+		case fmtMulDiv:
+			src += name + " $a0, $a1\n"
+		case fmtMoveFrom, fmtMoveTo, fmtJr:
+			src += name + " $v1\n"
+		case fmtJalr:
+			src += name + " $t9\n" + name + " $s0, $t9\n"
+		case fmtNone:
+			src += name + "\n"
+		case fmtI:
+			src += name + " $t0, $t1, 100\n"
+		case fmtLui:
+			src += name + " $t0, 0x8000\n"
+		case fmtMem:
+			src += name + " $t0, -8($sp)\n"
+		case fmtBranch2:
+			src += name + " $t0, $t1, 0x400\n"
+		case fmtBranch1:
+			src += name + " $t0, 0x2000\n"
+		case fmtJump:
+			src += name + " 0x4000\n"
+		case fmtCount:
+			src += name + " $v0, $a0\n"
+		}
+	}
+
+	words, _, err := AssembleWords(0x1000, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range words {
+		pc := 0x1000 + uint32(4*i)
+		text := Disassemble(pc, w)
+		again, _, err := AssembleWords(pc, text)
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		if again[0] != w {
+			t.Fatalf("%08x disassembles to %q, which is %08x", w, text, again[0])
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"mlvm/asm"
+)
+
+// the register block is the 32 GPRs then pc, hi, lo, heap and brk
+var REG_BLOCK_END uint32 = REG_OFFSET + REG_BLOCK_WORDS*4
+
+// MemRegion names the part of GuestLayout addr falls in
+func MemRegion(addr uint32) string {
+	l := GuestLayout
+	for _, r := range l.regions() {
+		// the input is what's in the oracle window before the first 4020
+		if r.Name != "oracle" && addr >= r.Start && addr < r.End {
+			return r.Name
+		}
+	}
+	if addr < l.Heap.Start {
+		return "program"
+	}
+	return "io"
+}
+
+// RegName names a word of the register block
+func RegName(addr uint32) string {
+	switch addr {
+	case REG_PC:
+		return "pc"
+	case REG_HI:
+		return "hi"
+	case REG_LO:
+		return "lo"
+	case REG_HEAP:
+		return "heap"
+	case REG_BRK:
+		return "brk"
+	}
+	return "$" + asm.RegName((addr-REG_OFFSET)/4)
+}
+
+type RegDiff struct {
+	Name string
+	A    uint32
+	B    uint32
+}
+
+// MemRangeDiff is a run of consecutive changed words, [Start, End)
+type MemRangeDiff struct {
+	Start  uint32
+	End    uint32
+	Region string
+	A      []uint32
+	B      []uint32
+}
+
+type CheckpointDiff struct {
+	Regs   []RegDiff
+	Ranges []MemRangeDiff
+}
+
+// DiffRam compares two ram images, treating missing words as zero
+func DiffRam(a, b map[uint32](uint32)) *CheckpointDiff {
+	d := &CheckpointDiff{}
+	for addr := REG_OFFSET; addr < REG_BLOCK_END; addr += 4 {
+		if a[addr] != b[addr] {
+			d.Regs = append(d.Regs, RegDiff{RegName(addr), a[addr], b[addr]})
+		}
+	}
+
+	var changed []uint32
+	for addr, value := range a {
+		if b[addr] != value && (addr < REG_OFFSET || addr >= REG_BLOCK_END) {
+			changed = append(changed, addr)
+		}
+	}
+	for addr, value := range b {
+		if _, ok := a[addr]; !ok && value != 0 && (addr < REG_OFFSET || addr >= REG_BLOCK_END) {
+			changed = append(changed, addr)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i] < changed[j] })
+
+	for _, addr := range changed {
+		region := MemRegion(addr)
+		if n := len(d.Ranges); n > 0 && d.Ranges[n-1].End == addr && d.Ranges[n-1].Region == region {
+			r := &d.Ranges[n-1]
+			r.End += 4
+			r.A = append(r.A, a[addr])
+			r.B = append(r.B, b[addr])
+			continue
+		}
+		d.Ranges = append(d.Ranges, MemRangeDiff{addr, addr + 4, region, []uint32{a[addr]}, []uint32{b[addr]}})
+	}
+	return d
+}
+
+// DiffCheckpoints loads both checkpoints and compares their ram
+func DiffCheckpoints(fa, fb string) (*CheckpointDiff, error) {
+	_, _, a, err := LoadCheckpoint(fa)
+	if err != nil {
+		return nil, err
+	}
+	_, _, b, err := LoadCheckpoint(fb)
+	if err != nil {
+		return nil, err
+	}
+	return DiffRam(a, b), nil
+}
+
+// words up to this many are printed in full
+const DIFF_SHOW_WORDS = 4
+
+func (d *CheckpointDiff) String() string {
+	var b strings.Builder
+	if len(d.Regs) == 0 && len(d.Ranges) == 0 {
+		return "no differences\n"
+	}
+	if len(d.Regs) > 0 {
+		b.WriteString("registers:\n")
+		for _, r := range d.Regs {
+			fmt.Fprintf(&b, "  %5s %08x -> %08x\n", r.Name, r.A, r.B)
+		}
+	}
+	if len(d.Ranges) > 0 {
+		words := 0
+		for _, r := range d.Ranges {
+			words += len(r.A)
+		}
+		fmt.Fprintf(&b, "memory: %d words in %d ranges\n", words, len(d.Ranges))
+		for _, r := range d.Ranges {
+			fmt.Fprintf(&b, "  %08x-%08x  %-11s %6d words", r.Start, r.End, r.Region, len(r.A))
+			if len(r.A) <= DIFF_SHOW_WORDS {
+				for i := range r.A {
+					fmt.Fprintf(&b, "  %08x -> %08x", r.A[i], r.B[i])
+				}
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
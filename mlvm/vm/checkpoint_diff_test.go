@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+func TestDiffCheckpoints(t *testing.T) {
+	initTest()
+	basedir := t.TempDir()
+	oracle.SetRoot(basedir)
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	ram[REG_PC] = 0x1000
+	ram[0x1000] = 0x27bdffe0
+	ram[INPUT_ADDR] = 8
+	ram[OUTPUT_ADDR+4] = 1
+	fa := CheckpointPath(basedir, -1, 0)
+	WriteCheckpoint(ram, fa, 0)
+
+	ram[REG_PC] = 0x1004
+	ram[REG_OFFSET+29*4] = 0x7fffd000
+	ram[REG_HEAP] = 0x20001000
+	ram[OUTPUT_ADDR] = 4
+	ram[OUTPUT_ADDR+4] = 2
+	ram[OUTPUT_ADDR+8] = 3
+	ram[OUTPUT_ADDR+16] = 5
+	ram[HEAP_START] = 9
+	ram[INPUT_ADDR] = 0
+	fb := CheckpointPath(basedir, -1, 1)
+	WriteCheckpoint(ram, fb, 1)
+
+	d, err := DiffCheckpoints(fa, fb)
+	check(err)
+	if len(d.Regs) != 3 || d.Regs[0].Name != "$sp" || d.Regs[1].Name != "pc" || d.Regs[2] != (RegDiff{"heap", 0, 0x20001000}) {
+		t.Fatalf("registers %+v", d.Regs)
+	}
+	want := []MemRangeDiff{
+		{HEAP_START, HEAP_START + 4, "heap", []uint32{0}, []uint32{9}},
+		{INPUT_ADDR, INPUT_ADDR + 4, "input", []uint32{8}, []uint32{0}},
+		{OUTPUT_ADDR, OUTPUT_ADDR + 12, "output", []uint32{0, 1, 0}, []uint32{4, 2, 3}},
+		{OUTPUT_ADDR + 16, OUTPUT_ADDR + 20, "output", []uint32{0}, []uint32{5}},
+	}
+	if len(d.Ranges) != len(want) {
+		t.Fatalf("ranges %+v", d.Ranges)
+	}
+	for i, r := range d.Ranges {
+		if r.Start != want[i].Start || r.End != want[i].End || r.Region != want[i].Region || r.B[0] != want[i].B[0] {
+			t.Fatalf("range %d is %+v, want %+v", i, r, want[i])
+		}
+	}
+	out := d.String()
+	for _, want := range []string{
+		"     pc 00001000 -> 00001004\n",
+		"memory: 6 words in 4 ranges\n",
+		"  32000000-3200000c  output           3 words  00000000 -> 00000004",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("diff is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMemRegion(t *testing.T) {
+	for addr, want := range map[uint32]string{
+		0x1000:        "program",
+		0x20000000:    "heap",
+		0x30000800:    "magic",
+		0x30001004:    "oracle hash",
+		INPUT_ADDR:    "input",
+		OUTPUT_ADDR:   "output",
+		MODEL_ADDR:    "model",
+		BRK_START + 4: "brk heap",
+		0xc0000080:    "registers",
+	} {
+		if got := MemRegion(addr); got != want {
+			t.Fatalf("%x is in %s, want %s", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/oracle"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Commands are the subcommands of mlvm, anything else runs the vm as before
+var Commands = map[string]func(args []string) error{
+	"proof":     ProofCommand,
+	"witness":   WitnessCommand,
+	"verify":    VerifyCommand,
+	"inspect":   InspectCommand,
+	"tracediff": TraceDiffCommand,
+	"diff":      DiffCommand,
+	"debug":     DebugCommand,
+	"costmodel": CostModelCommand,
+	"estimate":  EstimateCommand,
+	"layout":    LayoutCommand,
+	"commit":    CommitCommand,
+}
+
+// parseAddrs reads a comma separated list of hex (0x) or decimal addresses
+func parseAddrs(s string) ([]uint32, error) {
+	var addrs []uint32
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		addr, err := strconv.ParseUint(a, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, uint32(addr))
+	}
+	return addrs, nil
+}
+
+func writeOutput(out string, dat []byte) error {
+	if out == "" {
+		fmt.Println(string(dat))
+		return nil
+	}
+	return ioutil.WriteFile(out, dat, 0644)
+}
+
+func ProofCommand(args []string) error {
+	fs := flag.NewFlagSet("proof", flag.ExitOnError)
+	checkpoint := fs.String("checkpoint", "", "Checkpoint json to prove against")
+	addr := fs.String("addr", "", "Comma separated word addresses to prove")
+	regs := fs.Bool("regs", false, "Also prove the registers")
+	out := fs.String("out", "", "Write the proof here instead of stdout")
+	fs.Parse(args)
+
+	if *checkpoint == "" {
+		return errors.New("proof needs --checkpoint")
+	}
+	addrs, err := parseAddrs(*addr)
+	if err != nil {
+		return err
+	}
+	if *regs {
+		addrs = append(addrs, RegisterAddrs()...)
+	}
+	proof, err := ProveCheckpoint(*checkpoint, addrs)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, proof.Json())
+}
+
+func WitnessCommand(args []string) error {
+	fs := flag.NewFlagSet("witness", flag.ExitOnError)
+	checkpoint := checkpointFlags(fs)
+	out := fs.String("out", "", "Write the witness here instead of stdout")
+	fs.Parse(args)
+
+	fn, err := checkpoint()
+	if err != nil {
+		return err
+	}
+	w, err := WitnessCheckpoint(fn)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, w.Json())
+}
+
+func VerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	witness := fs.String("witness", "", "Witness json to verify")
+	diff := fs.Bool("diff", false, "Compare the verifier against unicorn instead")
+	from := fs.Int("from", 0, "First step to compare")
+	count := fs.Int("count", 1000, "Number of steps to compare")
+	basedir := fs.String("basedir", "/tmp/cannon", "Directory the preimage oracle caches into")
+	program := fs.String("program", MIPS_PROGRAM, "MIPS program")
+	model := fs.String("model", "", "Model file")
+	data := fs.String("data", "", "Input data")
+	fs.BoolVar(&PagedInput, "pagedInput", false, "The input data was paged through the preimage oracle")
+	fs.BoolVar(&CommittedModel, "committedModel", false, "The model was committed to as a Merkle root")
+	layout := layoutFlag(fs)
+	fs.Parse(args)
+
+	oracle.SetRoot(*basedir)
+	if err := layout(); err != nil {
+		return err
+	}
+	if *diff {
+		return DiffStepsWithUnicorn(*basedir, programLoader(*basedir, *program, *model, *data), *from, *count)
+	}
+
+	if *witness == "" {
+		return errors.New("verify needs --witness or --diff")
+	}
+	dat, err := ioutil.ReadFile(*witness)
+	if err != nil {
+		return err
+	}
+	var w StepWitness
+	if err := json.Unmarshal(dat, &w); err != nil {
+		return err
+	}
+	root, err := VerifyStep(&w)
+	if err != nil {
+		return err
+	}
+	fmt.Println("post root", root)
+	if root != w.PostRoot {
+		return fmt.Errorf("witness claims post root %s", w.PostRoot)
+	}
+	return nil
+}
+
+// programLoader sets up step 0 the way MIPSRunCompatible does, root is
+// the preimage dir a paged input or committed model goes into
+func programLoader(root string, program string, model string, data string) func(mu uc.Unicorn, ram map[uint32](uint32)) {
+	return func(mu uc.Unicorn, ram map[uint32](uint32)) {
+		ZeroRegisters(ram)
+		LoadProgramUnicorn(mu, program, ram)
+		if data != "" {
+			check(LoadInput(mu, data, ram, root))
+		}
+		if model != "" {
+			check(LoadWeights(mu, model, ram, root))
+		}
+		SyncRegs(mu, ram)
+	}
+}
+
+// layoutFlag reads a layout manifest, applying it sets GuestLayout
+func layoutFlag(fs *flag.FlagSet) func() error {
+	layout := fs.String("layout", "", "Memory layout manifest (json) of the guest")
+	return func() error {
+		if *layout == "" {
+			return nil
+		}
+		l, err := ReadLayout(*layout)
+		if err != nil {
+			return err
+		}
+		return SetLayout(l)
+	}
+}
+
+// checkpointFlags picks a checkpoint either by file or by step, and
+// switches to the layout it was written with
+func checkpointFlags(fs *flag.FlagSet) func() (string, error) {
+	checkpoint := fs.String("checkpoint", "", "Checkpoint json")
+	basedir := fs.String("basedir", "/tmp/cannon", "Directory the checkpoints were written to")
+	step := fs.Int("step", -1, "Step of the checkpoint in basedir")
+	nodeID := fs.Int("nodeID", -1, "Node of the checkpoint, for checkpoints written by MIPSRun")
+	return func() (string, error) {
+		oracle.SetRoot(*basedir)
+		fn := *checkpoint
+		if fn == "" {
+			if *step < 0 {
+				return "", errors.New("needs --checkpoint or --step")
+			}
+			fn = CheckpointPath(*basedir, *nodeID, *step)
+		}
+		return fn, UseCheckpoint(fn)
+	}
+}
+
+func InspectCommand(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	checkpoint := checkpointFlags(fs)
+	count := fs.Int("count", 8, "Number of instructions to show from PC")
+	fs.Parse(args)
+
+	fn, err := checkpoint()
+	if err != nil {
+		return err
+	}
+	root, step, ram, err := LoadCheckpoint(fn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("step %d root %s\n\n", step, root)
+	fmt.Print(Inspect(ram, *count))
+	return nil
+}
+
+func TraceDiffCommand(args []string) error {
+	fs := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	context := fs.Int("context", 8, "Number of steps to show around the divergence")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return errors.New("usage: tracediff [--context N] a.trace b.trace")
+	}
+	a, err := OpenTrace(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := OpenTrace(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	d, err := DiffTraces(a, b, *context)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		fmt.Println("traces are the same")
+		return nil
+	}
+	fmt.Print(d)
+	return nil
+}
+
+func DiffCommand(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	basedir := fs.String("basedir", "/tmp/cannon", "Directory the preimage oracle caches into")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return errors.New("usage: diff [--basedir dir] a.json b.json")
+	}
+	oracle.SetRoot(*basedir)
+	if err := UseCheckpoint(fs.Arg(0)); err != nil {
+		return err
+	}
+	d, err := DiffCheckpoints(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Print(d)
+	return nil
+}
+
+func DebugCommand(args []string) error {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	basedir := fs.String("basedir", "/tmp/cannon", "Directory with the checkpoints to go back to")
+	nodeID := fs.Int("nodeID", -1, "Node of the checkpoints, for checkpoints written by MIPSRun")
+	step := fs.Int("step", 0, "Step to start at")
+	program := fs.String("program", MIPS_PROGRAM, "MIPS program, for going back past the first checkpoint")
+	model := fs.String("model", "", "Model file")
+	data := fs.String("data", "", "Input data")
+	fs.BoolVar(&PagedInput, "pagedInput", false, "The input data was paged through the preimage oracle")
+	fs.BoolVar(&CommittedModel, "committedModel", false, "The model was committed to as a Merkle root")
+	gdb := fs.String("gdb", "", "Serve gdb on unix:<path> or [tcp:]<host:port> instead of the prompt")
+	layout := layoutFlag(fs)
+	fs.Parse(args)
+
+	oracle.SetRoot(*basedir)
+	if err := layout(); err != nil {
+		return err
+	}
+	d := NewDebugger(*basedir, *nodeID, programLoader(*basedir, *program, *model, *data), os.Stdout)
+	if err := d.Goto(*step); err != nil {
+		return err
+	}
+	if *gdb != "" {
+		return ServeGDB(d, *gdb)
+	}
+	d.Repl(os.Stdin)
+	return nil
+}
+
+func CostModelCommand(args []string) error {
+	fs := flag.NewFlagSet("costmodel", flag.ExitOnError)
+	basedir := fs.String("basedir", "/tmp/cannon", "Directory for the node files")
+	modelName := fs.String("modelName", "MNIST", "run MNIST or LLAMA")
+	program := fs.String("program", MIPS_PROGRAM, "MIPS program")
+	nodes := fs.String("nodes", "", "Comma separated nodes to measure, all of them by default")
+	out := fs.String("out", "", "Write the cost model here instead of stdout")
+	fs.Parse(args)
+
+	oracle.SetRoot(*basedir)
+	var ids []int
+	if *nodes != "" {
+		list, err := parseAddrs(*nodes)
+		if err != nil {
+			return err
+		}
+		for _, id := range list {
+			ids = append(ids, int(id))
+		}
+	}
+	costs, err := MeasureNodes(*basedir, *modelName, *program, ids)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, NewCostModel(*modelName, *program, costs).Json())
+}
+
+func EstimateCommand(args []string) error {
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	modelName := fs.String("modelName", "MNIST", "run MNIST or LLAMA")
+	input := fs.String("input", "", "Input to estimate the model on, the data file for MNIST or the prompt for LLAMA, the default one if empty")
+	cost := fs.String("cost", "", "Cost model json from costmodel")
+	rate := fs.Float64("stepsPerSecond", 0, "Unicorn speed, the one the cost model was measured at by default")
+	checkpointEvery := fs.Int("checkpointEvery", 0, "Steps between the checkpoints a node's run writes, as in mlvm's -checkpointEvery. 0 only counts the one it ends on")
+	checkpoint := fs.String("checkpoint", "", "Checkpoint to sample step witnesses from, instead of going by the trie depth")
+	samples := fs.Int("samples", 16, "Number of step witnesses to sample")
+	basedir := fs.String("basedir", "/tmp/cannon", "Directory the preimage oracle caches into")
+	out := fs.String("out", "", "Also write the estimate as json here")
+	fs.Parse(args)
+
+	if *cost == "" {
+		return errors.New("estimate needs --cost")
+	}
+	oracle.SetRoot(*basedir)
+	m, err := LoadCostModel(*cost)
+	if err != nil {
+		return err
+	}
+	e, err := EstimateModel(*modelName, *input, m, *rate, *checkpointEvery)
+	if err != nil {
+		return err
+	}
+	if *checkpoint != "" {
+		if err := UseCheckpoint(*checkpoint); err != nil {
+			return err
+		}
+		if err := e.SampleWitnesses(*checkpoint, *samples); err != nil {
+			return err
+		}
+	}
+	fmt.Print(e)
+	if *out != "" {
+		return writeOutput(*out, e.Json())
+	}
+	return nil
+}
+
+// LayoutCommand checks a layout manifest and prints it with the defaults
+// filled in, or prints the layout of a golden checkpoint or the default one
+func LayoutCommand(args []string) error {
+	fs := flag.NewFlagSet("layout", flag.ExitOnError)
+	golden := fs.String("golden", "", "Print the layout embedded in this golden checkpoint")
+	out := fs.String("out", "", "Write the layout here instead of stdout")
+	fs.Parse(args)
+
+	l := DefaultLayout()
+	switch {
+	case fs.NArg() == 1:
+		var err error
+		if l, err = ReadLayout(fs.Arg(0)); err != nil {
+			return err
+		}
+	case *golden != "":
+		dat, err := ioutil.ReadFile(*golden)
+		if err != nil {
+			return err
+		}
+		var j Jtree
+		if err := json.Unmarshal(dat, &j); err != nil {
+			return err
+		}
+		if j.Layout == nil {
+			return fmt.Errorf("%s has no layout, it isn't golden or predates layouts", *golden)
+		}
+		l = *j.Layout
+	case fs.NArg() > 1:
+		return errors.New("usage: layout [--golden checkpoint.json] [--out f] [manifest.json]")
+	}
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	return writeOutput(*out, l.Json())
+}
+
+// CommitCommand commits to a model the way -committedModel does and prints
+// the commitment, its root is what goes on chain
+func CommitCommand(args []string) error {
+	fs := flag.NewFlagSet("commit", flag.ExitOnError)
+	basedir := fs.String("basedir", "/tmp/cannon", "Preimage dir to write the chunks and nodes to")
+	model := fs.String("model", "", "Model file")
+	chunkSize := fs.Uint("chunkSize", uint(ModelChunkSize), "Bytes per chunk")
+	out := fs.String("out", "", "Write the commitment here instead of stdout")
+	fs.Parse(args)
+
+	if *model == "" {
+		return errors.New("commit needs --model")
+	}
+	dat, err := ioutil.ReadFile(*model)
+	if err != nil {
+		return err
+	}
+	c, err := CommitModel(*basedir, dat, uint32(*chunkSize))
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, c.Json())
+}
@@ -0,0 +1,317 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// StateCommitment is a way of hashing the ram into a state root. The MPT is
+// what MIPS.sol verifies, the others are here to compare against it.
+type StateCommitment interface {
+	Name() string
+	// Commit hashes ram, and keeps what it needs to prove words in it
+	Commit(ram map[uint32](uint32)) common.Hash
+	// Prove returns the nodes needed to read the word at addr from the last root
+	Prove(addr uint32) ([][]byte, error)
+	// Verify checks proof against root and returns the word at addr
+	Verify(root common.Hash, addr uint32, proof [][]byte) (uint32, error)
+}
+
+type MissingNodeError struct {
+	Hash common.Hash
+}
+
+func (e *MissingNodeError) Error() string {
+	return fmt.Sprintf("missing trie node %s", e.Hash)
+}
+
+var ErrBadProof = errors.New("proof doesn't match root")
+
+// MPTCommitment is the Merkle Patricia Trie over 4 byte word keys that
+// RamToTrie builds, with the nodes living in Preimages
+type MPTCommitment struct {
+	root common.Hash
+}
+
+func (c *MPTCommitment) Name() string {
+	return "mpt"
+}
+
+func (c *MPTCommitment) Commit(ram map[uint32](uint32)) common.Hash {
+	c.root = RamToTrieParallel(ram)
+	return c.root
+}
+
+func (c *MPTCommitment) Prove(addr uint32) ([][]byte, error) {
+	var proof [][]byte
+	_, _, err := TrieGet(c.root, addr, func(hash common.Hash) ([]byte, error) {
+		node, ok := Preimages[hash]
+		if !ok {
+			return nil, &MissingNodeError{hash}
+		}
+		proof = append(proof, node)
+		return node, nil
+	})
+	return proof, err
+}
+
+func (c *MPTCommitment) Verify(root common.Hash, addr uint32, proof [][]byte) (uint32, error) {
+	nodes := make(map[common.Hash][]byte)
+	for _, node := range proof {
+		nodes[crypto.Keccak256Hash(node)] = node
+	}
+	value, _, err := TrieGet(root, addr, func(hash common.Hash) ([]byte, error) {
+		node, ok := nodes[hash]
+		if !ok {
+			return nil, &MissingNodeError{hash}
+		}
+		return node, nil
+	})
+	return value, err
+}
+
+// TrieGet reads the word at addr by walking down from root, the same way
+// Lib_MerkleTrie.get does on chain. fetch is called once for every hashed
+// node on the path, in order from the root. A missing leaf reads as zero.
+func TrieGet(root common.Hash, addr uint32, fetch func(common.Hash) ([]byte, error)) (uint32, bool, error) {
+	key := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		key[i] = byte((addr >> 2) >> (28 - 4*i) & 0xf)
+	}
+
+	node, err := fetch(root)
+	if err != nil {
+		return 0, false, err
+	}
+	for {
+		elems, _, err := rlp.SplitList(node)
+		if err != nil {
+			return 0, false, err
+		}
+		c, err := rlp.CountValues(elems)
+		if err != nil {
+			return 0, false, err
+		}
+
+		var child []byte
+		if c == 17 {
+			if len(key) == 0 {
+				return 0, false, ErrBadProof
+			}
+			for i := byte(0); i < key[0]; i++ {
+				if _, _, elems, err = rlp.Split(elems); err != nil {
+					return 0, false, err
+				}
+			}
+			child = firstItem(elems)
+			key = key[1:]
+		} else if c == 2 {
+			_, compact, rest, err := rlp.Split(elems)
+			if err != nil {
+				return 0, false, err
+			}
+			path, leaf := compactToNibbles(compact)
+			if len(path) > len(key) || string(path) != string(key[:len(path)]) {
+				// the key diverges here, so it isn't in the trie
+				return 0, false, nil
+			}
+			key = key[len(path):]
+			if leaf {
+				_, val, _, err := rlp.Split(rest)
+				if err != nil {
+					return 0, false, err
+				}
+				if len(key) != 0 || len(val) != 4 {
+					return 0, false, ErrBadProof
+				}
+				return binary.BigEndian.Uint32(val), true, nil
+			}
+			child = firstItem(rest)
+		} else {
+			return 0, false, ErrBadProof
+		}
+
+		kind, val, _, err := rlp.Split(child)
+		if err != nil {
+			return 0, false, err
+		}
+		if kind == rlp.List {
+			// short nodes are embedded in their parent
+			node = child
+		} else if len(val) == 32 {
+			if node, err = fetch(common.BytesToHash(val)); err != nil {
+				return 0, false, err
+			}
+		} else if len(val) == 0 {
+			return 0, false, nil
+		} else {
+			return 0, false, ErrBadProof
+		}
+	}
+}
+
+// firstItem returns the whole rlp encoding of the first item in elems
+func firstItem(elems []byte) []byte {
+	_, _, rest, err := rlp.Split(elems)
+	if err != nil {
+		return nil
+	}
+	return elems[:len(elems)-len(rest)]
+}
+
+func compactToNibbles(compact []byte) ([]byte, bool) {
+	if len(compact) == 0 {
+		return nil, false
+	}
+	flag := compact[0] >> 4
+	var nibbles []byte
+	if flag&1 == 1 {
+		nibbles = append(nibbles, compact[0]&0xf)
+	}
+	for _, b := range compact[1:] {
+		nibbles = append(nibbles, b>>4, b&0xf)
+	}
+	return nibbles, flag&2 == 2
+}
+
+// PagedMerkleCommitment is a binary keccak Merkle tree whose leaves are
+// the hashes of fixed size pages of memory. A word is proven by its whole page
+// followed by the sibling hashes from the bottom up.
+type PagedMerkleCommitment struct {
+	PageBits int
+
+	zeroHashes []common.Hash
+	pages      map[uint32][]byte
+	// levels[h] holds the non zero subtrees of height h, sorted by index
+	levels []pagedLevel
+}
+
+type pagedLevel struct {
+	index []uint32
+	hash  []common.Hash
+}
+
+func NewPagedMerkleCommitment(pageSize int) *PagedMerkleCommitment {
+	c := &PagedMerkleCommitment{}
+	for 1<<c.PageBits < pageSize {
+		c.PageBits++
+	}
+	if 1<<c.PageBits != pageSize || pageSize < 4 {
+		panic("page size must be a power of 2 of at least a word")
+	}
+
+	c.zeroHashes = []common.Hash{crypto.Keccak256Hash(make([]byte, pageSize))}
+	for i := 0; i < c.depth(); i++ {
+		z := c.zeroHashes[i]
+		c.zeroHashes = append(c.zeroHashes, crypto.Keccak256Hash(z[:], z[:]))
+	}
+	return c
+}
+
+func (c *PagedMerkleCommitment) Name() string {
+	return fmt.Sprintf("paged-%d", 1<<c.PageBits)
+}
+
+func (c *PagedMerkleCommitment) depth() int {
+	return 32 - c.PageBits
+}
+
+func (c *PagedMerkleCommitment) Commit(ram map[uint32](uint32)) common.Hash {
+	c.pages = make(map[uint32][]byte)
+	for addr, value := range ram {
+		if value == 0 {
+			continue
+		}
+		page, ok := c.pages[addr>>c.PageBits]
+		if !ok {
+			page = make([]byte, 1<<c.PageBits)
+			c.pages[addr>>c.PageBits] = page
+		}
+		binary.BigEndian.PutUint32(page[addr&(1<<c.PageBits-1):], value)
+	}
+
+	var level pagedLevel
+	for i := range c.pages {
+		level.index = append(level.index, i)
+	}
+	sort.Slice(level.index, func(i, j int) bool { return level.index[i] < level.index[j] })
+	for _, i := range level.index {
+		level.hash = append(level.hash, crypto.Keccak256Hash(c.pages[i]))
+	}
+
+	c.levels = []pagedLevel{level}
+	for h := 0; h < c.depth(); h++ {
+		var parent pagedLevel
+		for j := 0; j < len(level.index); j++ {
+			i := level.index[j]
+			left, right := c.zeroHashes[h], c.zeroHashes[h]
+			if i&1 == 0 {
+				left = level.hash[j]
+				if j+1 < len(level.index) && level.index[j+1] == i|1 {
+					j++
+					right = level.hash[j]
+				}
+			} else {
+				right = level.hash[j]
+			}
+			parent.index = append(parent.index, i>>1)
+			parent.hash = append(parent.hash, crypto.Keccak256Hash(left[:], right[:]))
+		}
+		level = parent
+		c.levels = append(c.levels, level)
+	}
+	return c.node(c.depth(), 0)
+}
+
+func (c *PagedMerkleCommitment) node(height int, i uint32) common.Hash {
+	level := c.levels[height]
+	j := sort.Search(len(level.index), func(j int) bool { return level.index[j] >= i })
+	if j < len(level.index) && level.index[j] == i {
+		return level.hash[j]
+	}
+	return c.zeroHashes[height]
+}
+
+func (c *PagedMerkleCommitment) Prove(addr uint32) ([][]byte, error) {
+	if c.levels == nil {
+		return nil, errors.New("nothing committed")
+	}
+	i := addr >> c.PageBits
+	page, ok := c.pages[i]
+	if !ok {
+		page = make([]byte, 1<<c.PageBits)
+	}
+	proof := [][]byte{page}
+	for h := 0; h < c.depth(); h++ {
+		sibling := c.node(h, i^1)
+		proof = append(proof, sibling.Bytes())
+		i >>= 1
+	}
+	return proof, nil
+}
+
+func (c *PagedMerkleCommitment) Verify(root common.Hash, addr uint32, proof [][]byte) (uint32, error) {
+	if len(proof) != c.depth()+1 || len(proof[0]) != 1<<c.PageBits {
+		return 0, ErrBadProof
+	}
+	i := addr >> c.PageBits
+	hash := crypto.Keccak256Hash(proof[0])
+	for _, sibling := range proof[1:] {
+		if i&1 == 0 {
+			hash = crypto.Keccak256Hash(hash[:], sibling)
+		} else {
+			hash = crypto.Keccak256Hash(sibling, hash[:])
+		}
+		i >>= 1
+	}
+	if hash != root {
+		return 0, ErrBadProof
+	}
+	return binary.BigEndian.Uint32(proof[0][addr&(1<<c.PageBits-1)&^3:]), nil
+}
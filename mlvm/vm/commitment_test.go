@@ -0,0 +1,75 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func commitments() []StateCommitment {
+	return []StateCommitment{
+		&MPTCommitment{},
+		NewPagedMerkleCommitment(32),
+		NewPagedMerkleCommitment(4096),
+	}
+}
+
+func TestStateCommitmentProofs(t *testing.T) {
+	ram := randomRam(10000, 3)
+	addrs := []uint32{0xc0000000, 0x31000004, 0x7ffffffc, 0x5ead0000}
+	for addr := range ram {
+		addrs = append(addrs, addr)
+		if len(addrs) == 100 {
+			break
+		}
+	}
+
+	for _, c := range commitments() {
+		Preimages = make(map[common.Hash][]byte)
+		root := c.Commit(ram)
+		for _, addr := range addrs {
+			proof, err := c.Prove(addr)
+			if err != nil {
+				t.Fatalf("%s: prove %x: %v", c.Name(), addr, err)
+			}
+			value, err := c.Verify(root, addr, proof)
+			if err != nil {
+				t.Fatalf("%s: verify %x: %v", c.Name(), addr, err)
+			}
+			if value != ram[addr] {
+				t.Fatalf("%s: %x proved %x, want %x", c.Name(), addr, value, ram[addr])
+			}
+		}
+
+		proof, _ := c.Prove(addrs[0])
+		proof[len(proof)-1] = append([]byte{}, proof[len(proof)-1]...)
+		proof[len(proof)-1][0] ^= 1
+		if _, err := c.Verify(root, addrs[0], proof); err == nil {
+			t.Fatalf("%s: tampered proof verified", c.Name())
+		}
+	}
+}
+
+func BenchmarkStateCommitment(b *testing.B) {
+	ram := randomRam(1000000, 5)
+	for _, c := range commitments() {
+		b.Run(c.Name(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Preimages = make(map[common.Hash][]byte)
+				c.Commit(ram)
+			}
+
+			size, count := 0, 0
+			for addr := range ram {
+				proof, _ := c.Prove(addr)
+				for _, node := range proof {
+					size += len(node)
+				}
+				if count++; count == 1000 {
+					break
+				}
+			}
+			b.ReportMetric(float64(size)/float64(count), "proof-bytes")
+		})
+	}
+}
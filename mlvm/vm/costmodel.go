@@ -0,0 +1,329 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"mlgo/ml"
+)
+
+// names of mlgo's ops. The OP_ constants are exported but their type and
+// the op field aren't, so this is keyed by the constants rather than copied
+// in order.
+var opNames = map[int]string{
+	int(ml.OP_NONE): "NONE", int(ml.OP_DUP): "DUP", int(ml.OP_ADD): "ADD",
+	int(ml.OP_SUB): "SUB", int(ml.OP_MUL): "MUL", int(ml.OP_DIV): "DIV",
+	int(ml.OP_SQR): "SQR", int(ml.OP_SQRT): "SQRT", int(ml.OP_SUM): "SUM",
+	int(ml.OP_MEAN): "MEAN", int(ml.OP_REPEAT): "REPEAT", int(ml.OP_ABS): "ABS",
+	int(ml.OP_SGN): "SGN", int(ml.OP_NEG): "NEG", int(ml.OP_STEP): "STEP",
+	int(ml.OP_RELU): "RELU", int(ml.OP_GELU): "GELU", int(ml.OP_SILU): "SILU",
+	int(ml.OP_NORM): "NORM", int(ml.OP_RMS_NORM): "RMS_NORM",
+	int(ml.OP_MUL_MAT): "MUL_MAT", int(ml.OP_SCALE): "SCALE", int(ml.OP_CPY): "CPY",
+	int(ml.OP_RESHAPE): "RESHAPE", int(ml.OP_VIEW): "VIEW",
+	int(ml.OP_PERMUTE): "PERMUTE", int(ml.OP_TRANSPOSE): "TRANSPOSE",
+	int(ml.OP_GET_ROWS): "GET_ROWS", int(ml.OP_DIAG_MASK_INF): "DIAG_MASK_INF",
+	int(ml.OP_SOFT_MAX): "SOFT_MAX", int(ml.OP_ROPE): "ROPE",
+	int(ml.OP_CONV_1D_1S): "CONV_1D_1S", int(ml.OP_CONV_1D_2S): "CONV_1D_2S",
+	int(ml.OP_FLASH_ATTN): "FLASH_ATTN", int(ml.OP_FLASH_FF): "FLASH_FF",
+}
+
+// TensorOp names the op of a graph node. The op field isn't exported by
+// mlgo, so it's read with reflect, and anything that isn't the integer it
+// was when this was written comes out as UNKNOWN.
+func TensorOp(t *ml.Tensor) string {
+	f := reflect.ValueOf(t).Elem().FieldByName("op")
+	var op int
+	switch f.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		op = int(f.Uint())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		op = int(f.Int())
+	default:
+		return "UNKNOWN"
+	}
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_%d", op)
+}
+
+func TensorShape(t *ml.Tensor) []uint32 {
+	if t == nil {
+		return nil
+	}
+	return append([]uint32{}, t.NE[:t.Dims]...)
+}
+
+func shapeString(shape []uint32) string {
+	dims := make([]string, len(shape))
+	for i, d := range shape {
+		dims[i] = fmt.Sprint(d)
+	}
+	return strings.Join(dims, "x")
+}
+
+// costShape is the shape a node is looked up by in the cost table
+func costShape(op string, shape []uint32, src0 []uint32, src1 []uint32) string {
+	if op == "MUL_MAT" {
+		// the work of a matmul is in its sources, not its output
+		return shapeString(src0) + "*" + shapeString(src1)
+	}
+	return shapeString(shape)
+}
+
+// NodeCost is what running one graph node in MIPS took
+type NodeCost struct {
+	NodeID int      `json:"node"`
+	Op     string   `json:"op"`
+	Shape  []uint32 `json:"shape"`
+	Src0   []uint32 `json:"src0,omitempty"`
+	Src1   []uint32 `json:"src1,omitempty"`
+	Steps  int      `json:"steps"`
+	// memory only ever grows, so the end of the run is the peak: the bytes
+	// mmapped by the guest and the bytes of every word ever touched
+	HeapBytes uint32 `json:"heapBytes"`
+	RamBytes  int    `json:"ramBytes"`
+	// wall time of the MIPS run, and of writing a checkpoint of where it
+	// ended, its trie and json
+	Seconds           float64 `json:"seconds"`
+	CheckpointSeconds float64 `json:"checkpointSeconds"`
+}
+
+func elements(shape []uint32) int {
+	e := 1
+	for _, d := range shape {
+		e *= int(d)
+	}
+	return e
+}
+
+// Elements is the size of the node's output
+func (n *NodeCost) Elements() int {
+	return elements(n.Shape)
+}
+
+// Work is what the steps of the node's op grow with, the elements of its
+// output, except for a matmul, whose output doesn't say how long its rows
+// were. That's its multiply-adds, the elements of src0 times the columns
+// of src1, which share src0's rows.
+func (n *NodeCost) Work() int {
+	if n.Op == "MUL_MAT" && len(n.Src0) > 0 && len(n.Src1) > 0 && n.Src1[0] != 0 {
+		return elements(n.Src0) * (elements(n.Src1) / int(n.Src1[0]))
+	}
+	return n.Elements()
+}
+
+// CostEntry is every node of one op and shape
+type CostEntry struct {
+	Op       string `json:"op"`
+	Shape    string `json:"shape"`
+	Nodes    int    `json:"nodes"`
+	MinSteps int    `json:"minSteps"`
+	MaxSteps int    `json:"maxSteps"`
+	Steps    int    `json:"steps"`
+}
+
+// CostFit is a least squares fit of steps = Base + PerElement*work of an op,
+// over all the shapes it was seen with, see NodeCost.Work
+type CostFit struct {
+	Op         string  `json:"op"`
+	Base       float64 `json:"base"`
+	PerElement float64 `json:"perElement"`
+}
+
+type CostModel struct {
+	Model   string      `json:"model"`
+	Program string      `json:"program"`
+	Nodes   []NodeCost  `json:"nodes"`
+	Table   []CostEntry `json:"table"`
+	Fits    []CostFit   `json:"fits"`
+}
+
+// MIPSRunNode runs the program on a node file to the end, without writing
+// any checkpoints, and returns the steps, the heap it took and the final ram
+func MIPSRunNode(basedir string, programPath string, inputPath string) (int, uint32, map[uint32](uint32)) {
+	ResetHeap()
+	steps = 0
+	c := loadNodeUnicorn(basedir, programPath, inputPath)
+	defer c.Mu.Close()
+	check(c.RunTo(-1))
+	return c.Step, uint32(heap_start), c.Ram
+}
+
+// MeasureNodes runs each node of the graph through LayerRun and MIPSRun's
+// path and records its cost. nodes selects which, nil for all of them.
+func MeasureNodes(basedir string, modelName string, programPath string, nodes []int) ([]NodeCost, error) {
+	graph, _, err := ModelGraph(modelName, "")
+	if err != nil {
+		return nil, err
+	}
+	if nodes == nil {
+		for i := 0; i < int(graph.NodesCount); i++ {
+			nodes = append(nodes, i)
+		}
+	}
+	check(os.MkdirAll(basedir+"/data", 0755))
+
+	var costs []NodeCost
+	for _, id := range nodes {
+		if id < 0 || id >= int(graph.NodesCount) {
+			return nil, fmt.Errorf("node %d out of %d", id, graph.NodesCount)
+		}
+		nodeFile, _, err := LayerRun(basedir+"/data", id, modelName)
+		if err != nil {
+			return nil, err
+		}
+		node := graph.Nodes[id]
+		cost := NodeCost{NodeID: id, Op: TensorOp(node), Shape: TensorShape(node), Src0: TensorShape(node.Src0), Src1: TensorShape(node.Src1)}
+		start := time.Now()
+		steps, heap, ram := MIPSRunNode(basedir, programPath, nodeFile)
+		cost.Seconds = time.Since(start).Seconds()
+		cost.Steps, cost.HeapBytes, cost.RamBytes = steps, heap, 4*len(ram)
+
+		// a node's run starts with no preimages, so the checkpoint is only
+		// its own trie
+		Preimages = make(map[common.Hash][]byte)
+		start = time.Now()
+		WriteCheckpoint(ram, fmt.Sprintf("%s/data/node_%d_checkpoint.json", basedir, id), steps)
+		cost.CheckpointSeconds = time.Since(start).Seconds()
+		fmt.Printf("node %d %s %s: %d steps\n", id, cost.Op, shapeString(cost.Shape), cost.Steps)
+		costs = append(costs, cost)
+	}
+	return costs, nil
+}
+
+// NewCostModel groups the node costs by op and shape and fits each op
+func NewCostModel(model string, program string, nodes []NodeCost) *CostModel {
+	m := &CostModel{Model: model, Program: program, Nodes: nodes}
+
+	entries := make(map[string]*CostEntry)
+	byOp := make(map[string][]NodeCost)
+	for _, n := range nodes {
+		shape := costShape(n.Op, n.Shape, n.Src0, n.Src1)
+		key := n.Op + " " + shape
+		e, ok := entries[key]
+		if !ok {
+			e = &CostEntry{Op: n.Op, Shape: shape, MinSteps: n.Steps}
+			entries[key] = e
+		}
+		e.Nodes++
+		e.Steps += n.Steps
+		if n.Steps < e.MinSteps {
+			e.MinSteps = n.Steps
+		}
+		if n.Steps > e.MaxSteps {
+			e.MaxSteps = n.Steps
+		}
+		byOp[n.Op] = append(byOp[n.Op], n)
+	}
+	for _, e := range entries {
+		// mean over the nodes
+		e.Steps /= e.Nodes
+		m.Table = append(m.Table, *e)
+	}
+	sort.Slice(m.Table, func(i, j int) bool {
+		if m.Table[i].Op != m.Table[j].Op {
+			return m.Table[i].Op < m.Table[j].Op
+		}
+		return m.Table[i].Shape < m.Table[j].Shape
+	})
+
+	for op, ns := range byOp {
+		m.Fits = append(m.Fits, fitCost(op, ns))
+	}
+	sort.Slice(m.Fits, func(i, j int) bool { return m.Fits[i].Op < m.Fits[j].Op })
+	return m
+}
+
+func fitCost(op string, nodes []NodeCost) CostFit {
+	var n, sx, sy, sxx, sxy float64
+	for _, node := range nodes {
+		x, y := float64(node.Work()), float64(node.Steps)
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	fit := CostFit{Op: op}
+	if d := n*sxx - sx*sx; d != 0 {
+		fit.PerElement = (n*sxy - sx*sy) / d
+		fit.Base = (sy - fit.PerElement*sx) / n
+	} else {
+		// one size only, all of it is the base cost
+		fit.Base = sy / n
+	}
+	return fit
+}
+
+// Steps estimates a node from the table, the fit of its op for the node's
+// work when its shape wasn't measured, and the slowest op when neither is
+// known
+func (m *CostModel) Steps(op string, shape string, work int) int {
+	for _, e := range m.Table {
+		if e.Op == op && e.Shape == shape {
+			return e.Steps
+		}
+	}
+	for _, f := range m.Fits {
+		if f.Op == op {
+			// a fit can slope down, far enough out it's below zero
+			return int(math.Max(0, f.Base+f.PerElement*float64(work)))
+		}
+	}
+	worst := 0
+	for _, e := range m.Table {
+		if e.MaxSteps > worst {
+			worst = e.MaxSteps
+		}
+	}
+	return worst
+}
+
+// CheckpointSeconds is the slowest checkpoint write measured, the one of the
+// biggest ram
+func (m *CostModel) CheckpointSeconds() float64 {
+	seconds := 0.0
+	for _, n := range m.Nodes {
+		seconds = math.Max(seconds, n.CheckpointSeconds)
+	}
+	return seconds
+}
+
+// StepsPerSecond is how fast unicorn ran the measured nodes
+func (m *CostModel) StepsPerSecond() float64 {
+	steps, seconds := 0, 0.0
+	for _, n := range m.Nodes {
+		steps += n.Steps
+		seconds += n.Seconds
+	}
+	if seconds == 0 {
+		return 0
+	}
+	return float64(steps) / seconds
+}
+
+func (m *CostModel) Json() []byte {
+	dat, err := json.MarshalIndent(m, "", "  ")
+	check(err)
+	return dat
+}
+
+func LoadCostModel(fn string) (*CostModel, error) {
+	dat, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var m CostModel
+	if err := json.Unmarshal(dat, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"mlgo/ml"
+)
+
+func TestTensorOp(t *testing.T) {
+	node := &ml.Tensor{Dims: 2, NE: [4]uint32{10, 3, 1, 1}}
+	if op := TensorOp(node); op != "NONE" {
+		t.Fatal("op", op)
+	}
+	if shape := shapeString(TensorShape(node)); shape != "10x3" {
+		t.Fatal("shape", shape)
+	}
+
+	// the ops of a built graph, the way mnist builds it
+	ctx := &ml.Context{}
+	input := ml.NewTensor1D(ctx, ml.TYPE_F32, 4)
+	weight := ml.NewTensor2D(ctx, ml.TYPE_F32, 4, 3)
+	bias := ml.NewTensor1D(ctx, ml.TYPE_F32, 3)
+	fc := ml.Add(ctx, ml.MulMat(ctx, weight, input), bias)
+	final := ml.SoftMax(ctx, ml.Relu(ctx, fc))
+	for _, c := range []struct {
+		node *ml.Tensor
+		op   string
+	}{
+		{final, "SOFT_MAX"}, {final.Src0, "RELU"}, {fc, "ADD"}, {fc.Src0, "MUL_MAT"}, {input, "NONE"},
+	} {
+		if op := TensorOp(c.node); op != c.op {
+			t.Fatal("op", op, "want", c.op)
+		}
+	}
+
+	// every op mlgo has is named
+	for op := 0; op < int(ml.OP_COUNT); op++ {
+		if _, ok := opNames[op]; !ok {
+			t.Fatal("no name for op", op)
+		}
+	}
+}
+
+// a matmul is fitted by its sources: these have the same output, but the
+// second's rows are ten times as long
+func TestCostModelMulMat(t *testing.T) {
+	m := NewCostModel("MNIST", "mlgo.bin", []NodeCost{
+		{Op: "MUL_MAT", Shape: []uint32{4, 2}, Src0: []uint32{10, 4}, Src1: []uint32{10, 2}, Steps: 1400},
+		{Op: "MUL_MAT", Shape: []uint32{4, 2}, Src0: []uint32{100, 4}, Src1: []uint32{100, 2}, Steps: 5000},
+	})
+	// 1000 steps plus 5 per multiply-add
+	if f := m.Fits[0]; int(f.Base+0.5) != 1000 || int(f.PerElement+0.5) != 5 {
+		t.Fatal("fit", f)
+	}
+	n := NodeCost{Op: "MUL_MAT", Shape: []uint32{4, 2}, Src0: []uint32{200, 4}, Src1: []uint32{200, 2}}
+	if n.Work() != 1600 {
+		t.Fatal("work", n.Work())
+	}
+	if steps := m.Steps(n.Op, costShape(n.Op, n.Shape, n.Src0, n.Src1), n.Work()); steps != 9000 {
+		t.Fatal("fit steps", steps)
+	}
+}
+
+func TestCostModel(t *testing.T) {
+	nodes := []NodeCost{
+		{NodeID: 0, Op: "ADD", Shape: []uint32{10}, Steps: 1100},
+		{NodeID: 1, Op: "ADD", Shape: []uint32{10}, Steps: 1100},
+		{NodeID: 2, Op: "ADD", Shape: []uint32{20}, Steps: 1200},
+		{NodeID: 3, Op: "MUL_MAT", Shape: []uint32{10}, Src0: []uint32{4, 10}, Src1: []uint32{4}, Steps: 5000},
+		{NodeID: 4, Op: "MUL_MAT", Shape: []uint32{10}, Src0: []uint32{4, 10}, Src1: []uint32{4}, Steps: 6000},
+	}
+	m := NewCostModel("MNIST", "mlgo.bin", nodes)
+
+	if len(m.Table) != 3 {
+		t.Fatal("table", m.Table)
+	}
+	if e := m.Table[2]; e.Op != "MUL_MAT" || e.Shape != "4x10*4" || e.Nodes != 2 || e.MinSteps != 5000 || e.MaxSteps != 6000 || e.Steps != 5500 {
+		t.Fatal("mul_mat", e)
+	}
+	// ADD is 1000 steps plus 10 per element
+	if f := m.Fits[0]; f.Op != "ADD" || int(f.Base+0.5) != 1000 || int(f.PerElement+0.5) != 10 {
+		t.Fatal("fit", f)
+	}
+	if steps := m.Steps("ADD", "40", 40); steps != 1400 {
+		t.Fatal("fit steps", steps)
+	}
+	if steps := m.Steps("SOFT_MAX", "10", 10); steps != 6000 {
+		t.Fatal("unknown op steps", steps)
+	}
+	// a fit that slopes down stops at 0
+	down := NewCostModel("MNIST", "mlgo.bin", []NodeCost{
+		{Op: "ADD", Shape: []uint32{10}, Steps: 1000},
+		{Op: "ADD", Shape: []uint32{20}, Steps: 100},
+	})
+	if steps := down.Steps("ADD", "1000", 1000); steps != 0 {
+		t.Fatal("negative fit steps", steps)
+	}
+
+	var back CostModel
+	if err := json.Unmarshal(m.Json(), &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back.Nodes) != 5 || back.Table[0] != m.Table[0] {
+		t.Fatal("json", back)
+	}
+}
@@ -0,0 +1,346 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// ListCheckpoints returns the steps that have a checkpoint in basedir, sorted
+func ListCheckpoints(basedir string, nodeID int) []int {
+	prefix := strings.TrimSuffix(CheckpointPath(basedir, nodeID, 0), "0.json")
+	files, _ := filepath.Glob(prefix + "*.json")
+	var steps []int
+	for _, fn := range files {
+		// skips checkpoint_final.json and the checkpoints of other nodes
+		step, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(fn, prefix), ".json"))
+		if err == nil {
+			steps = append(steps, step)
+		}
+	}
+	sort.Ints(steps)
+	return steps
+}
+
+// RestoreUnicorn puts ram, registers included, back into a fresh unicorn
+func RestoreUnicorn(mu uc.Unicorn, ram map[uint32](uint32)) {
+	addrs := make([]uint32, 0, len(ram))
+	for addr := range ram {
+		if addr < REG_OFFSET {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	// write runs of consecutive words in one go
+	var run []byte
+	start := uint32(0)
+	for i, addr := range addrs {
+		if i == 0 || addr != start+uint32(len(run)) {
+			if len(run) > 0 {
+				check(mu.MemWrite(uint64(start), run))
+			}
+			start, run = addr, run[:0]
+		}
+		run = binary.BigEndian.AppendUint32(run, ram[addr])
+	}
+	if len(run) > 0 {
+		check(mu.MemWrite(uint64(start), run))
+	}
+
+	s := StateFromRam(ram)
+	for i, value := range s.GPR {
+		mu.RegWrite(uc.MIPS_REG_ZERO+i, uint64(value))
+	}
+	mu.RegWrite(uc.MIPS_REG_PC, uint64(s.PC))
+	mu.RegWrite(uc.MIPS_REG_HI, uint64(s.HI))
+	mu.RegWrite(uc.MIPS_REG_LO, uint64(s.LO))
+	heap_start = uint64(s.Heap)
+	brk_size = uint64(s.Brk)
+}
+
+// Debugger runs a program under the chunked runner, stopping at breakpoints
+// and watched words. Going back is done by restoring the nearest checkpoint
+// at or before the target, or the start, and running forward again.
+type Debugger struct {
+	Basedir string
+	NodeID  int
+	// Load sets up the program at step 0
+	Load func(mu uc.Unicorn, ram map[uint32](uint32))
+
+	c       *ChunkedUnicorn
+	breaks  map[uint32]bool
+	watches map[uint32]uint32
+	out     io.Writer
+}
+
+func NewDebugger(basedir string, nodeID int, load func(mu uc.Unicorn, ram map[uint32](uint32)), out io.Writer) *Debugger {
+	return &Debugger{Basedir: basedir, NodeID: nodeID, Load: load, breaks: make(map[uint32]bool), watches: make(map[uint32]uint32), out: out}
+}
+
+// Step is the step the debugger is stopped at
+func (d *Debugger) Step() int {
+	return d.c.Step
+}
+
+func (d *Debugger) Ram() map[uint32](uint32) {
+	return d.c.Ram
+}
+
+// Goto moves to step, from a checkpoint if it lies behind the current one.
+// Breakpoints and watches don't stop it.
+func (d *Debugger) Goto(step int) error {
+	if d.c == nil || step < d.c.Step {
+		if err := d.restore(step); err != nil {
+			return err
+		}
+	}
+	if err := d.c.RunTo(step); err != nil {
+		return err
+	}
+	d.sync()
+	return nil
+}
+
+// restore starts over from the last checkpoint at or before step
+func (d *Debugger) restore(step int) error {
+	if d.c != nil {
+		d.c.Mu.Close()
+	}
+	from := -1
+	for _, s := range ListCheckpoints(d.Basedir, d.NodeID) {
+		if s <= step {
+			from = s
+		}
+	}
+
+	var ram map[uint32](uint32)
+	if from >= 0 {
+		_, _, loaded, err := LoadCheckpoint(CheckpointPath(d.Basedir, d.NodeID, from))
+		if err != nil {
+			return err
+		}
+		ram = loaded
+	} else {
+		ram = make(map[uint32](uint32))
+		from = 0
+	}
+	d.c = GetChunkedUnicorn(d.Basedir, ram)
+	if len(ram) > 0 {
+		RestoreUnicorn(d.c.Mu, ram)
+		// the oracle window isn't in ram, it's the preimage of the hash
+		hostPreimage(d.c.Mu, d.Basedir, ram)
+		d.c.Exited = StateFromRam(ram).PC == HALT_PC+4
+	} else {
+		ResetHeap()
+		d.Load(d.c.Mu, ram)
+	}
+	d.c.Step = from
+	steps = from
+	return nil
+}
+
+func (d *Debugger) sync() {
+	SyncRegs(d.c.Mu, d.c.Ram)
+	for addr := range d.watches {
+		d.watches[addr] = d.c.Ram[addr]
+	}
+}
+
+// Continue runs to target, the end if negative, or until a breakpoint is
+// reached or a watched word changes. It returns why it stopped.
+func (d *Debugger) Continue(target int) (string, error) {
+	if len(d.breaks) == 0 && len(d.watches) == 0 {
+		if err := d.c.RunTo(target); err != nil {
+			return "", err
+		}
+		d.sync()
+		return d.stopReason(), nil
+	}
+
+	// one step at a time, so the stop is at the exact step
+	for !d.c.Exited && (target < 0 || d.c.Step < target) {
+		if err := d.c.RunTo(d.c.Step + 1); err != nil {
+			return "", err
+		}
+		pc, _ := d.c.Mu.RegRead(uc.MIPS_REG_PC)
+		if d.breaks[uint32(pc)] {
+			d.sync()
+			return fmt.Sprintf("breakpoint at %08x", pc), nil
+		}
+		for addr, old := range d.watches {
+			if value := d.c.Ram[addr]; value != old {
+				d.sync()
+				return fmt.Sprintf("watch %08x: %08x -> %08x", addr, old, value), nil
+			}
+		}
+	}
+	d.sync()
+	return d.stopReason(), nil
+}
+
+func (d *Debugger) stopReason() string {
+	if d.c.Exited {
+		return "exited"
+	}
+	return "stopped"
+}
+
+func (d *Debugger) Break(pc uint32) {
+	d.breaks[pc] = true
+}
+
+func (d *Debugger) Watch(addr uint32) {
+	d.watches[addr&^3] = d.c.Ram[addr&^3]
+}
+
+// where prints the step and the instruction about to run
+func (d *Debugger) where() {
+	pc := d.c.Ram[REG_PC]
+	if sym := SymbolizePC(pc); sym != "" {
+		fmt.Fprintf(d.out, "step %d  %08x <%s>:  %08x  %s\n", d.c.Step, pc, sym, d.c.Ram[pc], DisassembleAt(d.c.Ram, pc))
+		return
+	}
+	fmt.Fprintf(d.out, "step %d  %08x:  %08x  %s\n", d.c.Step, pc, d.c.Ram[pc], DisassembleAt(d.c.Ram, pc))
+}
+
+const debugHelp = `commands:
+  s, step [n]          run n steps, default 1
+  c, continue [step]   run to step, the end by default, stopping at breakpoints and watches
+  g, goto step         go to step, backwards too, ignoring breakpoints and watches
+  rs, back [n]         go back n steps, default 1
+  b, break pc          stop before the instruction at pc
+  w, watch addr        stop when the word at addr changes
+  d, delete            remove all breakpoints and watches
+  r, regs              print the registers and the next instructions
+  x addr [count]       print count words of memory from addr
+  q, quit
+`
+
+func parseNum(args []string, i int, def int64) (int64, error) {
+	if len(args) <= i {
+		return def, nil
+	}
+	return strconv.ParseInt(args[i], 0, 64)
+}
+
+// Exec runs one command line, and returns true once the session is over
+func (d *Debugger) Exec(line string) (bool, error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return false, nil
+	}
+	n, err := parseNum(args, 1, -1)
+	if err != nil {
+		return false, err
+	}
+
+	switch args[0] {
+	case "s", "step":
+		if n < 0 {
+			n = 1
+		}
+		reason, err := d.Continue(d.c.Step + int(n))
+		if err != nil {
+			return false, err
+		}
+		if reason != "stopped" {
+			fmt.Fprintln(d.out, reason)
+		}
+		d.where()
+	case "c", "continue":
+		reason, err := d.Continue(int(n))
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintln(d.out, reason)
+		d.where()
+	case "g", "goto", "rs", "back":
+		target := int(n)
+		if (args[0] == "g" || args[0] == "goto") && n < 0 {
+			return false, errors.New("goto needs a step")
+		}
+		if args[0] == "rs" || args[0] == "back" {
+			if n < 0 {
+				n = 1
+			}
+			target = d.c.Step - int(n)
+		}
+		if target < 0 {
+			return false, errors.New("no step before 0")
+		}
+		if err := d.Goto(target); err != nil {
+			return false, err
+		}
+		d.where()
+	case "b", "break":
+		if n < 0 {
+			return false, errors.New("break needs a pc")
+		}
+		d.Break(uint32(n))
+	case "w", "watch":
+		if n < 0 {
+			return false, errors.New("watch needs an address")
+		}
+		d.Watch(uint32(n))
+	case "d", "delete":
+		d.breaks = make(map[uint32]bool)
+		d.watches = make(map[uint32]uint32)
+	case "r", "regs":
+		fmt.Fprint(d.out, Inspect(d.c.Ram, 4))
+	case "x":
+		if n < 0 {
+			return false, errors.New("x needs an address")
+		}
+		count, err := parseNum(args, 2, 4)
+		if err != nil {
+			return false, err
+		}
+		for i := uint32(0); i < uint32(count); i++ {
+			addr := uint32(n)&^3 + 4*i
+			if i%4 == 0 {
+				if i > 0 {
+					fmt.Fprintln(d.out)
+				}
+				fmt.Fprintf(d.out, "%08x:", addr)
+			}
+			fmt.Fprintf(d.out, " %08x", d.c.Ram[addr])
+		}
+		fmt.Fprintln(d.out)
+	case "q", "quit":
+		return true, nil
+	case "h", "help":
+		fmt.Fprint(d.out, debugHelp)
+	default:
+		return false, fmt.Errorf("unknown command %s, try help", args[0])
+	}
+	return false, nil
+}
+
+// Repl reads commands from in until quit or the end of input
+func (d *Debugger) Repl(in io.Reader) {
+	d.where()
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(d.out, "(mlvm) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(d.out)
+			return
+		}
+		quit, err := d.Exec(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(d.out, "error:", err)
+		}
+		if quit {
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDebugger(t *testing.T) {
+	initTest()
+	basedir := t.TempDir()
+	ram := make(map[uint32](uint32))
+	c := GetChunkedUnicorn("", ram)
+	loadAsm(loopProgram)(c.Mu, ram)
+	runChunked(c, -1, -1, 500, func(step int) {
+		WriteCheckpoint(ram, CheckpointPath(basedir, -1, step), step)
+	})
+	if steps := ListCheckpoints(basedir, -1); fmt.Sprint(steps) != "[500 1000 1500 2000 2500 3000]" {
+		t.Fatalf("checkpoints at %v", steps)
+	}
+
+	initTest()
+	var out bytes.Buffer
+	d := NewDebugger(basedir, -1, loadAsm(loopProgram), &out)
+	check(d.Goto(0))
+	exec := func(line string) {
+		if _, err := d.Exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+
+	// the li after the loop
+	exec("b 0x14")
+	exec("c")
+	if d.Step() != 3002 || d.Ram()[REG_PC] != 0x14 {
+		t.Fatalf("breakpoint hit at step %d pc %x", d.Step(), d.Ram()[REG_PC])
+	}
+	exec("d")
+	exec("w 0x30000804")
+	exec("c")
+	if d.Step() != 3005 || d.Ram()[0x30000804] != 7 {
+		t.Fatalf("watch hit at step %d", d.Step())
+	}
+	if !strings.Contains(out.String(), "watch 30000804: 00000000 -> 00000007\nstep 3005  00000020:") {
+		t.Fatalf("output:\n%s", out.String())
+	}
+
+	// back into the loop, from the checkpoint at 2500
+	exec("rs 10")
+	if d.Step() != 2995 || d.Ram()[REG_OFFSET+8*4] != 2 {
+		t.Fatalf("went back to step %d with $t0 %d", d.Step(), d.Ram()[REG_OFFSET+8*4])
+	}
+	back := RamToTrie(d.Ram())
+
+	initTest()
+	fresh := NewDebugger(t.TempDir(), -1, loadAsm(loopProgram), &out)
+	check(fresh.Goto(2995))
+	if RamToTrie(fresh.Ram()) != back {
+		t.Fatal("going back doesn't match running forward")
+	}
+
+	quit, err := d.Exec("q")
+	if !quit || err != nil {
+		t.Fatal("quit didn't quit")
+	}
+}
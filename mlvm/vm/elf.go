@@ -0,0 +1,157 @@
+package vm
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// ProgramSegment is a run of bytes loaded at Addr
+type ProgramSegment struct {
+	Addr uint32
+	Data []byte
+}
+
+type Symbol struct {
+	Name string
+	Addr uint32
+	Size uint32
+}
+
+// Program is a guest image, either a MIPS ELF or a flat binary loaded at 0
+type Program struct {
+	Entry    uint32
+	Segments []ProgramSegment
+	// sorted by address, empty for a flat binary
+	Symbols []Symbol
+}
+
+// LoadedProgram is the last program loaded with LoadProgramUnicorn, for
+// symbolizing pcs
+var LoadedProgram *Program
+
+// ReadProgram reads an ELF, or else a flat binary that starts at 0
+func ReadProgram(fn string) (*Program, error) {
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(dat, []byte(elf.ELFMAG)) {
+		return &Program{Segments: []ProgramSegment{{0, dat}}}, nil
+	}
+	p, err := ParseElf(dat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return p, nil
+}
+
+// ParseElf takes the PT_LOAD segments, the entry point and the function and
+// object symbols of a big endian 32 bit MIPS executable
+func ParseElf(dat []byte) (*Program, error) {
+	f, err := elf.NewFile(bytes.NewReader(dat))
+	if err != nil {
+		return nil, err
+	}
+	if f.Class != elf.ELFCLASS32 || f.Data != elf.ELFDATA2MSB || f.Machine != elf.EM_MIPS {
+		return nil, fmt.Errorf("not a big endian mips32 elf: %v %v %v", f.Class, f.Data, f.Machine)
+	}
+
+	p := &Program{Entry: uint32(f.Entry)}
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+		if prog.Vaddr+prog.Memsz > uint64(HEAP_START) {
+			return nil, fmt.Errorf("segment at %x runs into the heap", prog.Vaddr)
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return nil, err
+		}
+		// the bss is left out, ram is zero wherever nothing was loaded
+		p.Segments = append(p.Segments, ProgramSegment{uint32(prog.Vaddr), data})
+	}
+
+	syms, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	for _, s := range syms {
+		typ := elf.ST_TYPE(s.Info)
+		if s.Name != "" && s.Value != 0 && (typ == elf.STT_FUNC || typ == elf.STT_OBJECT) {
+			p.Symbols = append(p.Symbols, Symbol{s.Name, uint32(s.Value), uint32(s.Size)})
+		}
+	}
+	sort.Slice(p.Symbols, func(i, j int) bool { return p.Symbols[i].Addr < p.Symbols[j].Addr })
+	return p, nil
+}
+
+// words pads a segment out to whole words, as LoadData wants them
+func (s ProgramSegment) words() (uint32, []byte) {
+	pad := s.Addr & 3
+	dat := append(make([]byte, pad), s.Data...)
+	for len(dat)%4 != 0 {
+		dat = append(dat, 0)
+	}
+	return s.Addr - pad, dat
+}
+
+// Load puts the segments into ram and points the pc at the entry. A flat
+// binary ends up exactly as LoadMappedFile leaves it.
+func (p *Program) Load(ram map[uint32](uint32)) {
+	for _, s := range p.Segments {
+		addr, dat := s.words()
+		LoadData(dat, ram, addr)
+	}
+	WriteRam(ram, REG_PC, p.Entry)
+}
+
+func (p *Program) LoadUnicorn(mu uc.Unicorn, ram map[uint32](uint32)) {
+	for _, s := range p.Segments {
+		addr, dat := s.words()
+		LoadBytesToUnicorn(mu, dat, ram, addr)
+	}
+	mu.RegWrite(uc.MIPS_REG_PC, uint64(p.Entry))
+	WriteRam(ram, REG_PC, p.Entry)
+}
+
+// LoadProgramUnicorn is LoadMappedFileUnicorn at 0 that also takes ELFs
+func LoadProgramUnicorn(mu uc.Unicorn, fn string, ram map[uint32](uint32)) {
+	p, err := ReadProgram(fn)
+	check(err)
+	p.LoadUnicorn(mu, ram)
+	LoadedProgram = p
+}
+
+// Symbolize finds the symbol addr is in
+func (p *Program) Symbolize(addr uint32) (Symbol, bool) {
+	i := sort.Search(len(p.Symbols), func(i int) bool { return p.Symbols[i].Addr > addr }) - 1
+	if i < 0 {
+		return Symbol{}, false
+	}
+	s := p.Symbols[i]
+	if s.Size != 0 && addr >= s.Addr+s.Size {
+		return Symbol{}, false
+	}
+	return s, true
+}
+
+// SymbolizePC renders addr as symbol+offset, or nothing without symbols
+func SymbolizePC(addr uint32) string {
+	if LoadedProgram == nil {
+		return ""
+	}
+	s, ok := LoadedProgram.Symbolize(addr)
+	if !ok {
+		return ""
+	}
+	if addr == s.Addr {
+		return s.Name
+	}
+	return fmt.Sprintf("%s+0x%x", s.Name, addr-s.Addr)
+}
@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"mlvm/asm"
+)
+
+// buildElf writes a big endian mips executable with one PT_LOAD per segment
+// and a symbol table
+func buildElf(entry uint32, segs []ProgramSegment, syms []Symbol) []byte {
+	var strtab, shstrtab bytes.Buffer
+	strtab.WriteByte(0)
+	shstrtab.WriteByte(0)
+	name := func(b *bytes.Buffer, s string) uint32 {
+		off := uint32(b.Len())
+		b.WriteString(s + "\x00")
+		return off
+	}
+
+	var symtab bytes.Buffer
+	binary.Write(&symtab, binary.BigEndian, elf.Sym32{})
+	for _, s := range syms {
+		binary.Write(&symtab, binary.BigEndian, elf.Sym32{
+			Name: name(&strtab, s.Name), Value: s.Addr, Size: s.Size,
+			Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: uint16(elf.SHN_ABS),
+		})
+	}
+	sections := []elf.Section32{{}, {
+		Name: name(&shstrtab, ".symtab"), Type: uint32(elf.SHT_SYMTAB), Link: 2, Info: 1, Entsize: 16,
+	}, {
+		Name: name(&shstrtab, ".strtab"), Type: uint32(elf.SHT_STRTAB),
+	}, {
+		Name: name(&shstrtab, ".shstrtab"), Type: uint32(elf.SHT_STRTAB),
+	}}
+
+	off := uint32(52 + 32*len(segs))
+	var progs []elf.Prog32
+	for _, s := range segs {
+		size := uint32(len(s.Data))
+		progs = append(progs, elf.Prog32{
+			Type: uint32(elf.PT_LOAD), Off: off, Vaddr: s.Addr, Paddr: s.Addr,
+			Filesz: size, Memsz: size + 0x100, Flags: uint32(elf.PF_R | elf.PF_X), Align: 4,
+		})
+		off += size
+	}
+	for i, dat := range [][]byte{symtab.Bytes(), strtab.Bytes(), shstrtab.Bytes()} {
+		sections[i+1].Off = off
+		sections[i+1].Size = uint32(len(dat))
+		off += uint32(len(dat))
+	}
+
+	var b bytes.Buffer
+	hdr := elf.Header32{
+		Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_MIPS), Version: 1, Entry: entry,
+		Phoff: 52, Shoff: off, Ehsize: 52, Phentsize: 32, Phnum: uint16(len(segs)),
+		Shentsize: 40, Shnum: uint16(len(sections)), Shstrndx: 3,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&b, binary.BigEndian, hdr)
+	binary.Write(&b, binary.BigEndian, progs)
+	for _, s := range segs {
+		b.Write(s.Data)
+	}
+	b.Write(symtab.Bytes())
+	b.Write(strtab.Bytes())
+	b.Write(shstrtab.Bytes())
+	binary.Write(&b, binary.BigEndian, sections)
+	return b.Bytes()
+}
+
+func TestElfMatchesFlatBinary(t *testing.T) {
+	initTest()
+	dir := t.TempDir()
+	flat := asm.MustAssemble(0, storesProgram)
+	check(ioutil.WriteFile(dir+"/program.bin", flat, 0644))
+	// the same image split in two segments with a gap of zeros between them
+	check(ioutil.WriteFile(dir+"/program.elf", buildElf(0, []ProgramSegment{{0, flat[:16]}, {16, flat[16:]}}, nil), 0644))
+
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	LoadMappedFile(dir+"/program.bin", ram, 0)
+	want := RamToTrie(ram)
+
+	for _, fn := range []string{"program.bin", "program.elf"} {
+		p, err := ReadProgram(dir + "/" + fn)
+		check(err)
+		ram := make(map[uint32](uint32))
+		ZeroRegisters(ram)
+		p.Load(ram)
+		if root := RamToTrie(ram); root != want {
+			t.Fatalf("%s has golden root %s, want %s", fn, root, want)
+		}
+	}
+}
+
+func TestElfEntryAndSymbols(t *testing.T) {
+	initTest()
+	src := `
+start:
+	li $s0, 0x10000
+	jal store
+	nop
+` + exitProgram + `
+store:
+	li $t0, 42
+	jr $ra
+	sw $t0, 0($s0)
+`
+	words, labels, err := asm.AssembleWords(0x400, src)
+	check(err)
+	code := make([]byte, 4*len(words))
+	for i, w := range words {
+		binary.BigEndian.PutUint32(code[4*i:], w)
+	}
+	dat := buildElf(0x400, []ProgramSegment{{0x400, code}}, []Symbol{
+		{"main.start", labels["start"], labels["store"] - labels["start"]},
+		{"main.store", labels["store"], 12},
+	})
+	p, err := ParseElf(dat)
+	check(err)
+	if p.Entry != 0x400 || len(p.Symbols) != 2 {
+		t.Fatalf("entry %x symbols %v", p.Entry, p.Symbols)
+	}
+	LoadedProgram = p
+	defer func() { LoadedProgram = nil }()
+	if s := SymbolizePC(labels["store"] + 8); s != "main.store+0x8" {
+		t.Fatalf("symbolized as %q", s)
+	}
+	if s := SymbolizePC(labels["store"] + 12); s != "" {
+		t.Fatalf("past the end symbolized as %q", s)
+	}
+
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	p.Load(ram)
+	for i := 0; ram[REG_PC] != HALT_PC; i++ {
+		if i == 100 {
+			t.Fatal("program didn't exit")
+		}
+		_, err := StepMIPS(&RamStepMemory{Ram: ram})
+		check(err)
+	}
+	if ram[0x10000] != 42 {
+		t.Fatalf("stored %d", ram[0x10000])
+	}
+}
@@ -0,0 +1,253 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"path/filepath"
+	"strings"
+
+	"mlgo/ml"
+)
+
+// rough gas prices behind Estimate.Gas, per the storage MIPSMemory does
+const (
+	GAS_TX            = 21000
+	GAS_CALLDATA_BYTE = 16
+	GAS_SSTORE        = 22100
+	GAS_SLOAD         = 2100
+	// decoding and executing the instruction in MIPS.sol, outside of memory
+	GAS_STEP_EXECUTE = 30000
+)
+
+// a full branch node, 16 children of 33 bytes, for when no witness is sampled
+const TRIE_BRANCH_BYTES = 532
+
+// words a typical step touches on separate paths of the trie: the
+// instruction, the register block and a word of data
+const WITNESS_PATHS = 3
+
+// Estimate is what a dispute over a model would take
+type Estimate struct {
+	Model string `json:"model"`
+	Input string `json:"input,omitempty"`
+	Nodes int    `json:"nodes"`
+	// the node phase-2 would be played on in the worst case
+	WorstNode      int     `json:"worstNode"`
+	WorstOp        string  `json:"worstOp"`
+	WorstSteps     int     `json:"worstSteps"`
+	TotalSteps     int     `json:"totalSteps"`
+	Phase1Rounds   int     `json:"phase1Rounds"`
+	Phase2Rounds   int     `json:"phase2Rounds"`
+	StepsPerSecond float64 `json:"stepsPerSecond"`
+	// writing one checkpoint, going by the biggest ram measured, and the
+	// steps between the checkpoints a node's run writes on the way, 0 for
+	// only the one it ends on
+	CheckpointSeconds float64 `json:"checkpointSeconds"`
+	CheckpointEvery   int     `json:"checkpointEvery"`
+	Checkpoints       int     `json:"checkpoints"`
+	// generating the checkpoints of the worst node, and of every node:
+	// running them in unicorn and writing the checkpoints on the way
+	WorstSeconds float64 `json:"worstSeconds"`
+	TotalSeconds float64 `json:"totalSeconds"`
+	// from sampled witnesses when there was a checkpoint, from the trie depth
+	// otherwise
+	Sampled      bool `json:"sampled"`
+	WitnessNodes int  `json:"witnessNodes"`
+	WitnessBytes int  `json:"witnessBytes"`
+	Reads        int  `json:"reads"`
+	Writes       int  `json:"writes"`
+	Gas          int  `json:"gas"`
+}
+
+// log2 rounded up, the rounds of a binary search over n
+func searchRounds(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// trieDepth is the nodes on the path to a word in a trie of words words.
+// The keys are addr>>2, 8 nibbles, so no path is longer than 9.
+func trieDepth(words int) int {
+	depth := 1
+	for n := 1; n < words && depth < 9; n *= 16 {
+		depth++
+	}
+	return depth
+}
+
+// stepGas prices a step: the nodes going in as calldata and being stored by
+// AddTrieNode, every read walking the trie, and every write storing a new
+// path to the root
+func stepGas(nodes int, nodeBytes int, depth int, reads int, writes int) int {
+	slots := 1
+	if nodes > 0 {
+		slots += (nodeBytes/nodes + 31) / 32
+	}
+	gas := GAS_TX + GAS_STEP_EXECUTE
+	gas += nodeBytes*GAS_CALLDATA_BYTE + nodes*slots*GAS_SSTORE
+	gas += reads * depth * slots * GAS_SLOAD
+	gas += writes * depth * slots * GAS_SSTORE
+	return gas
+}
+
+// checkpoints is how many a node's run of steps writes, one every
+// checkpointEvery steps and the one it ends on
+func checkpoints(steps int, checkpointEvery int) int {
+	if checkpointEvery <= 0 {
+		return 1
+	}
+	return 1 + steps/checkpointEvery
+}
+
+// EstimateModel prices the graph of modelName on input, see ModelGraph, with
+// the cost model
+func EstimateModel(modelName string, input string, m *CostModel, stepsPerSecond float64, checkpointEvery int) (*Estimate, error) {
+	graph, _, err := ModelGraph(modelName, input)
+	if err != nil {
+		return nil, err
+	}
+	e := EstimateGraph(modelName, graph, m, stepsPerSecond, checkpointEvery)
+	e.Input = input
+	return e, nil
+}
+
+// EstimateGraph prices graph with the cost model. A zero stepsPerSecond
+// takes the speed the cost model was measured at.
+func EstimateGraph(modelName string, graph *ml.Graph, m *CostModel, stepsPerSecond float64, checkpointEvery int) *Estimate {
+	e := &Estimate{Model: modelName, Nodes: int(graph.NodesCount), WorstNode: -1, CheckpointEvery: checkpointEvery}
+	for id := 0; id < int(graph.NodesCount); id++ {
+		node := graph.Nodes[id]
+		op, shape := TensorOp(node), TensorShape(node)
+		cost := NodeCost{Op: op, Shape: shape, Src0: TensorShape(node.Src0), Src1: TensorShape(node.Src1)}
+		steps := m.Steps(op, costShape(op, shape, cost.Src0, cost.Src1), cost.Work())
+		e.TotalSteps += steps
+		e.Checkpoints += checkpoints(steps, checkpointEvery)
+		if steps > e.WorstSteps {
+			e.WorstNode, e.WorstOp, e.WorstSteps = id, op, steps
+		}
+	}
+	e.Phase1Rounds = searchRounds(e.Nodes)
+	e.Phase2Rounds = searchRounds(e.WorstSteps)
+
+	if stepsPerSecond == 0 {
+		stepsPerSecond = m.StepsPerSecond()
+	}
+	e.StepsPerSecond = stepsPerSecond
+	if stepsPerSecond > 0 {
+		e.CheckpointSeconds = m.CheckpointSeconds()
+		e.WorstSeconds = float64(e.WorstSteps)/stepsPerSecond + float64(checkpoints(e.WorstSteps, checkpointEvery))*e.CheckpointSeconds
+		e.TotalSeconds = float64(e.TotalSteps)/stepsPerSecond + float64(e.Checkpoints)*e.CheckpointSeconds
+	}
+
+	// the biggest ram measured stands in for the worst node's
+	ramBytes := 0
+	for _, n := range m.Nodes {
+		if n.RamBytes > ramBytes {
+			ramBytes = n.RamBytes
+		}
+	}
+	depth := trieDepth(ramBytes / 4)
+	// the paths share the root
+	e.WitnessNodes = 1 + WITNESS_PATHS*(depth-1)
+	e.WitnessBytes = e.WitnessNodes * TRIE_BRANCH_BYTES
+	// the pc, the instruction, two source registers and a destination, of
+	// which the pc and the destination are written back
+	e.Reads, e.Writes = 5, 2
+	e.Gas = stepGas(e.WitnessNodes, e.WitnessBytes, depth, e.Reads, e.Writes)
+	return e
+}
+
+// SampleWitnesses replaces the trie side of e with the mean of count step
+// witnesses from the checkpoint
+func (e *Estimate) SampleWitnesses(checkpoint string, count int) error {
+	root, step, ram, err := LoadCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+	depth := trieDepth(len(ram))
+	nodes, nodeBytes, reads, writes, gas := 0, 0, 0, 0, 0
+	for i := 0; i < count; i++ {
+		if StateFromRam(ram).Exited {
+			count = i
+			break
+		}
+		// BuildStepWitness moves ram on, so the reads and writes are counted
+		// on a copy first
+		access, err := StepMIPS(&RamStepMemory{Ram: copyRam(ram), Root: filepath.Dir(checkpoint)})
+		if err != nil {
+			return err
+		}
+		w, err := BuildStepWitness(root, step, ram, filepath.Dir(checkpoint))
+		if err != nil {
+			return err
+		}
+		size := 0
+		for _, n := range w.Nodes {
+			size += len(n)
+		}
+		nodes += len(w.Nodes)
+		nodeBytes += size
+		// every word is read before it's written
+		reads += len(access.Addrs)
+		writes += len(access.Writes)
+		gas += stepGas(len(w.Nodes), size, depth, len(access.Addrs), len(access.Writes))
+		root = w.PostRoot
+		step++
+	}
+	if count == 0 {
+		return fmt.Errorf("%s has already exited", checkpoint)
+	}
+	e.Sampled = true
+	e.WitnessNodes = nodes / count
+	e.WitnessBytes = nodeBytes / count
+	e.Reads = reads / count
+	e.Writes = writes / count
+	e.Gas = gas / count
+	return nil
+}
+
+func (e *Estimate) String() string {
+	var b strings.Builder
+	model := e.Model
+	if e.Input != "" {
+		model += " on " + e.Input
+	}
+	fmt.Fprintf(&b, "model %s: %d nodes, %d steps in all\n", model, e.Nodes, e.TotalSteps)
+	fmt.Fprintf(&b, "phase 1: %d rounds over the nodes\n", e.Phase1Rounds)
+	fmt.Fprintf(&b, "phase 2: %d rounds over the %d steps of node %d (%s)\n", e.Phase2Rounds, e.WorstSteps, e.WorstNode, e.WorstOp)
+	if e.StepsPerSecond > 0 {
+		every := "one per node"
+		if e.CheckpointEvery > 0 {
+			every = fmt.Sprintf("one every %d steps and one per node", e.CheckpointEvery)
+		}
+		fmt.Fprintf(&b, "checkpoint generation: %s for the worst node, %s for every node\n", formatSeconds(e.WorstSeconds), formatSeconds(e.TotalSeconds))
+		fmt.Fprintf(&b, "  running at %.0f steps/s and writing %d checkpoints, %s, at %.2fs each\n", e.StepsPerSecond, e.Checkpoints, every, e.CheckpointSeconds)
+	} else {
+		fmt.Fprintf(&b, "checkpoint generation: no run times in the cost model\n")
+	}
+	how := "estimated from the trie depth"
+	if e.Sampled {
+		how = "mean of sampled steps"
+	}
+	fmt.Fprintf(&b, "step witness: %d trie nodes, %d bytes, %d reads, %d writes (%s)\n", e.WitnessNodes, e.WitnessBytes, e.Reads, e.Writes, how)
+	fmt.Fprintf(&b, "confirmStateTransition: ~%d gas\n", e.Gas)
+	return b.String()
+}
+
+func formatSeconds(s float64) string {
+	if s < 60 {
+		return fmt.Sprintf("%.1fs", s)
+	}
+	r := int(math.Round(s))
+	return fmt.Sprintf("%dm%02ds", r/60, r%60)
+}
+
+func (e *Estimate) Json() []byte {
+	dat, err := json.MarshalIndent(e, "", "  ")
+	check(err)
+	return dat
+}
@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/oracle"
+	"mlgo/ml"
+)
+
+func TestSearchRounds(t *testing.T) {
+	for n, want := range map[int]int{0: 0, 1: 0, 2: 1, 3: 2, 4: 2, 5: 3, 1024: 10, 1025: 11} {
+		if got := searchRounds(n); got != want {
+			t.Errorf("searchRounds(%d) = %d, want %d", n, got, want)
+		}
+	}
+	for words, want := range map[int]int{1: 1, 16: 2, 17: 3, 1 << 20: 6, 1 << 40: 9} {
+		if got := trieDepth(words); got != want {
+			t.Errorf("trieDepth(%d) = %d, want %d", words, got, want)
+		}
+	}
+}
+
+func TestEstimateGraph(t *testing.T) {
+	graph := &ml.Graph{NodesCount: 5}
+	for i := range graph.Nodes[:5] {
+		graph.Nodes[i] = &ml.Tensor{Dims: 1, NE: [4]uint32{uint32(10 * (i + 1)), 1, 1, 1}}
+	}
+	// NONE is 1000 steps plus 100 per element
+	m := NewCostModel("test", "test.bin", []NodeCost{
+		{Op: "NONE", Shape: []uint32{10}, Steps: 2000, Seconds: 1, RamBytes: 4 << 20, CheckpointSeconds: 0.5},
+		{Op: "NONE", Shape: []uint32{20}, Steps: 3000, Seconds: 2, CheckpointSeconds: 0.25},
+	})
+
+	e := EstimateGraph("test", graph, m, 0, 0)
+	if e.Nodes != 5 || e.Phase1Rounds != 3 {
+		t.Fatal("phase 1", e.Nodes, e.Phase1Rounds)
+	}
+	if e.WorstNode != 4 || e.WorstSteps != 6000 || e.Phase2Rounds != 13 {
+		t.Fatal("phase 2", e.WorstNode, e.WorstSteps, e.Phase2Rounds)
+	}
+	// 12s of running and a checkpoint of 0.5s at the end of each node
+	if e.TotalSteps != 20000 || e.StepsPerSecond != 5000/3.0 || e.Checkpoints != 5 || math.Abs(e.TotalSeconds-14.5) > 1e-9 {
+		t.Fatal("time", e.TotalSteps, e.StepsPerSecond, e.Checkpoints, e.TotalSeconds)
+	}
+	// 2+3+4+5+6 checkpoints on the way, the worst node's 6 and one at its end
+	e = EstimateGraph("test", graph, m, 0, 1000)
+	if e.Checkpoints != 25 || math.Abs(e.TotalSeconds-24.5) > 1e-9 || math.Abs(e.WorstSeconds-7.1) > 1e-9 {
+		t.Fatal("checkpoints", e.Checkpoints, e.TotalSeconds, e.WorstSeconds)
+	}
+	// a million words is 6 deep, 3 paths of 5 under the root
+	if e.Sampled || e.WitnessNodes != 16 || e.Gas <= GAS_TX {
+		t.Fatal("witness", e.WitnessNodes, e.Gas)
+	}
+}
+
+func TestEstimateSampleWitnesses(t *testing.T) {
+	initTest()
+	basedir := t.TempDir()
+	oracle.SetRoot(basedir)
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	ram[REG_OFFSET+8*4] = 0x1234
+	ram[0] = 0xad080100 // sw $t0, 0x100($t0)
+	ram[4] = 0x25080004 // addiu $t0, $t0, 4
+	WriteCheckpoint(ram, basedir+"/checkpoint.json", 0)
+
+	e := &Estimate{}
+	check(e.SampleWitnesses(basedir+"/checkpoint.json", 2))
+	if !e.Sampled || e.WitnessNodes == 0 || e.WitnessBytes == 0 {
+		t.Fatal("witness", e.WitnessNodes, e.WitnessBytes)
+	}
+	// the pc, the instruction and $t0, and the stored word once
+	if e.Reads < 3 || e.Writes < 2 {
+		t.Fatal("access", e.Reads, e.Writes)
+	}
+}
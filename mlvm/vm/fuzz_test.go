@@ -0,0 +1,485 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Differential fuzzing of StepMIPS (MIPS.sol) against unicorn. The fuzz input
+// is turned into a short program, where branches and jumps only go forward,
+// and some initial register and memory state. Both run it and the
+// roots have to agree after every step, except on knownDivergences. Run with
+//   go test -run XXX -fuzz FuzzStepDifferential
+
+const FUZZ_PROGRAM = 0x1000
+const FUZZ_DATA = 0x10000
+
+// registers the generated code computes with, $s0 always points at FUZZ_DATA
+// and $s1 at ORACLE_ADDR
+var fuzzRegs = []uint32{2, 3, 8, 9, 10, 11, 12, 13, 14, 15, 24, 25}
+
+type fuzzReader struct {
+	b []byte
+}
+
+func (r *fuzzReader) byte() uint32 {
+	if len(r.b) == 0 {
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return uint32(v)
+}
+
+func (r *fuzzReader) u16() uint32 {
+	return r.byte()<<8 | r.byte()
+}
+
+func (r *fuzzReader) u32() uint32 {
+	return r.u16()<<16 | r.u16()
+}
+
+func (r *fuzzReader) reg() uint32 {
+	return fuzzRegs[r.byte()%uint32(len(fuzzRegs))]
+}
+
+func rtype(fn, rs, rt, rd, shamt uint32) uint32 {
+	return rs<<21 | rt<<16 | rd<<11 | shamt<<6 | fn
+}
+
+func itype(op, rs, rt, imm uint32) uint32 {
+	return op<<26 | rs<<21 | rt<<16 | imm&0xFFFF
+}
+
+// fuzzOp emits a few instructions for an op. Jumps and branches land on the
+// start of an op, skip ops on from their delay slot, see fuzzProgram.code.
+type fuzzOp func(r *fuzzReader) (code []uint32, skip int)
+
+func fuzzALU(fn uint32) fuzzOp {
+	return func(r *fuzzReader) ([]uint32, int) {
+		return []uint32{rtype(fn, r.reg(), r.reg(), r.reg(), 0)}, 0
+	}
+}
+
+func fuzzShift(fn uint32) fuzzOp {
+	return func(r *fuzzReader) ([]uint32, int) {
+		return []uint32{rtype(fn, 0, r.reg(), r.reg(), r.byte()&0x1F)}, 0
+	}
+}
+
+func fuzzImm(op uint32) fuzzOp {
+	return func(r *fuzzReader) ([]uint32, int) {
+		rs := r.reg()
+		if op == 0xf {
+			rs = 0
+		}
+		return []uint32{itype(op, rs, r.reg(), r.u16())}, 0
+	}
+}
+
+func fuzzMem(op uint32, align uint32) fuzzOp {
+	return func(r *fuzzReader) ([]uint32, int) {
+		return []uint32{itype(op, 16, r.reg(), r.u16()&0xFFF&^(align-1))}, 0
+	}
+}
+
+func fuzzBranch(op uint32, rt uint32) fuzzOp {
+	return func(r *fuzzReader) ([]uint32, int) {
+		rs := r.reg()
+		if op == 4 || op == 5 {
+			rt = r.reg()
+		}
+		// forward only
+		return []uint32{itype(op, rs, rt, 0)}, int(r.byte() % 4)
+	}
+}
+
+// write a few bytes of FUZZ_DATA to stdout or stderr
+func fuzzWrite(r *fuzzReader) ([]uint32, int) {
+	return []uint32{
+		itype(9, 0, 4, 1+r.byte()&1),   // a0 fd
+		itype(9, 16, 5, r.u16()&0xFFF), // a1 buf
+		itype(9, 0, 6, r.byte()&0x3F),  // a2 count
+		itype(9, 0, 2, 4004),           // v0
+		0xc,                            // syscall
+	}, 0
+}
+
+// load the preimage and read a word of it
+func fuzzOracle(r *fuzzReader) ([]uint32, int) {
+	return []uint32{
+		itype(9, 0, 2, 4020),
+		0xc,
+		itype(0x23, 17, r.reg(), (r.byte()%12)*4),
+	}, 0
+}
+
+func fuzzSyscall(no uint32) fuzzOp {
+	return func(r *fuzzReader) ([]uint32, int) {
+		return []uint32{
+			itype(9, 0, 4, (r.byte()&1)*r.u16()), // a0, often 0
+			itype(9, 0, 5, r.u16()),              // a1
+			itype(9, 0, 2, no),                   // v0
+			0xc,                                  // syscall
+		}, 0
+	}
+}
+
+var fuzzOps = []fuzzOp{
+	fuzzALU(0x21), fuzzALU(0x23), fuzzALU(0x24), fuzzALU(0x25), fuzzALU(0x26),
+	fuzzALU(0x27), fuzzALU(0x2a), fuzzALU(0x2b), fuzzALU(0x04), fuzzALU(0x06),
+	fuzzALU(0x0a), fuzzALU(0x0b), fuzzALU(0x07),
+	fuzzShift(0x00), fuzzShift(0x02), fuzzShift(0x03),
+	fuzzImm(0x9), fuzzImm(0xa), fuzzImm(0xb), fuzzImm(0xc), fuzzImm(0xd),
+	fuzzImm(0xe), fuzzImm(0xf),
+	fuzzMem(0x20, 1), fuzzMem(0x21, 2), fuzzMem(0x22, 1), fuzzMem(0x23, 4),
+	fuzzMem(0x24, 1), fuzzMem(0x25, 2), fuzzMem(0x26, 1),
+	fuzzMem(0x28, 1), fuzzMem(0x29, 2), fuzzMem(0x2a, 1), fuzzMem(0x2b, 4),
+	fuzzMem(0x2e, 1),
+	fuzzBranch(4, 0), fuzzBranch(5, 0), fuzzBranch(6, 0), fuzzBranch(7, 0),
+	fuzzBranch(1, 0), fuzzBranch(1, 1),
+	fuzzSyscall(4090), fuzzSyscall(4045), fuzzSyscall(4120),
+	fuzzWrite, fuzzOracle,
+	// hi/lo
+	func(r *fuzzReader) ([]uint32, int) {
+		fn := []uint32{0x18, 0x19, 0x1a, 0x1b}[r.byte()%4]
+		return []uint32{rtype(fn, r.reg(), r.reg(), 0, 0)}, 0
+	},
+	func(r *fuzzReader) ([]uint32, int) {
+		fn := []uint32{0x10, 0x11, 0x12, 0x13}[r.byte()%4]
+		if fn&1 == 0 {
+			return []uint32{rtype(fn, 0, 0, r.reg(), 0)}, 0
+		}
+		return []uint32{rtype(fn, r.reg(), 0, 0, 0)}, 0
+	},
+	// SPECIAL2 mul, clz, clo
+	func(r *fuzzReader) ([]uint32, int) {
+		fn := []uint32{0x2, 0x20, 0x21}[r.byte()%3]
+		rs, rt, rd := r.reg(), r.reg(), r.reg()
+		if fn != 2 {
+			rt = rd
+		}
+		return []uint32{0x1c<<26 | rtype(fn, rs, rt, rd, 0)}, 0
+	},
+	// ll/sc pair
+	func(r *fuzzReader) ([]uint32, int) {
+		off := r.u16() & 0xFFC
+		return []uint32{itype(0x30, 16, r.reg(), off), itype(0x38, 16, r.reg(), off)}, 0
+	},
+	// j/jal
+	func(r *fuzzReader) ([]uint32, int) {
+		return []uint32{(2 + r.byte()&1) << 26}, int(r.byte() % 4)
+	},
+	// jalr through $t9
+	func(r *fuzzReader) ([]uint32, int) {
+		return []uint32{itype(0xf, 0, 25, 0), itype(0xd, 25, 25, 0), rtype(9, 25, 0, 31, 0)}, int(r.byte() % 4)
+	},
+}
+
+type fuzzInsns struct {
+	code []uint32
+	skip int
+}
+
+// fuzzProgram is a program split into ops, so it can be minimized op by op
+type fuzzProgram struct {
+	regs [32]uint32
+	data []uint32
+	ops  []fuzzInsns
+	// in the preimage dir, oracleHash is its hash or one with no preimage
+	preimage   []byte
+	oracleHash common.Hash
+}
+
+func (op fuzzInsns) hasDelaySlot() bool {
+	return DecodeInsn(op.code[len(op.code)-1]).HasDelaySlot()
+}
+
+// valid is false when something with a delay slot is in a delay slot
+func (p *fuzzProgram) valid() bool {
+	for i := 1; i < len(p.ops); i++ {
+		if p.ops[i-1].hasDelaySlot() && (len(p.ops[i].code) > 1 || p.ops[i].hasDelaySlot()) {
+			return false
+		}
+	}
+	return true
+}
+
+// code lays out the ops from FUZZ_PROGRAM and points the jumps at their targets
+func (p *fuzzProgram) code() []uint32 {
+	var starts []uint32
+	pc := uint32(FUZZ_PROGRAM)
+	for _, op := range p.ops {
+		starts = append(starts, pc)
+		pc += uint32(4 * len(op.code))
+	}
+	// past the end is the exit_group sequence
+	starts = append(starts, pc)
+
+	var code []uint32
+	for i, op := range p.ops {
+		op.code = append([]uint32{}, op.code...)
+		if op.hasDelaySlot() {
+			target := starts[len(starts)-1]
+			if i+2+op.skip < len(starts) {
+				target = starts[i+2+op.skip]
+			}
+			last := len(op.code) - 1
+			insn := DecodeInsn(op.code[last])
+			if insn.Opcode == 2 || insn.Opcode == 3 {
+				op.code[last] |= target >> 2
+			} else if insn.Opcode == 0 {
+				op.code[0] |= target >> 16
+				op.code[1] |= target & 0xFFFF
+			} else {
+				op.code[last] |= ((target - starts[i] - 4*uint32(last) - 4) >> 2) & 0xFFFF
+			}
+		}
+		code = append(code, op.code...)
+	}
+	return append(code, itype(9, 0, 2, 4246), 0xc)
+}
+
+func parseFuzzProgram(in []byte) *fuzzProgram {
+	r := &fuzzReader{in}
+	p := &fuzzProgram{}
+	for _, reg := range fuzzRegs {
+		p.regs[reg] = r.u32()
+	}
+	p.regs[16] = FUZZ_DATA
+	p.regs[17] = ORACLE_ADDR
+	for i := 0; i < 16; i++ {
+		p.data = append(p.data, r.u32())
+	}
+	for n := r.byte() % 40; n > 0; n-- {
+		p.preimage = append(p.preimage, byte(r.byte()))
+	}
+	p.oracleHash = crypto.Keccak256Hash(p.preimage)
+	if r.byte()%4 == 0 {
+		p.oracleHash[0] ^= 1
+	}
+
+	for len(r.b) > 0 && len(p.ops) < 64 {
+		var op fuzzInsns
+		op.code, op.skip = fuzzOps[r.byte()%uint32(len(fuzzOps))](r)
+		p.ops = append(p.ops, op)
+		if !p.valid() {
+			p.ops = p.ops[:len(p.ops)-1]
+		}
+	}
+	return p
+}
+
+func (p *fuzzProgram) ram() map[uint32](uint32) {
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	for i, v := range p.regs {
+		ram[REG_OFFSET+uint32(i)*4] = v
+	}
+	ram[REG_PC] = FUZZ_PROGRAM
+	for i, v := range p.data {
+		ram[FUZZ_DATA+uint32(i)*4] = v
+	}
+	for i := uint32(0); i < 32; i += 4 {
+		ram[ORACLE_HASH_ADDR+i] = binary.BigEndian.Uint32(p.oracleHash[i:])
+	}
+
+	addr := uint32(FUZZ_PROGRAM)
+	for _, insn := range p.code() {
+		ram[addr] = insn
+		addr += 4
+	}
+	return ram
+}
+
+func (p *fuzzProgram) String() string {
+	s := ""
+	for i, insn := range p.code() {
+		s += fmt.Sprintf("  %08x: %08x\n", FUZZ_PROGRAM+4*i, insn)
+	}
+	return s
+}
+
+// unicornRoots runs ram in unicorn and returns the root before every step
+func unicornRoots(root string, ram map[uint32](uint32)) []common.Hash {
+	initTest()
+	var roots []common.Hash
+	mu := GetHookedUnicorn(root, ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
+		SyncRegs(mu, ram)
+		roots = append(roots, RamToTrie(ram))
+		if len(roots) > 1000 {
+			mu.Stop()
+		}
+	})
+	defer mu.Close()
+
+	for addr, v := range ram {
+		if addr >= REG_OFFSET {
+			continue
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		check(mu.MemWrite(uint64(addr), b))
+	}
+	for i := 1; i < 32; i++ {
+		check(mu.RegWrite(uc.MIPS_REG_ZERO+i, uint64(ram[REG_OFFSET+uint32(i)*4])))
+	}
+	check(mu.Start(FUZZ_PROGRAM, 0x5ead0004))
+	return roots
+}
+
+// knownDivergences are where unicorn and MIPS.sol are known to disagree. A
+// step that hits one has to really diverge, or the fuzzer fails so the entry
+// gets dropped, and the program isn't compared past it.
+var knownDivergences = []struct {
+	name string
+	hits func(insn Insn, ram map[uint32](uint32), root string) bool
+}{
+	{"srav by 32 or more, MIPS.sol shifts by all of $rs and gets 0, unicorn by its low 5 bits",
+		func(insn Insn, ram map[uint32](uint32), root string) bool {
+			rs, rt := ram[REG_OFFSET+insn.Rs*4], ram[REG_OFFSET+insn.Rt*4]
+			return insn.Opcode == 0 && insn.Func == 0x07 && insn.Rd != 0 && rs >= 32 && int32(rt)>>(rs&0x1F) != 0
+		}},
+	{"div and divu by zero, MIPS.sol reverts",
+		func(insn Insn, ram map[uint32](uint32), root string) bool {
+			return insn.Opcode == 0 && (insn.Func == 0x1a || insn.Func == 0x1b) && ram[REG_OFFSET+insn.Rt*4] == 0
+		}},
+	{"reading the oracle window where the preimage has no data, MIPS.sol reverts, unicorn reads what the last 4020 left",
+		func(insn Insn, ram map[uint32](uint32), root string) bool {
+			if insn.Opcode < 0x20 || insn.Opcode > 0x26 {
+				return false
+			}
+			addr := (ram[REG_OFFSET+insn.Rs*4] + SE(insn.Imm, 16)) &^ 3
+			if addr < ORACLE_ADDR || addr >= ORACLE_END {
+				return false
+			}
+			var hash common.Hash
+			for i := uint32(0); i < 32; i += 4 {
+				binary.BigEndian.PutUint32(hash[i:], ram[ORACLE_HASH_ADDR+i])
+			}
+			if hash == emptyHash {
+				return false
+			}
+			dat, err := ReadPreimage(root, hash)
+			return err != nil || (addr != ORACLE_ADDR && addr-ORACLE_ADDR-4 >= uint32(len(dat)))
+		}},
+}
+
+// knownDivergence is the known divergence the step at pc hits, including in
+// the delay slot MIPS.Step runs with it
+func knownDivergence(ram map[uint32](uint32), root string) string {
+	pc := ram[REG_PC]
+	insns := []Insn{DecodeInsn(ram[pc])}
+	if insns[0].HasDelaySlot() {
+		insns = append(insns, DecodeInsn(ram[pc+4]))
+	}
+	for _, insn := range insns {
+		for _, d := range knownDivergences {
+			if d.hits(insn, ram, root) {
+				return d.name
+			}
+		}
+	}
+	return ""
+}
+
+// diffFuzzProgram returns where StepMIPS and unicorn first disagree, and the
+// known divergence it stopped at if any. root is the preimage dir.
+func diffFuzzProgram(p *fuzzProgram, root string) (string, error) {
+	want := unicornRoots(root, p.ram())
+
+	ram := p.ram()
+	if r := RamToTrie(ram); r != want[0] {
+		return "", fmt.Errorf("initial root %s, unicorn has %s", r, want[0])
+	}
+	for step, u := 0, 0; ram[REG_PC] != HALT_PC; step++ {
+		pc := ram[REG_PC]
+		insn := DecodeInsn(ram[pc])
+		known := knownDivergence(ram, root)
+		_, err := StepMIPS(&RamStepMemory{Ram: ram, Root: root})
+		u++
+		if insn.HasDelaySlot() {
+			u++
+		}
+		if known != "" {
+			if err == nil && u < len(want) && RamToTrie(ram) == want[u] {
+				return known, fmt.Errorf("step %d at %x (%08x): known divergence %q doesn't diverge anymore", step, pc, insn.Word, known)
+			}
+			return known, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("step %d at %x (%08x): %v", step, pc, insn.Word, err)
+		}
+		if u >= len(want) {
+			return "", fmt.Errorf("step %d at %x (%08x): unicorn stopped after %d steps", step, pc, insn.Word, len(want))
+		}
+		if r := RamToTrie(ram); r != want[u] {
+			return "", fmt.Errorf("step %d at %x (%08x): root %s, unicorn has %s", step, pc, insn.Word, r, want[u])
+		}
+	}
+	return "", nil
+}
+
+// minimizeFuzzProgram drops ops for as long as the two still disagree
+func minimizeFuzzProgram(p *fuzzProgram, root string) *fuzzProgram {
+	for i := 0; i < len(p.ops); {
+		q := *p
+		q.ops = append(append([]fuzzInsns{}, p.ops[:i]...), p.ops[i+1:]...)
+		if _, err := diffFuzzProgram(&q, root); q.valid() && err != nil {
+			p = &q
+		} else {
+			i++
+		}
+	}
+	return p
+}
+
+func FuzzStepDifferential(f *testing.F) {
+	f.Add([]byte("\x00"))
+	seed := make([]byte, 4*len(fuzzRegs)+64)
+	for i := range seed {
+		seed[i] = byte(i*37 + 11)
+	}
+	for op := range fuzzOps {
+		f.Add(append(append([]byte{}, seed...), byte(op), 0x81, 0x02, 0xf3, 0x44, 0x05, byte(op), 0x16, 0x27, 0x88, 0x09))
+	}
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		p := parseFuzzProgram(in)
+		root := t.TempDir()
+		_, err := WritePreimage(root, p.preimage)
+		check(err)
+		if _, err := diffFuzzProgram(p, root); err != nil {
+			p = minimizeFuzzProgram(p, root)
+			_, perr := diffFuzzProgram(p, root)
+			t.Fatalf("%v\nminimized program:\n%sregs %x\ndata %x\npreimage %x oracle hash %s\nfails with %v", err, p, p.regs, p.data, p.preimage, p.oracleHash, perr)
+		}
+	})
+}
+
+// every known divergence is still there
+func TestKnownDivergences(t *testing.T) {
+	preimage := []byte("known divergence")
+	for i, code := range [][]uint32{
+		{rtype(0x07, 8, 9, 10, 0)},
+		{rtype(0x1a, 8, 11, 0, 0)},
+		{itype(9, 0, 2, 4020), 0xc, itype(0x23, 17, 8, 40)},
+	} {
+		p := &fuzzProgram{preimage: preimage, oracleHash: crypto.Keccak256Hash(preimage)}
+		p.regs[8], p.regs[9], p.regs[16], p.regs[17] = 40, 0x80000000, FUZZ_DATA, ORACLE_ADDR
+		p.ops = []fuzzInsns{{code: code}}
+		root := t.TempDir()
+		_, err := WritePreimage(root, preimage)
+		check(err)
+		known, err := diffFuzzProgram(p, root)
+		check(err)
+		if known != knownDivergences[i].name {
+			t.Fatalf("program %d hit %q, want %q", i, known, knownDivergences[i].name)
+		}
+	}
+}
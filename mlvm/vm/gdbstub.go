@@ -0,0 +1,407 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// A gdb remote serial protocol stub over the Debugger, so gdb-multiarch can
+// attach with "target remote". The registers are described to gdb in the
+// SyncRegs order, the 32 GPRs then pc, hi and lo, followed by the cp0 and fpu
+// registers gdb insists on for mips, which always read as zero. Continuing
+// can't be interrupted, it runs to a breakpoint, a watch or the end.
+
+const gdbTargetXml = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+<architecture>mips</architecture>
+<feature name="org.gnu.gdb.mips.cpu">
+%s  <reg name="pc" bitsize="32" regnum="32" type="code_ptr"/>
+  <reg name="hi" bitsize="32" regnum="33"/>
+  <reg name="lo" bitsize="32" regnum="34"/>
+</feature>
+<feature name="org.gnu.gdb.mips.cp0">
+  <reg name="status" bitsize="32" regnum="35"/>
+  <reg name="badvaddr" bitsize="32" regnum="36"/>
+  <reg name="cause" bitsize="32" regnum="37"/>
+</feature>
+<feature name="org.gnu.gdb.mips.fpu">
+%s  <reg name="fcsr" bitsize="32" regnum="70" group="float"/>
+  <reg name="fir" bitsize="32" regnum="71" group="float"/>
+</feature>
+</target>
+`
+
+// everything past lo, from 35 on, only exists to keep gdb happy
+const GDB_NUM_REGS = 72
+const GDB_REG_PC = 32
+
+func gdbTarget() string {
+	var gprs, fprs strings.Builder
+	for i := 0; i < 32; i++ {
+		fmt.Fprintf(&gprs, "  <reg name=\"r%d\" bitsize=\"32\" regnum=\"%d\"/>\n", i, i)
+		fmt.Fprintf(&fprs, "  <reg name=\"f%d\" bitsize=\"32\" type=\"ieee_single\" regnum=\"%d\"/>\n", i, 38+i)
+	}
+	return fmt.Sprintf(gdbTargetXml, gprs.String(), fprs.String())
+}
+
+// GDBServer talks to one gdb over conn
+type GDBServer struct {
+	d      *Debugger
+	r      *bufio.Reader
+	w      io.Writer
+	target string
+}
+
+func NewGDBServer(d *Debugger, conn io.ReadWriter) *GDBServer {
+	return &GDBServer{d: d, r: bufio.NewReader(conn), w: conn, target: gdbTarget()}
+}
+
+// ServeGDB waits for gdb on listen, unix:<path> or [tcp:]<host:port>, and
+// serves it until it detaches
+func ServeGDB(d *Debugger, listen string) error {
+	network, addr := "tcp", strings.TrimPrefix(listen, "tcp:")
+	if strings.HasPrefix(listen, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(listen, "unix:")
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Printf("waiting for gdb on %s %s\n", network, addr)
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return NewGDBServer(d, conn).Serve()
+}
+
+func gdbChecksum(dat string) byte {
+	var sum byte
+	for i := 0; i < len(dat); i++ {
+		sum += dat[i]
+	}
+	return sum
+}
+
+// readPacket returns the next $...#xx packet, acking it
+func (s *GDBServer) readPacket() (string, error) {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		// acks, and the interrupt byte which there's nothing to interrupt for
+		if c != '$' {
+			continue
+		}
+		dat, err := s.r.ReadString('#')
+		if err != nil {
+			return "", err
+		}
+		dat = dat[:len(dat)-1]
+		sum := make([]byte, 2)
+		if _, err := io.ReadFull(s.r, sum); err != nil {
+			return "", err
+		}
+		if want, err := strconv.ParseUint(string(sum), 16, 8); err != nil || byte(want) != gdbChecksum(dat) {
+			s.w.Write([]byte("-"))
+			continue
+		}
+		s.w.Write([]byte("+"))
+		return gdbUnescape(dat), nil
+	}
+}
+
+func gdbUnescape(dat string) string {
+	if !strings.Contains(dat, "}") {
+		return dat
+	}
+	var b strings.Builder
+	for i := 0; i < len(dat); i++ {
+		if dat[i] == '}' && i+1 < len(dat) {
+			i++
+			b.WriteByte(dat[i] ^ 0x20)
+		} else {
+			b.WriteByte(dat[i])
+		}
+	}
+	return b.String()
+}
+
+func (s *GDBServer) writePacket(dat string) error {
+	var b strings.Builder
+	for i := 0; i < len(dat); i++ {
+		switch dat[i] {
+		case '$', '#', '}', '*':
+			b.WriteByte('}')
+			b.WriteByte(dat[i] ^ 0x20)
+		default:
+			b.WriteByte(dat[i])
+		}
+	}
+	escaped := b.String()
+	_, err := fmt.Fprintf(s.w, "$%s#%02x", escaped, gdbChecksum(escaped))
+	return err
+}
+
+// Serve handles packets until gdb detaches or kills the target
+func (s *GDBServer) Serve() error {
+	for {
+		pkt, err := s.readPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply, done := s.handle(pkt)
+		if err := s.writePacket(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func gdbError(err error) string {
+	fmt.Println("gdb:", err)
+	return "E01"
+}
+
+func (s *GDBServer) handle(pkt string) (string, bool) {
+	switch {
+	case pkt == "?":
+		return s.stopReply(""), false
+	case strings.HasPrefix(pkt, "qSupported"):
+		return "PacketSize=4000;qXfer:features:read+", false
+	case strings.HasPrefix(pkt, "qXfer:features:read:target.xml:"):
+		return s.xfer(strings.TrimPrefix(pkt, "qXfer:features:read:target.xml:")), false
+	case pkt == "qAttached":
+		return "1", false
+	case pkt == "qC":
+		return "QC1", false
+	case pkt == "qfThreadInfo":
+		return "m1", false
+	case pkt == "qsThreadInfo":
+		return "l", false
+	case strings.HasPrefix(pkt, "H"):
+		return "OK", false
+	case strings.HasPrefix(pkt, "qRcmd,"):
+		return s.monitor(strings.TrimPrefix(pkt, "qRcmd,")), false
+	case pkt == "g":
+		var b strings.Builder
+		for i := 0; i < GDB_NUM_REGS; i++ {
+			fmt.Fprintf(&b, "%08x", s.readReg(i))
+		}
+		return b.String(), false
+	case strings.HasPrefix(pkt, "G"):
+		dat, err := hex.DecodeString(pkt[1:])
+		if err != nil {
+			return gdbError(err), false
+		}
+		for i := 0; i*4+4 <= len(dat) && i < GDB_NUM_REGS; i++ {
+			s.writeReg(i, binary.BigEndian.Uint32(dat[i*4:]))
+		}
+		s.d.sync()
+		return "OK", false
+	case strings.HasPrefix(pkt, "p"):
+		n, err := strconv.ParseUint(pkt[1:], 16, 32)
+		if err != nil || n >= GDB_NUM_REGS {
+			return "E01", false
+		}
+		return fmt.Sprintf("%08x", s.readReg(int(n))), false
+	case strings.HasPrefix(pkt, "P"):
+		var n int
+		var value uint32
+		if _, err := fmt.Sscanf(pkt, "P%x=%08x", &n, &value); err != nil || n >= GDB_NUM_REGS {
+			return "E01", false
+		}
+		s.writeReg(n, value)
+		s.d.sync()
+		return "OK", false
+	case strings.HasPrefix(pkt, "m"):
+		var addr, size uint64
+		if _, err := fmt.Sscanf(pkt, "m%x,%x", &addr, &size); err != nil {
+			return gdbError(err), false
+		}
+		dat, err := s.d.c.Mu.MemRead(addr, size)
+		if err != nil {
+			return "E14", false
+		}
+		return hex.EncodeToString(dat), false
+	case strings.HasPrefix(pkt, "M"):
+		var addr, size uint64
+		parts := strings.SplitN(pkt, ":", 2)
+		if _, err := fmt.Sscanf(parts[0], "M%x,%x", &addr, &size); err != nil || len(parts) != 2 {
+			return "E01", false
+		}
+		dat, err := hex.DecodeString(parts[1])
+		if err != nil || uint64(len(dat)) != size {
+			return "E01", false
+		}
+		if err := s.writeMem(uint32(addr), dat); err != nil {
+			return gdbError(err), false
+		}
+		return "OK", false
+	case strings.HasPrefix(pkt, "Z") || strings.HasPrefix(pkt, "z"):
+		var kind int
+		var addr uint64
+		if _, err := fmt.Sscanf(pkt[1:], "%d,%x", &kind, &addr); err != nil {
+			return "E01", false
+		}
+		set := pkt[0] == 'Z'
+		switch kind {
+		case 0, 1:
+			if set {
+				s.d.Break(uint32(addr))
+			} else {
+				delete(s.d.breaks, uint32(addr))
+			}
+		case 2:
+			if set {
+				s.d.Watch(uint32(addr))
+			} else {
+				delete(s.d.watches, uint32(addr)&^3)
+			}
+		default:
+			return "", false
+		}
+		return "OK", false
+	case pkt == "s" || pkt == "c":
+		target := -1
+		if pkt == "s" {
+			target = s.d.Step() + 1
+		}
+		reason, err := s.d.Continue(target)
+		if err != nil {
+			return gdbError(err), false
+		}
+		return s.stopReply(reason), false
+	case pkt == "D":
+		return "OK", true
+	case pkt == "k":
+		return "", true
+	}
+	// anything else is unsupported, which gdb takes as an empty reply
+	return "", false
+}
+
+func (s *GDBServer) stopReply(reason string) string {
+	if s.d.c.Exited {
+		return "W00"
+	}
+	var watch uint32
+	if _, err := fmt.Sscanf(reason, "watch %x:", &watch); err == nil {
+		return fmt.Sprintf("T05watch:%x;", watch)
+	}
+	return "S05"
+}
+
+func (s *GDBServer) xfer(args string) string {
+	var offset, length int
+	if _, err := fmt.Sscanf(args, "%x,%x", &offset, &length); err != nil {
+		return "E01"
+	}
+	if offset >= len(s.target) {
+		return "l"
+	}
+	if offset+length >= len(s.target) {
+		return "l" + s.target[offset:]
+	}
+	return "m" + s.target[offset:offset+length]
+}
+
+// monitor handles "monitor step", which prints the step counter that the
+// checkpoints and the dispute game count in, and "monitor goto N"
+func (s *GDBServer) monitor(arg string) string {
+	cmd, err := hex.DecodeString(arg)
+	if err != nil {
+		return "E01"
+	}
+	args := strings.Fields(string(cmd))
+	var out string
+	switch {
+	case len(args) == 1 && args[0] == "step":
+		out = fmt.Sprintf("step %d\n", s.d.Step())
+	case len(args) == 1 && args[0] == "heap":
+		out = fmt.Sprintf("heap %08x brk %08x\n", s.d.Ram()[REG_HEAP], s.d.Ram()[REG_BRK])
+	case len(args) == 2 && args[0] == "goto":
+		step, err := strconv.Atoi(args[1])
+		if err == nil {
+			err = s.d.Goto(step)
+		}
+		if err != nil {
+			out = fmt.Sprintf("goto: %v\n", err)
+		} else {
+			out = fmt.Sprintf("step %d\n", s.d.Step())
+		}
+	default:
+		out = "monitor commands: step, heap, goto N\n"
+	}
+	// gdb prints O packets as they arrive, the final reply ends the command
+	if err := s.writePacket("O" + hex.EncodeToString([]byte(out))); err != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+func (s *GDBServer) readReg(n int) uint32 {
+	switch {
+	case n < 32:
+		return s.d.Ram()[REG_OFFSET+uint32(n)*4]
+	case n == GDB_REG_PC:
+		return s.d.Ram()[REG_PC]
+	case n == 33:
+		return s.d.Ram()[REG_HI]
+	case n == 34:
+		return s.d.Ram()[REG_LO]
+	}
+	return 0
+}
+
+func (s *GDBServer) writeReg(n int, value uint32) {
+	mu := s.d.c.Mu
+	switch {
+	case n > 0 && n < 32:
+		mu.RegWrite(uc.MIPS_REG_ZERO+n, uint64(value))
+	case n == GDB_REG_PC:
+		mu.RegWrite(uc.MIPS_REG_PC, uint64(value))
+	case n == 33:
+		mu.RegWrite(uc.MIPS_REG_HI, uint64(value))
+	case n == 34:
+		mu.RegWrite(uc.MIPS_REG_LO, uint64(value))
+	}
+}
+
+// writeMem writes to unicorn and keeps the words in ram in step with it
+func (s *GDBServer) writeMem(addr uint32, dat []byte) error {
+	if addr >= REG_OFFSET || uint64(addr)+uint64(len(dat)) > uint64(REG_OFFSET) {
+		return errors.New("write outside of guest memory")
+	}
+	mu := s.d.c.Mu
+	if err := mu.MemWrite(uint64(addr), dat); err != nil {
+		return err
+	}
+	for a := addr &^ 3; a < addr+uint32(len(dat)); a += 4 {
+		word, err := mu.MemRead(uint64(a), 4)
+		if err != nil {
+			return err
+		}
+		WriteRam(s.d.Ram(), a, binary.BigEndian.Uint32(word))
+	}
+	s.d.sync()
+	return nil
+}
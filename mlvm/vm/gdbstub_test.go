@@ -0,0 +1,129 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// gdbClient plays gdb's side of the protocol
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *gdbClient) read() string {
+	for {
+		b, err := c.r.ReadByte()
+		check(err)
+		if b == '+' {
+			continue
+		}
+		if b != '$' {
+			c.t.Fatalf("unexpected %q from the stub", b)
+		}
+		dat, err := c.r.ReadString('#')
+		check(err)
+		sum := make([]byte, 2)
+		c.r.Read(sum)
+		if fmt.Sprintf("%02x", gdbChecksum(dat[:len(dat)-1])) != string(sum) {
+			c.t.Fatalf("bad checksum on %s", dat)
+		}
+		c.conn.Write([]byte("+"))
+		return gdbUnescape(dat[:len(dat)-1])
+	}
+}
+
+func (c *gdbClient) send(pkt string) string {
+	fmt.Fprintf(c.conn, "$%s#%02x", pkt, gdbChecksum(pkt))
+	return c.read()
+}
+
+func TestGDBStub(t *testing.T) {
+	initTest()
+	d := NewDebugger(t.TempDir(), -1, loadAsm(loopProgram), nil)
+	check(d.Goto(0))
+	server, conn := net.Pipe()
+	done := make(chan error)
+	go func() {
+		err := NewGDBServer(d, server).Serve()
+		server.Close()
+		done <- err
+	}()
+	c := &gdbClient{t, conn, bufio.NewReader(conn)}
+
+	if reply := c.send("qSupported:multiprocess+;xmlRegisters=i386"); !strings.Contains(reply, "qXfer:features:read+") {
+		t.Fatalf("qSupported %s", reply)
+	}
+	var xml string
+	for {
+		reply := c.send(fmt.Sprintf("qXfer:features:read:target.xml:%x,100", len(xml)))
+		xml += reply[1:]
+		if reply[0] == 'l' {
+			break
+		}
+	}
+	if xml != gdbTarget() || !strings.Contains(xml, `<reg name="pc" bitsize="32" regnum="32" type="code_ptr"/>`) {
+		t.Fatalf("target.xml:\n%s", xml)
+	}
+	if reply := c.send("?"); reply != "S05" {
+		t.Fatalf("? %s", reply)
+	}
+
+	// li $v0, 7, then registers in SyncRegs order
+	if reply := c.send("s"); reply != "S05" {
+		t.Fatalf("step %s", reply)
+	}
+	regs := c.send("g")
+	if len(regs) != GDB_NUM_REGS*8 || regs[2*8:3*8] != "00000007" || regs[32*8:33*8] != "00000004" {
+		t.Fatalf("registers %s", regs)
+	}
+	if reply := c.send("p20"); reply != "00000004" {
+		t.Fatalf("pc %s", reply)
+	}
+	if reply := c.send("m8,4"); reply != "2508ffff" {
+		t.Fatalf("memory %s", reply)
+	}
+
+	// stop at the store, make it store 9 instead
+	if reply := c.send("Z0,1c,4"); reply != "OK" {
+		t.Fatalf("Z0 %s", reply)
+	}
+	if reply := c.send("c"); reply != "S05" || d.Step() != 3004 {
+		t.Fatalf("continue %s at step %d", reply, d.Step())
+	}
+	if reply := c.send("P2=00000009"); reply != "OK" {
+		t.Fatalf("P %s", reply)
+	}
+	if reply := c.send("Z2,30000804,4"); reply != "OK" {
+		t.Fatalf("Z2 %s", reply)
+	}
+	if reply := c.send("c"); reply != "T05watch:30000804;" {
+		t.Fatalf("watch %s", reply)
+	}
+	if reply := c.send("m30000804,4"); reply != "00000009" || d.Ram()[0x30000804] != 9 {
+		t.Fatalf("output %s", reply)
+	}
+	if reply := c.send("M30000804,4:0000000a"); reply != "OK" || d.Ram()[0x30000804] != 10 {
+		t.Fatalf("M %s", reply)
+	}
+
+	fmt.Fprintf(conn, "$qRcmd,%s#%02x", hex.EncodeToString([]byte("step")), gdbChecksum("qRcmd,"+hex.EncodeToString([]byte("step"))))
+	if out, _ := hex.DecodeString(c.read()[1:]); string(out) != "step 3005\n" {
+		t.Fatalf("monitor step printed %q", out)
+	}
+	if reply := c.read(); reply != "OK" {
+		t.Fatalf("monitor %s", reply)
+	}
+
+	c.send("z0,1c,4")
+	if reply := c.send("c"); reply != "W00" {
+		t.Fatalf("exit %s", reply)
+	}
+	c.send("D")
+	check(<-done)
+}
@@ -0,0 +1,84 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"mlvm/asm"
+)
+
+// CheckpointPath is where the checkpoint for step is left, by MIPSRunCompatible
+// for a negative nodeID and by MIPSRun for a node otherwise
+func CheckpointPath(basedir string, nodeID int, step int) string {
+	if nodeID < 0 {
+		return fmt.Sprintf("%s/checkpoint_%d.json", basedir, step)
+	}
+	return fmt.Sprintf("%s/checkpoint/checkpoint_%d_%d.json", basedir, nodeID, step)
+}
+
+// LoadCheckpoint reads a checkpoint file back into ram. A golden checkpoint
+// has to have been written with the layout in use, see UseCheckpoint.
+func LoadCheckpoint(fn string) (common.Hash, int, map[uint32](uint32), error) {
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return common.Hash{}, 0, nil, err
+	}
+	j, err := TrieFromJson(dat)
+	if err != nil {
+		return common.Hash{}, 0, nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	if j.Layout != nil && *j.Layout != GuestLayout {
+		return common.Hash{}, 0, nil, fmt.Errorf("%s was written with another layout than the one in use", fn)
+	}
+	return j.Root, j.Step, RamFromTrie(j.Root), nil
+}
+
+// UseCheckpoint switches to the layout fn was written with, if it's a golden
+// checkpoint
+func UseCheckpoint(fn string) error {
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	j, err := TrieFromJson(dat)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	if j.Layout != nil {
+		return SetLayout(*j.Layout)
+	}
+	return nil
+}
+
+// DisassembleAt renders the instruction at pc in ram
+func DisassembleAt(ram map[uint32](uint32), pc uint32) string {
+	return asm.Disassemble(pc, ram[pc])
+}
+
+// Inspect prints the registers and the count instructions from PC
+func Inspect(ram map[uint32](uint32), count int) string {
+	var b strings.Builder
+	pc := ram[REG_PC]
+	for i := uint32(0); i < uint32(count); i++ {
+		addr := pc + 4*i
+		marker := "  "
+		if i == 0 {
+			marker = "=>"
+		}
+		fmt.Fprintf(&b, "%s %08x:  %08x  %s\n", marker, addr, ram[addr], DisassembleAt(ram, addr))
+	}
+	b.WriteString("\n")
+	for i := uint32(0); i < 32; i++ {
+		fmt.Fprintf(&b, "%5s %08x", "$"+asm.RegName(i), ram[REG_OFFSET+i*4])
+		if i%4 == 3 {
+			b.WriteString("\n")
+		} else {
+			b.WriteString("  ")
+		}
+	}
+	fmt.Fprintf(&b, "   pc %08x     hi %08x     lo %08x   heap %08x    brk %08x\n", pc, ram[REG_HI], ram[REG_LO], ram[REG_HEAP], ram[REG_BRK])
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+func TestInspectCheckpoint(t *testing.T) {
+	initTest()
+	basedir := t.TempDir()
+	oracle.SetRoot(basedir)
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	ram[REG_PC] = 0x1000
+	ram[REG_OFFSET+29*4] = 0x7fffd000
+	ram[0x1000] = 0x27bdffe0 // addiu $sp, $sp, -32
+	ram[0x1004] = 0x0c000800 // jal 0x2000
+	fn := CheckpointPath(basedir, -1, 12)
+	WriteCheckpoint(ram, fn, 12)
+
+	_, step, loaded, err := LoadCheckpoint(fn)
+	check(err)
+	if step != 12 {
+		t.Fatalf("loaded step %d", step)
+	}
+	out := Inspect(loaded, 3)
+	for _, want := range []string{
+		"=> 00001000:  27bdffe0  addiu $sp, $sp, -32\n",
+		"   00001004:  0c000800  jal 0x2000\n",
+		"   00001008:  00000000  nop\n",
+		"  $sp 7fffd000",
+		"   pc 00001000",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("inspect is missing %q:\n%s", want, out)
+		}
+	}
+}
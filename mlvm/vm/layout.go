@@ -0,0 +1,244 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+// Region is a part of the guest's address space, [Start, End)
+type Region struct {
+	Start uint32
+	End   uint32
+}
+
+func (r Region) Contains(addr uint32) bool {
+	return addr >= r.Start && addr < r.End
+}
+
+func (r Region) Overlaps(o Region) bool {
+	return r.Start < o.End && o.Start < r.End
+}
+
+type hexRegion struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (r Region) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hexRegion{fmt.Sprintf("0x%08x", r.Start), fmt.Sprintf("0x%08x", r.End)})
+}
+
+func (r *Region) UnmarshalJSON(dat []byte) error {
+	var h hexRegion
+	if err := json.Unmarshal(dat, &h); err != nil {
+		return err
+	}
+	start, err := strconv.ParseUint(h.Start, 0, 32)
+	if err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+	end, err := strconv.ParseUint(h.End, 0, 64)
+	if err != nil || end > 1<<32 {
+		return fmt.Errorf("end: %s", h.End)
+	}
+	r.Start, r.End = uint32(start), uint32(end)
+	return nil
+}
+
+// Layout is where the guest and mlvm agree things are in memory. The guest
+// program has to be built for the same layout. Oracle, OracleHash, Registers
+// and the starts of Heap and Brk are also constants in MIPS.sol and
+// MIPSMemory.sol, so Validate keeps them where the contracts have them
+// unless Unpinned says the contracts were built to match.
+type Layout struct {
+	// the output magic and hash the guest writes when done
+	Magic Region `json:"magic"`
+	// the hash the 4020 syscall loads the preimage of
+	OracleHash Region `json:"oracleHash"`
+	// where the preimage shows up, its length then its bytes
+	Oracle Region `json:"oracle"`
+	// the input is loaded into the oracle window, as a length then its bytes
+	Input Region `json:"input"`
+	// a paged input's header, out of the window, which on chain only ever
+	// reads preimages
+	PagedInput Region `json:"pagedInput"`
+	Output     Region `json:"output"`
+	Model      Region `json:"model"`
+	// the GPRs, pc, hi, lo, heap and brk
+	Registers Region `json:"registers"`
+	Heap      Region `json:"heap"`
+	Brk       Region `json:"brk"`
+	// lets the regions the contracts pin move
+	Unpinned bool `json:"unpinned,omitempty"`
+}
+
+// the words of the register block
+const REG_BLOCK_WORDS = 0x25
+
+func DefaultLayout() Layout {
+	return Layout{
+		Magic:      Region{0x30000800, 0x30000844},
+		OracleHash: Region{0x30001000, 0x30001020},
+		Oracle:     Region{0x31000000, 0x32000000},
+		Input:      Region{0x31000000, 0x32000000},
+		PagedInput: Region{0x30002000, 0x30002000 + PAGED_INPUT_WORDS*4},
+		Output:     Region{0x32000000, 0x33000000},
+		Model:      Region{0x33000000, 0x40000000},
+		Registers:  Region{0xc0000000, 0xc0000000 + REG_BLOCK_WORDS*4},
+		Heap:       Region{HEAP_START, 0x30000000},
+		Brk:        Region{BRK_START, HALT_PC},
+	}
+}
+
+// GuestLayout is the layout in use, set it with SetLayout
+var GuestLayout = DefaultLayout()
+
+// memory layout in MIPS, from GuestLayout
+var (
+	INPUT_ADDR       uint32 = 0x31000000
+	PAGED_INPUT_ADDR uint32 = 0x30002000
+	OUTPUT_ADDR      uint32 = 0x32000000
+	MODEL_ADDR       uint32 = 0x33000000
+	MAGIC_ADDR       uint32 = 0x30000800
+	ORACLE_HASH_ADDR uint32 = 0x30001000
+	ORACLE_ADDR      uint32 = 0x31000000
+	ORACLE_END       uint32 = 0x32000000
+	// the model has to end before this
+	MODEL_END uint32 = 0x40000000
+)
+
+func (l *Layout) regions() []MemRange {
+	return []MemRange{
+		{"magic", l.Magic.Start, l.Magic.End},
+		{"oracle hash", l.OracleHash.Start, l.OracleHash.End},
+		{"oracle", l.Oracle.Start, l.Oracle.End},
+		{"input", l.Input.Start, l.Input.End},
+		{"paged input", l.PagedInput.Start, l.PagedInput.End},
+		{"output", l.Output.Start, l.Output.End},
+		{"model", l.Model.Start, l.Model.End},
+		{"registers", l.Registers.Start, l.Registers.End},
+		{"heap", l.Heap.Start, l.Heap.End},
+		{"brk heap", l.Brk.Start, l.Brk.End},
+		{"halt", HALT_PC, SLED_END + 4},
+	}
+}
+
+// pinned are the addresses MIPS.sol and MIPSMemory.sol hard code
+func (l *Layout) pinned() []MemRange {
+	return []MemRange{
+		{"oracle", l.Oracle.Start, l.Oracle.End},
+		{"oracle hash", l.OracleHash.Start, 0},
+		{"registers", l.Registers.Start, 0},
+		{"heap", l.Heap.Start, 0},
+		{"brk heap", l.Brk.Start, 0},
+	}
+}
+
+// Validate checks every region is there and none overlap, except the input
+// that is loaded into the oracle window, and that the regions the contracts
+// pin haven't moved
+func (l Layout) Validate() error {
+	if !l.Unpinned {
+		d := DefaultLayout()
+		for i, want := range d.pinned() {
+			if got := l.pinned()[i]; got != want {
+				at := fmt.Sprintf("%x", want.Start)
+				if want.End != 0 {
+					at += fmt.Sprintf("-%x", want.End)
+				}
+				return fmt.Errorf("%s is pinned at %s by the contracts, set unpinned to move it with contracts built to match", want.Name, at)
+			}
+		}
+	}
+	regions := l.regions()
+	for _, r := range regions {
+		if r.Start >= r.End {
+			return fmt.Errorf("%s %x-%x is empty", r.Name, r.Start, r.End)
+		}
+	}
+	if l.OracleHash.End-l.OracleHash.Start < 0x20 {
+		return fmt.Errorf("oracle hash %x-%x is shorter than a hash", l.OracleHash.Start, l.OracleHash.End)
+	}
+	if l.PagedInput.End-l.PagedInput.Start < PAGED_INPUT_WORDS*4 {
+		return fmt.Errorf("paged input %x-%x is shorter than the %d word header", l.PagedInput.Start, l.PagedInput.End, PAGED_INPUT_WORDS)
+	}
+	if l.Registers.End-l.Registers.Start < REG_BLOCK_WORDS*4 {
+		return fmt.Errorf("registers %x-%x are shorter than the %d word register block", l.Registers.Start, l.Registers.End, REG_BLOCK_WORDS)
+	}
+	if l.Input.Overlaps(l.Oracle) && (l.Input.Start < l.Oracle.Start || l.Input.End > l.Oracle.End) {
+		return fmt.Errorf("input %x-%x overlaps the oracle window %x-%x without being in it", l.Input.Start, l.Input.End, l.Oracle.Start, l.Oracle.End)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Start < regions[j].Start })
+	for i, a := range regions {
+		for _, b := range regions[i+1:] {
+			if b.Start >= a.End {
+				break
+			}
+			if (a.Name == "oracle" && b.Name == "input") || (a.Name == "input" && b.Name == "oracle") {
+				continue
+			}
+			return fmt.Errorf("%s %x-%x overlaps %s %x-%x", a.Name, a.Start, a.End, b.Name, b.Start, b.End)
+		}
+	}
+	if l.Heap.End > MEMORY_END || l.Brk.End > MEMORY_END {
+		return fmt.Errorf("heaps run past mapped memory at %x", MEMORY_END)
+	}
+	return nil
+}
+
+// ReadLayout reads a layout manifest. Regions it leaves out keep their
+// default.
+func ReadLayout(fn string) (Layout, error) {
+	l := DefaultLayout()
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(dat, &l); err != nil {
+		return l, fmt.Errorf("%s: %v", fn, err)
+	}
+	if err := l.Validate(); err != nil {
+		return l, fmt.Errorf("%s: %v", fn, err)
+	}
+	return l, nil
+}
+
+// SetLayout points the loaders, hooks and register block at l, and the
+// memory map's heaps at its heaps. l has to Validate.
+func SetLayout(l Layout) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	GuestLayout = l
+	INPUT_ADDR = l.Input.Start
+	PAGED_INPUT_ADDR = l.PagedInput.Start
+	OUTPUT_ADDR = l.Output.Start
+	MODEL_ADDR = l.Model.Start
+	MODEL_END = l.Model.End
+	MAGIC_ADDR = l.Magic.Start
+	ORACLE_HASH_ADDR = l.OracleHash.Start
+	ORACLE_ADDR = l.Oracle.Start
+	ORACLE_END = l.Oracle.End
+
+	REG_OFFSET = l.Registers.Start
+	REG_PC = REG_OFFSET + 0x20*4
+	REG_HI = REG_OFFSET + 0x21*4
+	REG_LO = REG_OFFSET + 0x22*4
+	REG_HEAP = REG_OFFSET + 0x23*4
+	REG_BRK = REG_OFFSET + 0x24*4
+	REG_LR = REG_OFFSET + 0x1f*4
+	REG_BLOCK_END = REG_OFFSET + REG_BLOCK_WORDS*4
+
+	Memory.HeapStart, Memory.HeapEnd = l.Heap.Start, l.Heap.End
+	Memory.BrkStart, Memory.BrkEnd = l.Brk.Start, l.Brk.End
+	return nil
+}
+
+func (l Layout) Json() []byte {
+	dat, err := json.MarshalIndent(l, "", "  ")
+	check(err)
+	return dat
+}
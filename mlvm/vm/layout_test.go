@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLayout(t *testing.T) {
+	initTest()
+	defer SetLayout(DefaultLayout())
+	check(DefaultLayout().Validate())
+
+	fn := filepath.Join(t.TempDir(), "layout.json")
+	check(ioutil.WriteFile(fn, []byte(`{
+		"oracle": {"start": "0x31000000", "end": "0x31800000"},
+		"input": {"start": "0x31000000", "end": "0x31800000"},
+		"output": {"start": "0x31800000", "end": "0x32000000"},
+		"model": {"start": "0x32000000", "end": "0x40000000"},
+		"registers": {"start": "0xc0001000", "end": "0xc0001100"},
+		"unpinned": true
+	}`), 0644))
+	l, err := ReadLayout(fn)
+	check(err)
+	if l.Magic != DefaultLayout().Magic || l.Model.Start != 0x32000000 {
+		t.Fatalf("read %+v", l)
+	}
+
+	check(SetLayout(l))
+	if OUTPUT_ADDR != 0x31800000 || MODEL_ADDR != 0x32000000 || REG_PC != 0xc0001080 || REG_BRK != 0xc0001090 {
+		t.Fatalf("output %x model %x pc %x brk %x", OUTPUT_ADDR, MODEL_ADDR, REG_PC, REG_BRK)
+	}
+	if MemRegion(0x32000004) != "model" || MemRegion(0xc0001004) != "registers" {
+		t.Fatal("MemRegion doesn't follow the layout")
+	}
+
+	// golden checkpoints carry the layout and bring it back
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	dat := CheckpointToJson(ram, common.Hash{}, -1, 0, 0)
+	SetLayout(DefaultLayout())
+	j, err := TrieFromJson(dat)
+	check(err)
+	if j.Layout == nil || *j.Layout != l || GuestLayout != DefaultLayout() {
+		t.Fatalf("golden layout %+v, in use %+v", j.Layout, GuestLayout)
+	}
+	// it's only switched to when asked, loading needs the layout in use
+	fn = filepath.Join(t.TempDir(), "golden.json")
+	check(ioutil.WriteFile(fn, dat, 0644))
+	if _, _, _, err := LoadCheckpoint(fn); err == nil {
+		t.Fatal("loaded a golden checkpoint of another layout")
+	}
+	check(UseCheckpoint(fn))
+	if GuestLayout != l || REG_PC != 0xc0001080 {
+		t.Fatalf("golden layout %+v", GuestLayout)
+	}
+	if _, _, _, err := LoadCheckpoint(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	// a bad layout comes back as an error
+	bad := strings.Replace(string(dat), `"unpinned":true`, `"unpinned":false`, 1)
+	if _, err := TrieFromJson([]byte(bad)); err == nil {
+		t.Fatal("read a golden checkpoint with a bad layout")
+	}
+	SetLayout(DefaultLayout())
+	if dat := CheckpointToJson(ram, common.Hash{}, 3, 0, 0); strings.Contains(string(dat), "layout") {
+		t.Fatal("only golden checkpoints carry the layout")
+	}
+}
+
+func TestLayoutValidate(t *testing.T) {
+	for want, edit := range map[string]func(l *Layout){
+		"output 32000000-33000000 overlaps model": func(l *Layout) { l.Model.Start = 0x32800000 },
+		"shorter than a hash":                     func(l *Layout) { l.OracleHash.End = 0x30001010 },
+		"register block":                          func(l *Layout) { l.Registers.End = 0xc0000090 },
+		"word header":                             func(l *Layout) { l.PagedInput.End = 0x30002010 },
+		"overlaps paged input 30001010-30001038":  func(l *Layout) { l.PagedInput = Region{0x30001010, 0x30001038} },
+		"without being in it":                     func(l *Layout) { l.Input = Region{0x30800000, 0x31800000} },
+		"halt":                                    func(l *Layout) { l.Brk.End = 0x60000000 },
+		"empty":                                   func(l *Layout) { l.Output.End = l.Output.Start },
+		"oracle is pinned at 31000000-32000000":   func(l *Layout) { l.Oracle.End = 0x31800000 },
+		"oracle hash is pinned at 30001000":       func(l *Layout) { l.OracleHash = Region{0x30002000, 0x30002020} },
+		"registers is pinned":                     func(l *Layout) { l.Registers = Region{0xc0001000, 0xc0001100} },
+		"heap is pinned":                          func(l *Layout) { l.Heap.Start = 0x20001000 },
+		"brk heap is pinned":                      func(l *Layout) { l.Brk.Start = 0x40001000 },
+	} {
+		l := DefaultLayout()
+		edit(&l)
+		if err := l.Validate(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%v, want %s", err, want)
+		}
+		if err := SetLayout(l); err == nil {
+			t.Errorf("set a layout with %s", want)
+		}
+	}
+
+	// contracts built to match can move them
+	l := DefaultLayout()
+	l.Registers = Region{0xc0001000, 0xc0001100}
+	l.Unpinned = true
+	check(l.Validate())
+}
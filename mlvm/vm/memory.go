@@ -0,0 +1,221 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// unicorn maps the guest's memory up to here
+const MEMORY_END = 0x80000000
+
+// MemoryMap is where the guest's two heaps live: mmap hands out memory from
+// [HeapStart, HeapEnd) and brk moves within [BrkStart, BrkEnd). They start
+// out as GuestLayout's heaps. The starts are MIPS.sol's HEAP_START and
+// BRK_START, a map that moves them can only be proven against a MIPS.sol with
+// the same constants.
+type MemoryMap struct {
+	HeapStart uint32
+	HeapEnd   uint32
+	BrkStart  uint32
+	BrkEnd    uint32
+	// Limit caps the bytes of both heaps together, 0 leaves only the regions
+	Limit uint64
+}
+
+var Memory = DefaultMemoryMap()
+
+func DefaultMemoryMap() MemoryMap {
+	l := GuestLayout
+	return MemoryMap{HeapStart: l.Heap.Start, HeapEnd: l.Heap.End, BrkStart: l.Brk.Start, BrkEnd: l.Brk.End}
+}
+
+// MemRange is a reserved part of the address space, [Start, End)
+type MemRange struct {
+	Name  string
+	Start uint32
+	End   uint32
+}
+
+// ReservedRanges are the parts of GuestLayout the heaps must stay out of
+func ReservedRanges() []MemRange {
+	var ranges []MemRange
+	for _, r := range GuestLayout.regions() {
+		if r.Name != "heap" && r.Name != "brk heap" {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// Collides returns the reserved range [start, end) overlaps, if any. end is
+// 64 bits so a range up to the top of memory doesn't wrap to 0.
+func Collides(start uint32, end uint64) (MemRange, bool) {
+	for _, r := range ReservedRanges() {
+		if start < r.End && uint64(r.Start) < end {
+			return r, true
+		}
+	}
+	return MemRange{}, false
+}
+
+func (m MemoryMap) Validate() error {
+	heaps := []MemRange{{"mmap heap", m.HeapStart, m.HeapEnd}, {"brk heap", m.BrkStart, m.BrkEnd}}
+	for _, h := range heaps {
+		if h.Start == 0 || h.Start >= h.End {
+			return fmt.Errorf("%s %x-%x is empty", h.Name, h.Start, h.End)
+		}
+		if h.End > MEMORY_END {
+			return fmt.Errorf("%s %x-%x runs past mapped memory at %x", h.Name, h.Start, h.End, MEMORY_END)
+		}
+		if r, ok := Collides(h.Start, uint64(h.End)); ok {
+			return fmt.Errorf("%s %x-%x collides with %s %x-%x", h.Name, h.Start, h.End, r.Name, r.Start, r.End)
+		}
+	}
+	if m.HeapStart < m.BrkEnd && m.BrkStart < m.HeapEnd {
+		return fmt.Errorf("mmap heap %x-%x and brk heap %x-%x overlap", m.HeapStart, m.HeapEnd, m.BrkStart, m.BrkEnd)
+	}
+	return nil
+}
+
+// ParseMemoryMap reads "mmap=start-end,brk=start-end" over the default map,
+// either part can be left out
+func ParseMemoryMap(s string) (MemoryMap, error) {
+	m := DefaultMemoryMap()
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, bounds, ok := strings.Cut(part, "=")
+		start, end, ok2 := strings.Cut(bounds, "-")
+		if !ok || !ok2 {
+			return m, fmt.Errorf("bad memory map part %q, want name=start-end", part)
+		}
+		a, err := strconv.ParseUint(start, 0, 32)
+		if err != nil {
+			return m, err
+		}
+		b, err := strconv.ParseUint(end, 0, 32)
+		if err != nil {
+			return m, err
+		}
+		switch name {
+		case "mmap", "heap":
+			m.HeapStart, m.HeapEnd = uint32(a), uint32(b)
+		case "brk":
+			m.BrkStart, m.BrkEnd = uint32(a), uint32(b)
+		default:
+			return m, fmt.Errorf("unknown memory region %s", name)
+		}
+	}
+	return m, nil
+}
+
+// HeapStats are what the heaps did over a run
+type HeapStats struct {
+	Mmaps int
+	Brks  int
+	// the largest mmap asked for
+	MaxMmap uint32
+}
+
+var Heap HeapStats
+
+// ResetHeap empties both heaps, for a new run
+func ResetHeap() {
+	heap_start = 0
+	brk_size = 0
+	Heap = HeapStats{}
+}
+
+// HeapReport is the heap part of the run report
+func HeapReport() string {
+	s := fmt.Sprintf("heap: %d mmaps, %d bytes of %d, largest %d; brk: %d calls, %d bytes of %d",
+		Heap.Mmaps, heap_start, Memory.HeapEnd-Memory.HeapStart, Heap.MaxMmap,
+		Heap.Brks, brk_size, Memory.BrkEnd-Memory.BrkStart)
+	if Memory.Limit > 0 {
+		s += fmt.Sprintf("; %d bytes of the %d limit", heap_start+brk_size, Memory.Limit)
+	}
+	return s
+}
+
+type MemoryError struct {
+	Syscall string
+	Size    uint64
+	Reason  string
+	Step    int
+	PC      uint32
+}
+
+func (e *MemoryError) Error() string {
+	return fmt.Sprintf("%s of %d bytes at step %d pc %x: %s", e.Syscall, e.Size, e.Step, e.PC, e.Reason)
+}
+
+func memoryError(mu uc.Unicorn, syscall string, size uint64, reason string, args ...interface{}) {
+	pc, _ := mu.RegRead(uc.MIPS_REG_PC)
+	syscallFault(&MemoryError{syscall, size, fmt.Sprintf(reason, args...), 0, uint32(pc)})
+}
+
+// hostMmap stops the run before an mmap can leave the heap or go over the
+// limit. Runs that get past here never do, so MIPS.sol doesn't check.
+func hostMmap(mu uc.Unicorn, root string, ram map[uint32](uint32)) {
+	a0, _ := mu.RegRead(uc.MIPS_REG_A0)
+	sz, _ := mu.RegRead(uc.MIPS_REG_A1)
+	Heap.Mmaps++
+	if uint32(sz) > Heap.MaxMmap {
+		Heap.MaxMmap = uint32(sz)
+	}
+	if a0 != 0 {
+		// a fixed mapping, it only has to keep off the reserved memory
+		if a0+sz > 1<<32 {
+			memoryError(mu, "mmap", sz, "%x-%x runs past the address space", a0, a0+sz)
+		} else if r, ok := Collides(uint32(a0), a0+sz); ok {
+			memoryError(mu, "mmap", sz, "%x-%x collides with %s", a0, a0+sz, r.Name)
+		}
+		return
+	}
+	if uint64(Memory.HeapStart)+heap_start+sz > uint64(Memory.HeapEnd) {
+		memoryError(mu, "mmap", sz, "heap would end at %x, past %x", uint64(Memory.HeapStart)+heap_start+sz, Memory.HeapEnd)
+	}
+	if Memory.Limit > 0 && heap_start+sz+brk_size > Memory.Limit {
+		memoryError(mu, "mmap", sz, "over the memory limit of %d bytes", Memory.Limit)
+	}
+}
+
+func hostBrk(mu uc.Unicorn, root string, ram map[uint32](uint32)) {
+	a0, _ := mu.RegRead(uc.MIPS_REG_A0)
+	Heap.Brks++
+	if a0 < uint64(Memory.BrkStart) {
+		return
+	}
+	if a0 > uint64(Memory.BrkEnd) {
+		memoryError(mu, "brk", a0-uint64(Memory.BrkStart), "break %x past %x", a0, Memory.BrkEnd)
+	}
+	if Memory.Limit > 0 && heap_start+a0-uint64(Memory.BrkStart) > Memory.Limit {
+		memoryError(mu, "brk", a0-uint64(Memory.BrkStart), "over the memory limit of %d bytes", Memory.Limit)
+	}
+}
+
+func runMmap(m SyscallMachine) uint32 {
+	a0 := SyscallArg(m, 0)
+	if a0 != 0 {
+		return a0
+	}
+	sz := SyscallArg(m, 1)
+	hr := m.Read(REG_HEAP)
+	m.Write(REG_HEAP, hr+sz)
+	return Memory.HeapStart + hr
+}
+
+// runBrk moves the break to a0 if it's in the brk heap, and returns the
+// break. brk(0) asks for it without moving it.
+func runBrk(m SyscallMachine) uint32 {
+	a0 := SyscallArg(m, 0)
+	if a0 < Memory.BrkStart {
+		return Memory.BrkStart + m.Read(REG_BRK)
+	}
+	m.Write(REG_BRK, a0-Memory.BrkStart)
+	return a0
+}
@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryMap(t *testing.T) {
+	check(DefaultMemoryMap().Validate())
+
+	m, err := ParseMemoryMap("mmap=0x10000000-0x20000000, brk=0x40000000-0x50000000")
+	check(err)
+	if m.HeapStart != 0x10000000 || m.HeapEnd != 0x20000000 || m.BrkStart != 0x40000000 || m.BrkEnd != 0x50000000 {
+		t.Fatalf("parsed %+v", m)
+	}
+	check(m.Validate())
+
+	for s, want := range map[string]string{
+		"mmap=0x20000000-0x31000004":  "collides with magic",
+		"brk=0x34000000-0x50000000":   "collides with model",
+		"brk=0x60000000-0xc0000100":   "past mapped memory",
+		"mmap=0x40000000-0x48000000":  "overlap",
+		"mmap=0x20000000-0x20000000":  "empty",
+		"stack=0x10000000-0x20000000": "unknown memory region",
+	} {
+		m, err := ParseMemoryMap(s)
+		if err == nil {
+			err = m.Validate()
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want %s", s, err, want)
+		}
+	}
+
+	// a range to the top of memory doesn't wrap to 0
+	if r, ok := Collides(0xb0000000, 1<<32); !ok || r.Name != "registers" {
+		t.Fatalf("collides with %+v %v", r, ok)
+	}
+}
+
+func TestBrk(t *testing.T) {
+	initTest()
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+
+	stepSyscall(t, ram, 4045, 0, 0)
+	if ram[REG_OFFSET+2*4] != BRK_START {
+		t.Fatalf("brk(0) %x", ram[REG_OFFSET+2*4])
+	}
+	if _, ok := ram[REG_BRK]; ok {
+		t.Fatal("brk(0) wrote the break")
+	}
+	stepSyscall(t, ram, 4045, BRK_START+0x3000, 0)
+	if ram[REG_OFFSET+2*4] != BRK_START+0x3000 || ram[REG_BRK] != 0x3000 {
+		t.Fatalf("brk %x break %x", ram[REG_OFFSET+2*4], ram[REG_BRK])
+	}
+	stepSyscall(t, ram, 4045, 0, 0)
+	if ram[REG_OFFSET+2*4] != BRK_START+0x3000 {
+		t.Fatalf("brk(0) after moving %x", ram[REG_OFFSET+2*4])
+	}
+
+	s := StateFromRam(ram)
+	if s.Brk != 0x3000 {
+		t.Fatalf("state brk %x", s.Brk)
+	}
+	dat, err := s.Registers.MarshalJSON()
+	check(err)
+	if !strings.HasSuffix(string(dat), `"brk":"0x00003000"}`) {
+		t.Fatal(string(dat))
+	}
+}
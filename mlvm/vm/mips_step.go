@@ -0,0 +1,511 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// This is a port of MIPS.Step and MIPSMemory.ReadMemory, so the state
+// transition that is checked on chain can be run and inspected off chain. Keep
+// it in sync with contracts/MIPS.sol, quirks included.
+
+// StepMemory is the state MIPS.sol steps over
+type StepMemory interface {
+	// ReadWord and WriteWord access a word of the state trie
+	ReadWord(addr uint32) (uint32, error)
+	WriteWord(addr uint32, value uint32) error
+	// Preimage returns the data MIPSMemory.AddPreimage was given for hash
+	Preimage(hash common.Hash) ([]byte, error)
+}
+
+type PreimageRead struct {
+	Hash   common.Hash
+	Offset uint32
+}
+
+// StepAccess is everything a step touched
+type StepAccess struct {
+	// Addrs are the trie words read or written, in order of first access
+	Addrs     []uint32
+	Preimages []PreimageRead
+	Writes    map[uint32]uint32
+}
+
+type stepError struct {
+	err error
+}
+
+var REG_LR uint32 = REG_OFFSET + 0x1f*4
+var REG_HI uint32 = REG_OFFSET + 0x21*4
+var REG_LO uint32 = REG_OFFSET + 0x22*4
+
+const HEAP_START = 0x20000000
+const BRK_START = 0x40000000
+
+var emptyHash = crypto.Keccak256Hash(nil)
+
+type mipsStep struct {
+	m      StepMemory
+	access *StepAccess
+	seen   map[uint32]bool
+}
+
+// StepMIPS runs a single MIPS.Step against m
+func StepMIPS(m StepMemory) (access *StepAccess, err error) {
+	s := &mipsStep{m: m, access: &StepAccess{Writes: make(map[uint32]uint32)}, seen: make(map[uint32]bool)}
+	defer func() {
+		if r := recover(); r != nil {
+			serr, ok := r.(stepError)
+			if !ok {
+				panic(r)
+			}
+			access, err = s.access, serr.err
+		}
+	}()
+
+	pc := s.read(REG_PC)
+	if pc == HALT_PC {
+		return s.access, nil
+	}
+	s.stepPC(pc, pc+4)
+	return s.access, nil
+}
+
+func fail(err error) {
+	panic(stepError{err})
+}
+
+func (s *mipsStep) touch(addr uint32) {
+	if !s.seen[addr] {
+		s.seen[addr] = true
+		s.access.Addrs = append(s.access.Addrs, addr)
+	}
+}
+
+func (s *mipsStep) read(addr uint32) uint32 {
+	if addr&3 != 0 {
+		fail(errors.New("read memory must be 32-bit aligned"))
+	}
+	// zero register is always 0
+	if addr == REG_OFFSET {
+		return 0
+	}
+
+	// MMIO preimage oracle
+	if addr >= ORACLE_ADDR && addr < ORACLE_END {
+		var hash common.Hash
+		for i := uint32(0); i < 32; i += 4 {
+			binary.BigEndian.PutUint32(hash[i:], s.read(ORACLE_HASH_ADDR+i))
+		}
+		if hash == emptyHash {
+			return 0
+		}
+		dat, err := s.m.Preimage(hash)
+		if err != nil {
+			fail(err)
+		}
+		offset := addr - (ORACLE_ADDR + 4)
+		if addr == ORACLE_ADDR {
+			offset = 0
+		}
+		s.access.Preimages = append(s.access.Preimages, PreimageRead{hash, offset})
+		if addr == ORACLE_ADDR {
+			return uint32(len(dat))
+		}
+		if offset >= uint32(len(dat)) {
+			fail(fmt.Errorf("preimage %s has no data at %d", hash, offset))
+		}
+		word := make([]byte, 4)
+		copy(word, dat[offset:])
+		return binary.BigEndian.Uint32(word)
+	}
+
+	s.touch(addr)
+	value, err := s.m.ReadWord(addr)
+	if err != nil {
+		fail(err)
+	}
+	return value
+}
+
+func (s *mipsStep) write(addr uint32, value uint32) {
+	if addr&3 != 0 {
+		fail(errors.New("write memory must be 32-bit aligned"))
+	}
+	s.touch(addr)
+	if err := s.m.WriteWord(addr, value); err != nil {
+		fail(err)
+	}
+	s.access.Writes[addr] = value
+	if s.read(addr) != value {
+		fail(errors.New("memory readback check failed"))
+	}
+}
+
+func SE(dat uint32, idx uint32) uint32 {
+	isSigned := (dat >> (idx - 1)) != 0
+	signed := ((uint64(1) << (32 - idx)) - 1) << idx
+	mask := (uint64(1) << idx) - 1
+	if isSigned {
+		return uint32(uint64(dat)&mask | signed)
+	}
+	return uint32(uint64(dat) & mask)
+}
+
+// stepMachine is the state trie as syscalls see it
+type stepMachine struct {
+	s *mipsStep
+}
+
+func (m stepMachine) Read(addr uint32) uint32 {
+	return m.s.read(addr)
+}
+
+func (m stepMachine) Write(addr uint32, value uint32) {
+	m.s.write(addr, value)
+}
+
+func (s *mipsStep) handleSyscall() bool {
+	return RunSyscall(stepMachine{s})
+}
+
+func (s *mipsStep) stepPC(pc uint32, nextPC uint32) {
+	// instruction fetch
+	insn := s.read(pc)
+
+	opcode := insn >> 26 // 6-bits
+	fn := insn & 0x3f    // 6-bits
+
+	// j-type j/jal
+	if opcode == 2 || opcode == 3 {
+		s.stepPC(nextPC, SE(insn&0x03FFFFFF, 26)<<2)
+		if opcode == 3 {
+			s.write(REG_LR, pc+8)
+		}
+		return
+	}
+
+	// register fetch
+	storeAddr := REG_OFFSET
+	var rs, rt uint32
+	rtReg := REG_OFFSET + ((insn >> 14) & 0x7C)
+
+	// R-type or I-type (stores rt)
+	rs = s.read(REG_OFFSET + ((insn >> 19) & 0x7C))
+	storeAddr = REG_OFFSET + ((insn >> 14) & 0x7C)
+	if opcode == 0 || opcode == 0x1c {
+		// R-type (stores rd)
+		rt = s.read(rtReg)
+		storeAddr = REG_OFFSET + ((insn >> 9) & 0x7C)
+	} else if opcode < 0x20 {
+		// rt is SignExtImm
+		// don't sign extend for andi, ori, xori
+		if opcode == 0xC || opcode == 0xD || opcode == 0xe {
+			// ZeroExtImm
+			rt = insn & 0xFFFF
+		} else {
+			// SignExtImm
+			rt = SE(insn&0xFFFF, 16)
+		}
+	} else if opcode >= 0x28 || opcode == 0x22 || opcode == 0x26 {
+		// store rt value with store
+		rt = s.read(rtReg)
+
+		// store actual rt with lwl and lwr
+		storeAddr = rtReg
+	}
+
+	if (opcode >= 4 && opcode < 8) || opcode == 1 {
+		shouldBranch := false
+
+		if opcode == 4 || opcode == 5 { // beq/bne
+			rt = s.read(rtReg)
+			shouldBranch = (rs == rt && opcode == 4) || (rs != rt && opcode == 5)
+		} else if opcode == 6 { // blez
+			shouldBranch = int32(rs) <= 0
+		} else if opcode == 7 { // bgtz
+			shouldBranch = int32(rs) > 0
+		} else if opcode == 1 {
+			// regimm
+			rtv := (insn >> 16) & 0x1F
+			if rtv == 0 { // bltz
+				shouldBranch = int32(rs) < 0
+			}
+			if rtv == 1 { // bgez
+				shouldBranch = int32(rs) >= 0
+			}
+		}
+
+		if shouldBranch {
+			s.stepPC(nextPC, pc+4+(SE(insn&0xFFFF, 16)<<2))
+			return
+		}
+		// branch not taken
+		s.stepPC(nextPC, nextPC+4)
+		return
+	}
+
+	// memory fetch (all I-type)
+	// we do the load for stores also
+	var mem uint32
+	if opcode >= 0x20 {
+		// M[R[rs]+SignExtImm]
+		rs += SE(insn&0xFFFF, 16)
+		addr := rs & 0xFFFFFFFC
+		mem = s.read(addr)
+		if opcode >= 0x28 && opcode != 0x30 {
+			// store
+			storeAddr = addr
+		}
+	}
+
+	// ALU
+	val := execute(insn, rs, rt, mem)
+
+	if opcode == 0 && fn >= 8 && fn < 0x1c {
+		if fn == 8 || fn == 9 {
+			// jr/jalr
+			s.stepPC(nextPC, rs)
+			if fn == 9 {
+				s.write(REG_LR, pc+8)
+			}
+			return
+		}
+
+		// handle movz and movn when they don't write back
+		if fn == 0xa && rt != 0 { // movz
+			storeAddr = REG_OFFSET
+		}
+		if fn == 0xb && rt == 0 { // movn
+			storeAddr = REG_OFFSET
+		}
+
+		// syscall (can read and write)
+		if fn == 0xC {
+			if s.handleSyscall() {
+				nextPC = HALT_PC
+			}
+		}
+
+		// lo and hi registers
+		// can write back
+		if fn >= 0x10 && fn < 0x1c {
+			if fn == 0x10 { // mfhi
+				val = s.read(REG_HI)
+			} else if fn == 0x11 { // mthi
+				storeAddr = REG_HI
+			} else if fn == 0x12 { // mflo
+				val = s.read(REG_LO)
+			} else if fn == 0x13 { // mtlo
+				storeAddr = REG_LO
+			}
+
+			var hi uint32
+			if fn == 0x18 { // mult
+				acc := uint64(int64(int32(rs)) * int64(int32(rt)))
+				hi = uint32(acc >> 32)
+				val = uint32(acc)
+			} else if fn == 0x19 { // multu
+				acc := uint64(rs) * uint64(rt)
+				hi = uint32(acc >> 32)
+				val = uint32(acc)
+			} else if fn == 0x1a || fn == 0x1b {
+				if rt == 0 {
+					fail(errors.New("division by zero"))
+				}
+				if fn == 0x1a { // div
+					hi = uint32(int32(rs) % int32(rt))
+					val = uint32(int32(rs) / int32(rt))
+				} else { // divu
+					hi = rs % rt
+					val = rs / rt
+				}
+			}
+
+			// lo/hi writeback
+			if fn >= 0x18 && fn < 0x1c {
+				s.write(REG_HI, hi)
+				storeAddr = REG_LO
+			}
+		}
+	}
+
+	// stupid sc, write a 1 to rt
+	if opcode == 0x38 && rtReg != REG_OFFSET {
+		s.write(rtReg, 1)
+	}
+
+	// write back
+	if storeAddr != REG_OFFSET {
+		s.write(storeAddr, val)
+	}
+
+	s.write(REG_PC, nextPC)
+}
+
+func execute(insn uint32, rs uint32, rt uint32, mem uint32) uint32 {
+	opcode := insn >> 26 // 6-bits
+	fn := insn & 0x3f    // 6-bits
+
+	if opcode < 0x20 {
+		// transform ArithLogI
+		if opcode >= 8 && opcode < 0xF {
+			switch opcode {
+			case 8:
+				fn = 0x20 // addi
+			case 9:
+				fn = 0x21 // addiu
+			case 0xa:
+				fn = 0x2a // slti
+			case 0xb:
+				fn = 0x2B // sltiu
+			case 0xc:
+				fn = 0x24 // andi
+			case 0xd:
+				fn = 0x25 // ori
+			case 0xe:
+				fn = 0x26 // xori
+			}
+			opcode = 0
+		}
+
+		// 0 is opcode SPECIAL
+		if opcode == 0 {
+			shamt := (insn >> 6) & 0x1f
+			if fn < 0x20 {
+				if fn >= 0x08 {
+					return rs // jr/jalr/div + others
+				}
+				// Shift and ShiftV
+				switch fn {
+				case 0x00:
+					return rt << shamt // sll
+				case 0x02:
+					return rt >> shamt // srl
+				case 0x03:
+					return SE(rt>>shamt, 32-shamt) // sra
+				case 0x04:
+					return rt << (rs & 0x1F) // sllv
+				case 0x06:
+					return rt >> (rs & 0x1F) // srlv
+				case 0x07:
+					return SE(rt>>rs, 32-rs) // srav
+				}
+			}
+			// 0x10-0x13 = mfhi, mthi, mflo, mtlo
+			// R-type (ArithLog)
+			switch fn {
+			case 0x20, 0x21:
+				return rs + rt // add or addu
+			case 0x22, 0x23:
+				return rs - rt // sub or subu
+			case 0x24:
+				return rs & rt // and
+			case 0x25:
+				return rs | rt // or
+			case 0x26:
+				return rs ^ rt // xor
+			case 0x27:
+				return ^(rs | rt) // nor
+			case 0x2a:
+				if int32(rs) < int32(rt) { // slt
+					return 1
+				}
+				return 0
+			case 0x2B:
+				if rs < rt { // sltu
+					return 1
+				}
+				return 0
+			}
+		} else if opcode == 0xf {
+			return rt << 16 // lui
+		} else if opcode == 0x1c { // SPECIAL2
+			if fn == 2 {
+				return uint32(int32(rs) * int32(rt)) // mul
+			}
+			if fn == 0x20 || fn == 0x21 { // clz, clo
+				if fn == 0x20 {
+					rs = ^rs
+				}
+				i := uint32(0)
+				for rs&0x80000000 != 0 {
+					i++
+					rs <<= 1
+				}
+				return i
+			}
+		}
+	} else if opcode < 0x28 {
+		switch opcode {
+		case 0x20: // lb
+			return SE((mem>>(24-(rs&3)*8))&0xFF, 8)
+		case 0x21: // lh
+			return SE((mem>>(16-(rs&2)*8))&0xFFFF, 16)
+		case 0x22: // lwl
+			val := mem << ((rs & 3) * 8)
+			mask := uint32(0xFFFFFFFF) << ((rs & 3) * 8)
+			return (rt & ^mask) | val
+		case 0x23: // lw
+			return mem
+		case 0x24: // lbu
+			return (mem >> (24 - (rs&3)*8)) & 0xFF
+		case 0x25: // lhu
+			return (mem >> (16 - (rs&2)*8)) & 0xFFFF
+		case 0x26: // lwr
+			val := mem >> (24 - (rs&3)*8)
+			mask := uint32(0xFFFFFFFF) >> (24 - (rs&3)*8)
+			return (rt & ^mask) | val
+		}
+	} else if opcode == 0x28 { // sb
+		val := (rt & 0xFF) << (24 - (rs&3)*8)
+		mask := 0xFFFFFFFF ^ uint32(0xFF<<(24-(rs&3)*8))
+		return (mem & mask) | val
+	} else if opcode == 0x29 { // sh
+		val := (rt & 0xFFFF) << (16 - (rs&2)*8)
+		mask := 0xFFFFFFFF ^ uint32(0xFFFF<<(16-(rs&2)*8))
+		return (mem & mask) | val
+	} else if opcode == 0x2a { // swl
+		val := rt >> ((rs & 3) * 8)
+		mask := uint32(0xFFFFFFFF) >> ((rs & 3) * 8)
+		return (mem & ^mask) | val
+	} else if opcode == 0x2b { // sw
+		return rt
+	} else if opcode == 0x2e { // swr
+		val := rt << (24 - (rs&3)*8)
+		mask := uint32(0xFFFFFFFF) << (24 - (rs&3)*8)
+		return (mem & ^mask) | val
+	} else if opcode == 0x30 { // ll
+		return mem
+	} else if opcode == 0x38 { // sc
+		return rt
+	}
+
+	fail(fmt.Errorf("invalid instruction %08x", insn))
+	return 0
+}
+
+// RamStepMemory steps directly over a ram image. The oracle window isn't in
+// ram, its reads come from the preimage dir Root the way hostPreimage loads
+// them.
+type RamStepMemory struct {
+	Ram  map[uint32](uint32)
+	Root string
+}
+
+func (m *RamStepMemory) ReadWord(addr uint32) (uint32, error) {
+	return m.Ram[addr], nil
+}
+
+func (m *RamStepMemory) WriteWord(addr uint32, value uint32) error {
+	WriteRam(m.Ram, addr, value)
+	return nil
+}
+
+func (m *RamStepMemory) Preimage(hash common.Hash) ([]byte, error) {
+	return ReadPreimage(m.Root, hash)
+}
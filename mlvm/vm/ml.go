@@ -10,45 +10,86 @@ import (
 )
 
 
-func LLAMA(nodeID int) ([]byte, int, error){
+func LLAMAGraph() (*ml.Graph, *ml.Context, error) {
+	return LLAMAGraphWithPrompt("Why Golang is so popular?")
+}
+
+func LLAMAGraphWithPrompt(prompt string) (*ml.Graph, *ml.Context, error) {
 	modelFile := "/path/models/llama-7b-fp32.bin.2"
-	prompt := "Why Golang is so popular?"
 	threadCount := 32
 	ctx, err := llama.LoadModel(modelFile, true)
 	fmt.Println("Load Model Finish")
 	if err != nil {
 		fmt.Println("load model error: ", err)
-		return nil, 0, err
+		return nil, nil, err
 	}
 	embd := ml.Tokenize(ctx.Vocab, prompt, true)
-	graph, mlctx, err := llama.ExpandGraph(ctx, embd, uint32(len(embd)), 0, threadCount)
+	return llama.ExpandGraph(ctx, embd, uint32(len(embd)), 0, threadCount)
+}
+
+func LLAMA(nodeID int) ([]byte, int, error){
+	graph, mlctx, err := LLAMAGraph()
+	if err != nil {
+		return nil, 0, err
+	}
 	ml.GraphComputeByNodes(mlctx, graph, nodeID)
 	envBytes := ml.SaveComputeNodeEnvToBytes(uint32(nodeID), graph.Nodes[nodeID], graph, true)
 	return envBytes, int(graph.NodesCount), nil
 }
 
-func MNIST(nodeID int) ([]byte, int, error) {
+func MNISTGraph() (*ml.Graph, *ml.Context, error) {
+	return MNISTGraphWithInput("../../mlgo/examples/mnist/models/mnist/input_7")
+}
+
+func MNISTGraphWithInput(dataFile string) (*ml.Graph, *ml.Context, error) {
 	threadCount := 1
 	modelFile := "../../mlgo/examples/mnist/models/mnist/ggml-model-small-f32.bin"
 	model, err := mnist.LoadModel(modelFile)
 	if err != nil {
 		fmt.Println("Load model error: ", err)
-		return nil, 0, err
+		return nil, nil, err
 	}
 	// load input
-	input, err := MNIST_Input(false)
+	input, err := MNIST_InputFile(dataFile, false)
 	if err != nil {
 		fmt.Println("Load input data error: ", err)
-		return nil, 0, err
+		return nil, nil, err
 	}
 	graph, ctx := mnist.ExpandGraph(model, threadCount, input)
+	return graph, ctx, nil
+}
+
+// ModelGraph builds the graph LayerRun computes nodes of, without computing
+// it. input is the data file for MNIST and the prompt for LLAMA, empty for
+// the ones LayerRun uses.
+func ModelGraph(modelName string, input string) (*ml.Graph, *ml.Context, error) {
+	if modelName == "MNIST" {
+		if input == "" {
+			return MNISTGraph()
+		}
+		return MNISTGraphWithInput(input)
+	}
+	if input == "" {
+		return LLAMAGraph()
+	}
+	return LLAMAGraphWithPrompt(input)
+}
+
+func MNIST(nodeID int) ([]byte, int, error) {
+	graph, ctx, err := MNISTGraph()
+	if err != nil {
+		return nil, 0, err
+	}
 	ml.GraphComputeByNodes(ctx, graph, nodeID)
 	envBytes := ml.SaveComputeNodeEnvToBytes(uint32(nodeID), graph.Nodes[nodeID], graph, true)
 	return envBytes, int(graph.NodesCount), nil
 }
 
 func MNIST_Input(show bool) ([]float32, error) {
-	dataFile := "../../mlgo/examples/mnist/models/mnist/input_7"
+	return MNIST_InputFile("../../mlgo/examples/mnist/models/mnist/input_7", show)
+}
+
+func MNIST_InputFile(dataFile string, show bool) ([]float32, error) {
 	buf, err := ioutil.ReadFile(dataFile)
 	if err != nil {
 		fmt.Println(err)
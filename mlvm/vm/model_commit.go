@@ -0,0 +1,178 @@
+package vm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// A committed model isn't loaded into memory either. The model region only
+// holds COMMITTED_MODEL, the model's size, the chunk size, the tree depth and
+// the Merkle root of the model's ModelChunkSize byte chunks. The leaves are
+// the hashes of the chunks, padded with zero hashes to 1<<depth, and every
+// node is the keccak of its two children. Chunks and nodes all go into the
+// preimage dir, so the guest gets to chunk i by fetching nodes from the root
+// down with 4020, taking the left or right hash by the bits of i from the top,
+// and then fetching the chunk.
+const COMMITTED_MODEL = 0xfffffffe
+
+// words at MODEL_ADDR for a committed model
+const COMMITTED_MODEL_WORDS = 4 + 8
+
+// CommittedModel has the loaders commit to the model instead of loading it
+var CommittedModel = false
+var ModelChunkSize uint32 = 1 << 20
+
+type ModelCommitment struct {
+	Root      common.Hash   `json:"root"`
+	Size      uint32        `json:"size"`
+	ChunkSize uint32        `json:"chunkSize"`
+	Depth     int           `json:"depth"`
+	Leaves    []common.Hash `json:"leaves"`
+}
+
+// CommitModel splits dat into chunks and builds the tree over them, with the
+// chunks and nodes written to the preimage dir
+func CommitModel(root string, dat []byte, chunkSize uint32) (*ModelCommitment, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		return nil, err
+	}
+	c := &ModelCommitment{Size: uint32(len(dat)), ChunkSize: chunkSize}
+	for i := 0; i == 0 || i < len(dat); i += int(chunkSize) {
+		end := i + int(chunkSize)
+		if end > len(dat) {
+			end = len(dat)
+		}
+		hash, err := WritePreimage(root, dat[i:end])
+		if err != nil {
+			return nil, err
+		}
+		c.Leaves = append(c.Leaves, hash)
+	}
+
+	level := append([]common.Hash{}, c.Leaves...)
+	for len(level) > 1<<c.Depth {
+		c.Depth++
+	}
+	for len(level) < 1<<c.Depth {
+		level = append(level, common.Hash{})
+	}
+	for len(level) > 1 {
+		next := make([]common.Hash, len(level)/2)
+		for i := range next {
+			hash, err := WritePreimage(root, append(level[2*i].Bytes(), level[2*i+1].Bytes()...))
+			if err != nil {
+				return nil, err
+			}
+			next[i] = hash
+		}
+		level = next
+	}
+	c.Root = level[0]
+	return c, nil
+}
+
+// Header is what a committed model leaves at MODEL_ADDR
+func (c *ModelCommitment) Header() []byte {
+	header := make([]byte, COMMITTED_MODEL_WORDS*4)
+	binary.BigEndian.PutUint32(header[0:], COMMITTED_MODEL)
+	binary.BigEndian.PutUint32(header[4:], c.Size)
+	binary.BigEndian.PutUint32(header[8:], c.ChunkSize)
+	binary.BigEndian.PutUint32(header[12:], uint32(c.Depth))
+	copy(header[16:], c.Root.Bytes())
+	return header
+}
+
+func (c *ModelCommitment) Json() []byte {
+	dat, err := json.MarshalIndent(c, "", "  ")
+	check(err)
+	return dat
+}
+
+// ReadModelChunk fetches chunk i under root the way the guest does, checking
+// every node on the way
+func ReadModelChunk(preimages string, root common.Hash, depth int, i uint32) ([]byte, error) {
+	if uint64(i) >= 1<<depth {
+		return nil, fmt.Errorf("chunk %d is past the %d leaves", i, 1<<depth)
+	}
+	hash := root
+	for d := depth - 1; d >= 0; d-- {
+		node, err := ReadPreimage(preimages, hash)
+		if err != nil {
+			return nil, err
+		}
+		if len(node) != 64 {
+			return nil, fmt.Errorf("node %s is %d bytes", hash, len(node))
+		}
+		bit := (i >> uint(d)) & 1
+		hash = common.BytesToHash(node[bit*32 : bit*32+32])
+	}
+	if hash == (common.Hash{}) {
+		return nil, fmt.Errorf("chunk %d is padding", i)
+	}
+	return ReadPreimage(preimages, hash)
+}
+
+// Proof is the sibling hashes from chunk i's leaf up to the root
+func (c *ModelCommitment) Proof(i uint32) []common.Hash {
+	level := append([]common.Hash{}, c.Leaves...)
+	for len(level) < 1<<c.Depth {
+		level = append(level, common.Hash{})
+	}
+	var proof []common.Hash
+	for len(level) > 1 {
+		proof = append(proof, level[i^1])
+		next := make([]common.Hash, len(level)/2)
+		for j := range next {
+			next[j] = crypto.Keccak256Hash(level[2*j].Bytes(), level[2*j+1].Bytes())
+		}
+		level = next
+		i >>= 1
+	}
+	return proof
+}
+
+// VerifyModelChunk checks chunk i against root with its Proof
+func VerifyModelChunk(root common.Hash, i uint32, chunk []byte, proof []common.Hash) bool {
+	hash := crypto.Keccak256Hash(chunk)
+	for _, sibling := range proof {
+		if i&1 == 0 {
+			hash = crypto.Keccak256Hash(hash.Bytes(), sibling.Bytes())
+		} else {
+			hash = crypto.Keccak256Hash(sibling.Bytes(), hash.Bytes())
+		}
+		i >>= 1
+	}
+	return hash == root
+}
+
+// LoadCommittedModel commits to the model in root, the preimage dir of mu's
+// hooks, and only loads the header
+func LoadCommittedModel(mu uc.Unicorn, file string, ram map[uint32](uint32), root string) (*ModelCommitment, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c, err := CommitModel(root, dat, ModelChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("committed model of %d bytes in %d chunks, depth %d root %s\n", c.Size, len(c.Leaves), c.Depth, c.Root)
+	LoadBytesToUnicorn(mu, c.Header(), ram, MODEL_ADDR)
+	return c, nil
+}
+
+// LoadWeights loads the model the way CommittedModel says
+func LoadWeights(mu uc.Unicorn, file string, ram map[uint32](uint32), root string) error {
+	if CommittedModel {
+		_, err := LoadCommittedModel(mu, file, ram, root)
+		return err
+	}
+	LoadModel(mu, file, ram)
+	return nil
+}
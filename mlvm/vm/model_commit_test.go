@@ -0,0 +1,164 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+func TestCommitModel(t *testing.T) {
+	root := t.TempDir()
+	dat := make([]byte, 5*1000+123)
+	for i := range dat {
+		dat[i] = byte(i * 13)
+	}
+
+	c, err := CommitModel(root, dat, 1000)
+	check(err)
+	if len(c.Leaves) != 6 || c.Depth != 3 {
+		t.Fatalf("%d leaves depth %d", len(c.Leaves), c.Depth)
+	}
+	for i := uint32(0); i < uint32(len(c.Leaves)); i++ {
+		chunk, err := ReadModelChunk(root, c.Root, c.Depth, i)
+		check(err)
+		end := int(i+1) * 1000
+		if end > len(dat) {
+			end = len(dat)
+		}
+		if !bytes.Equal(chunk, dat[int(i)*1000:end]) {
+			t.Fatalf("chunk %d doesn't match the model", i)
+		}
+		if !VerifyModelChunk(c.Root, i, chunk, c.Proof(i)) {
+			t.Fatalf("chunk %d doesn't verify", i)
+		}
+	}
+	if _, err := ReadModelChunk(root, c.Root, c.Depth, 6); err == nil {
+		t.Fatal("read a padding chunk")
+	}
+	if VerifyModelChunk(c.Root, 1, dat[:1000], c.Proof(1)) {
+		t.Fatal("chunk 0 verified as chunk 1")
+	}
+
+	// the same model commits to the same root, a different chunk size doesn't
+	again, err := CommitModel(root, dat, 1000)
+	check(err)
+	other, err := CommitModel(root, dat, 2000)
+	check(err)
+	if again.Root != c.Root || other.Root == c.Root {
+		t.Fatalf("roots %s %s %s", c.Root, again.Root, other.Root)
+	}
+
+	one, err := CommitModel(root, dat[:10], 1000)
+	check(err)
+	if one.Depth != 0 || one.Root != one.Leaves[0] {
+		t.Fatalf("single chunk depth %d", one.Depth)
+	}
+
+	header := c.Header()
+	if binary.BigEndian.Uint32(header) != COMMITTED_MODEL || binary.BigEndian.Uint32(header[4:]) != uint32(len(dat)) ||
+		binary.BigEndian.Uint32(header[12:]) != 3 || common.BytesToHash(header[16:]) != c.Root {
+		t.Fatalf("header %x", header)
+	}
+}
+
+// modelChunkProgram walks the committed model's tree from the root to chunk 5
+// through 4020 and copies the chunk to 0x10000
+const modelChunkProgram = `
+	li $s0, 0x33000000
+	li $s3, 5
+	lw $s5, 12($s0)
+	addiu $a0, $s0, 16
+node:
+	jal sethash
+	nop
+	li $v0, 4020
+	syscall
+	li $s1, 0x31000000
+	blez $s5, leaf
+	addiu $s5, $s5, -1
+	# the child by the bit of the chunk index at this depth
+	srlv $t0, $s3, $s5
+	andi $t0, $t0, 1
+	sll $t0, $t0, 5
+	addiu $a0, $s1, 4
+	addu $a0, $a0, $t0
+	li $a1, 0x20000
+	jal copy8
+	nop
+	b node
+	li $a0, 0x20000
+leaf:
+	lw $t6, 0($s1)
+	addiu $t7, $s1, 4
+	li $s4, 0x10000
+copy:
+	lw $t3, 0($t7)
+	sw $t3, 0($s4)
+	addiu $t7, $t7, 4
+	addiu $t6, $t6, -4
+	bgtz $t6, copy
+	addiu $s4, $s4, 4
+` + exitProgram + copyHashProgram
+
+// a guest walks a committed model to a chunk the same under unicorn and StepMIPS
+func TestModelChunkGuest(t *testing.T) {
+	defer func(size uint32) { ModelChunkSize = size }(ModelChunkSize)
+	ModelChunkSize = 16
+	defer func() { CommittedModel = false }()
+	CommittedModel = true
+
+	basedir := t.TempDir()
+	dat := make([]byte, 5*16+7)
+	for i := range dat {
+		dat[i] = byte(i * 13)
+	}
+	fn := filepath.Join(t.TempDir(), "model")
+	check(ioutil.WriteFile(fn, dat, 0644))
+	load := func(mu uc.Unicorn, ram map[uint32](uint32)) {
+		loadAsm(modelChunkProgram)(mu, ram)
+		check(LoadWeights(mu, fn, ram, basedir))
+	}
+
+	initTest()
+	ram := make(map[uint32](uint32))
+	c := GetChunkedUnicorn(basedir, ram)
+	load(c.Mu, ram)
+	if ram[MODEL_ADDR+12] != 3 {
+		t.Fatalf("depth %d", ram[MODEL_ADDR+12])
+	}
+	stepped := copyRam(ram)
+	check(c.RunTo(-1))
+	SyncRegs(c.Mu, ram)
+	if !c.Exited {
+		t.Fatal("program didn't exit")
+	}
+	stepRam(t, stepped, basedir)
+	// the last word of the chunk is zero padded
+	want := append(dat[5*16:], 0)
+	if got := readBytes(ram, 0x10000, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("unicorn read %x", got)
+	}
+	if got := readBytes(stepped, 0x10000, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("StepMIPS read %x", got)
+	}
+
+	initTest()
+	check(DiffStepsWithUnicorn(basedir, load, 0, c.Step))
+}
+
+// an input loaded into the oracle window would be overwritten fetching the model
+func TestModelChunkInput(t *testing.T) {
+	initTest()
+	defer func() { CommittedModel = false }()
+	CommittedModel = true
+	fn := filepath.Join(t.TempDir(), "input")
+	check(ioutil.WriteFile(fn, []byte("input"), 0644))
+	if err := LoadInput(nil, fn, make(map[uint32](uint32)), t.TempDir()); err == nil {
+		t.Fatal("loaded an input into the oracle window with a committed model")
+	}
+}
@@ -0,0 +1,150 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// A paged input isn't loaded into memory. The input region only holds
+// PAGED_INPUT, the input's length and the hash of its first chunk, and the
+// guest pulls the chunks through the 4020 oracle. Every chunk is the preimage
+//
+//	next hash (32 bytes) ++ up to InputChunkSize bytes of the input
+//
+// so the first hash commits to the whole input, and the last chunk links to
+// the zero hash. On chain the oracle window is read from preimages and not
+// from the trie, so the header goes to PAGED_INPUT_ADDR instead of into the
+// input region, and the guest has to copy a next hash out of the window
+// before writing it to ORACLE_HASH_ADDR.
+const PAGED_INPUT = 0xffffffff
+
+// words at PAGED_INPUT_ADDR for a paged input
+const PAGED_INPUT_WORDS = 2 + 8
+
+// PagedInput has the loaders page the input instead of loading it
+var PagedInput = false
+var InputChunkSize uint32 = 1 << 20
+
+// WritePreimage stores dat in the preimage dir under its hash, where the 4020
+// hook looks it up. One that's already there is kept.
+func WritePreimage(root string, dat []byte) (common.Hash, error) {
+	hash := crypto.Keccak256Hash(dat)
+	fn := fmt.Sprintf("%s/%s", root, hash)
+	if fi, err := os.Stat(fn); err == nil && fi.Size() == int64(len(dat)) {
+		return hash, nil
+	}
+	return hash, ioutil.WriteFile(fn, dat, 0644)
+}
+
+// ReadPreimage is the preimage of hash from the preimage dir, checked
+func ReadPreimage(root string, hash common.Hash) ([]byte, error) {
+	dat, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", root, hash))
+	if err != nil {
+		return nil, err
+	}
+	if crypto.Keccak256Hash(dat) != hash {
+		return nil, fmt.Errorf("preimage %s has the wrong hash", hash)
+	}
+	return dat, nil
+}
+
+func checkChunkSize(chunkSize uint32) error {
+	// a chunk and its length have to fit the oracle window
+	if chunkSize == 0 || uint64(chunkSize)+32+4 > uint64(ORACLE_END-ORACLE_ADDR) {
+		return fmt.Errorf("chunk size %d doesn't fit the oracle window %x-%x", chunkSize, ORACLE_ADDR, ORACLE_END)
+	}
+	return nil
+}
+
+// ChunkInput splits dat into hash-linked chunks in the preimage dir and
+// returns the hash of the first one. Even an empty input is one chunk.
+func ChunkInput(root string, dat []byte, chunkSize uint32) (common.Hash, int, error) {
+	if err := checkChunkSize(chunkSize); err != nil {
+		return common.Hash{}, 0, err
+	}
+	count := (len(dat) + int(chunkSize) - 1) / int(chunkSize)
+	if count == 0 {
+		count = 1
+	}
+	// from the back, each chunk needs the hash of the next
+	var next common.Hash
+	for i := count - 1; i >= 0; i-- {
+		end := (i + 1) * int(chunkSize)
+		if end > len(dat) {
+			end = len(dat)
+		}
+		chunk := append(next.Bytes(), dat[i*int(chunkSize):end]...)
+		hash, err := WritePreimage(root, chunk)
+		if err != nil {
+			return common.Hash{}, 0, err
+		}
+		next = hash
+	}
+	return next, count, nil
+}
+
+// ReadChunkedInput follows the chunks from head, the way the guest does
+func ReadChunkedInput(root string, head common.Hash) ([]byte, error) {
+	var dat []byte
+	for hash := head; hash != (common.Hash{}); {
+		chunk, err := ReadPreimage(root, hash)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) < 32 {
+			return nil, fmt.Errorf("chunk %s has no next hash", hash)
+		}
+		hash = common.BytesToHash(chunk[:32])
+		dat = append(dat, chunk[32:]...)
+	}
+	return dat, nil
+}
+
+// PagedInputHeader is what a paged input leaves at PAGED_INPUT_ADDR
+func PagedInputHeader(size int, head common.Hash) []byte {
+	header := make([]byte, PAGED_INPUT_WORDS*4)
+	binary.BigEndian.PutUint32(header[0:], PAGED_INPUT)
+	binary.BigEndian.PutUint32(header[4:], uint32(size))
+	copy(header[8:], head.Bytes())
+	return header
+}
+
+// LoadPagedInput chunks the input into root, the preimage dir of mu's hooks,
+// and only loads the header
+func LoadPagedInput(mu uc.Unicorn, file string, ram map[uint32](uint32), root string) error {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if uint64(len(buf)) >= PAGED_INPUT {
+		return errors.New("data too large")
+	}
+	head, count, err := ChunkInput(root, buf, InputChunkSize)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("paged input of %d bytes into %d chunks, first %s\n", len(buf), count, head)
+	LoadBytesToUnicorn(mu, PagedInputHeader(len(buf), head), ram, PAGED_INPUT_ADDR)
+	return nil
+}
+
+// LoadInput loads the input the way PagedInput says. An input in the oracle
+// window doesn't go with a committed model, the guest's first 4020 for a
+// node would overwrite it.
+func LoadInput(mu uc.Unicorn, file string, ram map[uint32](uint32), root string) error {
+	if PagedInput {
+		return LoadPagedInput(mu, file, ram, root)
+	}
+	if CommittedModel && GuestLayout.Input.Overlaps(GuestLayout.Oracle) {
+		return fmt.Errorf("the input at %x is in the oracle window the committed model is fetched through, page it or move the input region out of it", INPUT_ADDR)
+	}
+	return LoadInputData(mu, file, ram)
+}
@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+func TestChunkInput(t *testing.T) {
+	root := t.TempDir()
+	dat := make([]byte, 2500)
+	for i := range dat {
+		dat[i] = byte(i * 7)
+	}
+
+	head, count, err := ChunkInput(root, dat, 1000)
+	check(err)
+	if count != 3 {
+		t.Fatalf("%d chunks", count)
+	}
+	back, err := ReadChunkedInput(root, head)
+	check(err)
+	if !bytes.Equal(back, dat) {
+		t.Fatal("chunks don't read back as the input")
+	}
+
+	// the last chunk links to the zero hash and holds the rest
+	last := append(make([]byte, 32), dat[2000:]...)
+	if _, err := ReadPreimage(root, crypto.Keccak256Hash(last)); err != nil {
+		t.Fatal(err)
+	}
+
+	head, count, err = ChunkInput(root, nil, 1000)
+	check(err)
+	if count != 1 || head != crypto.Keccak256Hash(make([]byte, 32)) {
+		t.Fatalf("empty input %d chunks %s", count, head)
+	}
+
+	if _, _, err := ChunkInput(root, dat, ORACLE_END-ORACLE_ADDR); err == nil {
+		t.Fatal("a chunk bigger than the oracle window")
+	}
+}
+
+// the first chunk reads back through the oracle window the way StepMIPS reads it
+func TestPagedInputPreimage(t *testing.T) {
+	initTest()
+	root := t.TempDir()
+	dat := []byte("some input that is paged in")
+	head, _, err := ChunkInput(root, dat, 8)
+	check(err)
+	header := PagedInputHeader(len(dat), head)
+	if binary.BigEndian.Uint32(header) != PAGED_INPUT || binary.BigEndian.Uint32(header[4:]) != uint32(len(dat)) {
+		t.Fatalf("header %x", header)
+	}
+
+	// the guest copies the hash out of the header and reads the window
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	LoadData(header[8:], ram, ORACLE_HASH_ADDR)
+	ram[REG_PC] = 0x1000
+	ram[0x1000] = 0x8d090000 // lw $t1, 0($t0)
+	ram[REG_OFFSET+8*4] = ORACLE_ADDR + 4
+	m := &RamStepMemory{Ram: ram, Root: root}
+	if _, err := StepMIPS(m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.Preimage(head)
+	check(err)
+	if common.BytesToHash(got[:32]) == (common.Hash{}) || !bytes.Equal(got[32:], dat[:8]) {
+		t.Fatalf("first chunk %x", got)
+	}
+	if ram[REG_OFFSET+9*4] != binary.BigEndian.Uint32(got) {
+		t.Fatalf("read %x from the window", ram[REG_OFFSET+9*4])
+	}
+}
+
+// pagedInputProgram copies a paged input to 0x10000, following the chunks
+// from the header at 0x30002000 through 4020
+const pagedInputProgram = `
+	li $s0, 0x30002000
+	addiu $a0, $s0, 8
+	li $s4, 0x10000
+chunk:
+	jal sethash
+	nop
+	li $v0, 4020
+	syscall
+	li $s1, 0x31000000
+	lw $t6, 0($s1)
+	addiu $t6, $t6, -32
+	blez $t6, next
+	addiu $t7, $s1, 36
+data:
+	lw $t3, 0($t7)
+	sw $t3, 0($s4)
+	addiu $t7, $t7, 4
+	addiu $t6, $t6, -4
+	bgtz $t6, data
+	addiu $s4, $s4, 4
+next:
+	# the next hash has to be out of the window before it's set
+	addiu $a0, $s1, 4
+	li $a1, 0x20000
+	jal copy8
+	nop
+	li $a0, 0x20000
+	move $t1, $a0
+	li $t2, 8
+	move $s2, $zero
+zero:
+	lw $t3, 0($t1)
+	or $s2, $s2, $t3
+	addiu $t2, $t2, -1
+	bne $t2, $zero, zero
+	addiu $t1, $t1, 4
+	bne $s2, $zero, chunk
+	nop
+` + exitProgram + copyHashProgram
+
+// a guest reads a paged input through 4020 the same under unicorn and StepMIPS
+func TestPagedInputGuest(t *testing.T) {
+	defer func(size uint32) { InputChunkSize = size }(InputChunkSize)
+	InputChunkSize = 8
+
+	basedir := t.TempDir()
+	dat := []byte("an input the guest pages in 8 bytes at a time")
+	fn := filepath.Join(t.TempDir(), "input")
+	check(ioutil.WriteFile(fn, dat, 0644))
+	load := func(mu uc.Unicorn, ram map[uint32](uint32)) {
+		loadAsm(pagedInputProgram)(mu, ram)
+		check(LoadPagedInput(mu, fn, ram, basedir))
+	}
+
+	initTest()
+	ram := make(map[uint32](uint32))
+	c := GetChunkedUnicorn(basedir, ram)
+	load(c.Mu, ram)
+	stepped := copyRam(ram)
+	check(c.RunTo(-1))
+	SyncRegs(c.Mu, ram)
+	if !c.Exited {
+		t.Fatal("program didn't exit")
+	}
+	stepRam(t, stepped, basedir)
+	if got := readBytes(ram, 0x10000, len(dat)); !bytes.Equal(got, dat) {
+		t.Fatalf("unicorn read %q", got)
+	}
+	if got := readBytes(stepped, 0x10000, len(dat)); !bytes.Equal(got, dat) {
+		t.Fatalf("StepMIPS read %q", got)
+	}
+
+	initTest()
+	check(DiffStepsWithUnicorn(basedir, load, 0, c.Step))
+}
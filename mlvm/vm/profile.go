@@ -0,0 +1,271 @@
+package vm
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// ProfileFile turns on the step profiler for MIPSRun and MIPSRunCompatible,
+// sampling every ProfilePeriod steps
+var ProfileFile string
+var ProfilePeriod = 1
+
+// deepest call stack kept, anything older is dropped
+const PROFILE_MAX_DEPTH = 64
+
+// how far down the stack a return may land, for returns that skip frames
+const PROFILE_MAX_UNWIND = 8
+
+type profileSample struct {
+	stack []uint32
+	count int64
+}
+
+// Profiler counts steps by pc. It follows calls (jal, jalr, bal) with a
+// shadow stack and pops a frame on arriving at its return address, so the
+// profile also has the callers. Goroutine switches in the guest aren't
+// seen, the stacks are only as good as the calls and returns line up.
+type Profiler struct {
+	Period  int
+	Steps   int64
+	stack   []uint32
+	samples map[string]*profileSample
+	// the return address of a call, pushed once its delay slot has run
+	call uint32
+}
+
+func NewProfiler(period int) *Profiler {
+	if period < 1 {
+		period = 1
+	}
+	return &Profiler{Period: period, samples: make(map[string]*profileSample)}
+}
+
+// Hook profiles every step mu runs from now on
+func (p *Profiler) Hook(mu uc.Unicorn) {
+	mu.HookAdd(uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
+		// the nop sled of the chunked runner isn't part of the program
+		if addr > HALT_PC && addr <= SLED_END {
+			return
+		}
+		insn, _ := mu.MemRead(addr, 4)
+		p.Record(uint32(addr), binary.BigEndian.Uint32(insn))
+	}, 0, 0x80000000)
+}
+
+func isCall(insn uint32) bool {
+	opcode := insn >> 26
+	return opcode == 3 || (opcode == 0 && insn&0x3f == 9) || (opcode == 1 && (insn>>16)&0x1e == 0x10)
+}
+
+// Record counts a step at pc
+func (p *Profiler) Record(pc uint32, insn uint32) {
+	for i := len(p.stack) - 1; i >= 0 && i >= len(p.stack)-PROFILE_MAX_UNWIND; i-- {
+		if p.stack[i] == pc {
+			p.stack = p.stack[:i]
+			break
+		}
+	}
+
+	if p.Steps%int64(p.Period) == 0 {
+		// leaf first, then the call sites
+		stack := make([]uint32, 0, len(p.stack)+1)
+		stack = append(stack, pc)
+		for i := len(p.stack) - 1; i >= 0; i-- {
+			stack = append(stack, p.stack[i]-8)
+		}
+		key := make([]byte, 4*len(stack))
+		for i, addr := range stack {
+			binary.BigEndian.PutUint32(key[4*i:], addr)
+		}
+		s, ok := p.samples[string(key)]
+		if !ok {
+			s = &profileSample{stack: stack}
+			p.samples[string(key)] = s
+		}
+		s.count++
+	}
+	p.Steps++
+
+	if p.call != 0 {
+		if len(p.stack) == PROFILE_MAX_DEPTH {
+			p.stack = p.stack[1:]
+		}
+		p.stack = append(p.stack, p.call)
+		p.call = 0
+	} else if isCall(insn) {
+		p.call = pc + 8
+	}
+}
+
+// Flat is the number of sampled steps at each pc
+func (p *Profiler) Flat() map[uint32]int64 {
+	flat := make(map[uint32]int64)
+	for _, s := range p.samples {
+		flat[s.stack[0]] += s.count * int64(p.Period)
+	}
+	return flat
+}
+
+// a protobuf writer, just enough of one for profile.proto
+type protoBuf []byte
+
+func (b *protoBuf) varint(x uint64) {
+	*b = binary.AppendUvarint(*b, x)
+}
+
+func (b *protoBuf) uint(field int, x uint64) {
+	if x != 0 {
+		b.varint(uint64(field)<<3 | 0)
+		b.varint(x)
+	}
+}
+
+func (b *protoBuf) bytes(field int, dat []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(dat)))
+	*b = append(*b, dat...)
+}
+
+func (b *protoBuf) packed(field int, xs []uint64) {
+	var inner protoBuf
+	for _, x := range xs {
+		inner.varint(x)
+	}
+	b.bytes(field, inner)
+}
+
+// WriteProfile writes a gzipped pprof profile with one "steps" value. The
+// functions come from LoadedProgram's symbols, pcs without one are left as
+// bare addresses.
+func (p *Profiler) WriteProfile(w io.Writer, program string) error {
+	strs := []string{""}
+	strIndex := map[string]uint64{"": 0}
+	str := func(s string) uint64 {
+		if i, ok := strIndex[s]; ok {
+			return i
+		}
+		strIndex[s] = uint64(len(strs))
+		strs = append(strs, s)
+		return strIndex[s]
+	}
+
+	var prof protoBuf
+	valueType := func(field int) {
+		var vt protoBuf
+		vt.uint(1, str("steps"))
+		vt.uint(2, str("count"))
+		prof.bytes(field, vt)
+	}
+	valueType(1)
+
+	// sorted, so the same run always gives the same file
+	var samples []*profileSample
+	for _, s := range p.samples {
+		samples = append(samples, s)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].stack, samples[j].stack
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	locations := make(map[uint32]uint64)
+	var locationPCs []uint32
+	for _, s := range samples {
+		var ids []uint64
+		for _, pc := range s.stack {
+			id, ok := locations[pc]
+			if !ok {
+				id = uint64(len(locations) + 1)
+				locations[pc] = id
+				locationPCs = append(locationPCs, pc)
+			}
+			ids = append(ids, id)
+		}
+		var sample protoBuf
+		sample.packed(1, ids)
+		sample.packed(2, []uint64{uint64(s.count * int64(p.Period))})
+		prof.bytes(2, sample)
+	}
+
+	var mapping protoBuf
+	mapping.uint(1, 1)
+	mapping.uint(3, uint64(HEAP_START))
+	mapping.uint(5, str(program))
+	mapping.uint(7, 1)
+	prof.bytes(3, mapping)
+
+	functions := make(map[string]uint64)
+	var functionNames []string
+	for _, pc := range locationPCs {
+		var loc protoBuf
+		loc.uint(1, locations[pc])
+		loc.uint(2, 1)
+		loc.uint(3, uint64(pc))
+		if LoadedProgram != nil {
+			if sym, ok := LoadedProgram.Symbolize(pc); ok {
+				id, ok := functions[sym.Name]
+				if !ok {
+					id = uint64(len(functions) + 1)
+					functions[sym.Name] = id
+					functionNames = append(functionNames, sym.Name)
+				}
+				var line protoBuf
+				line.uint(1, id)
+				loc.bytes(4, line)
+			}
+		}
+		prof.bytes(4, loc)
+	}
+	for i, name := range functionNames {
+		var fn protoBuf
+		fn.uint(1, uint64(i+1))
+		fn.uint(2, str(name))
+		fn.uint(3, str(name))
+		prof.bytes(5, fn)
+	}
+
+	valueType(11)
+	prof.uint(12, uint64(p.Period))
+	for _, s := range strs {
+		prof.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(prof); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// startProfile hooks a profiler into mu if ProfileFile is set
+func startProfile(mu uc.Unicorn) *Profiler {
+	if ProfileFile == "" {
+		return nil
+	}
+	p := NewProfiler(ProfilePeriod)
+	p.Hook(mu)
+	return p
+}
+
+func stopProfile(p *Profiler, program string) {
+	if p == nil {
+		return
+	}
+	f, err := os.Create(ProfileFile)
+	check(err)
+	check(p.WriteProfile(f, program))
+	check(f.Close())
+	fmt.Printf("wrote profile of %d steps to %s\n", p.Steps, ProfileFile)
+}
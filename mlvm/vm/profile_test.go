@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"mlvm/asm"
+)
+
+const callProgram = `
+	li $s0, 0x10000
+	li $s1, 3
+again:
+	jal store
+	addiu $s1, $s1, -1
+	bne $s1, $zero, again
+	nop
+` + exitProgram + `
+store:
+	li $t0, 42
+	jr $ra
+	sw $t0, 0($s0)
+`
+
+func TestProfiler(t *testing.T) {
+	initTest()
+	words, labels, err := asm.AssembleWords(0, callProgram)
+	check(err)
+	LoadedProgram = &Program{Symbols: []Symbol{
+		{"main.main", 0, labels["store"]},
+		{"main.store", labels["store"], 12},
+	}}
+	defer func() { LoadedProgram = nil }()
+
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	for i, w := range words {
+		ram[uint32(4*i)] = w
+	}
+	p := NewProfiler(1)
+	for ram[REG_PC] != HALT_PC {
+		pc := ram[REG_PC]
+		p.Record(pc, ram[pc])
+		_, err := StepMIPS(&RamStepMemory{Ram: ram})
+		check(err)
+		// StepMIPS runs the delay slot with the branch, unicorn counts it apart
+		if DecodeInsn(ram[pc]).HasDelaySlot() {
+			p.Record(pc+4, ram[pc+4])
+		}
+	}
+
+	flat := p.Flat()
+	if flat[labels["store"]] != 3 || flat[labels["again"]] != 3 {
+		t.Fatalf("flat profile %v", flat)
+	}
+	var total int64
+	for _, n := range flat {
+		total += n
+	}
+	if total != p.Steps {
+		t.Fatalf("%d steps in the profile, %d recorded", total, p.Steps)
+	}
+	// every step in store is under the call, and the return pops it again
+	for _, s := range p.samples {
+		inStore := s.stack[0] >= labels["store"] && s.stack[0] < labels["store"]+12
+		if inStore != (len(s.stack) == 2) || (inStore && s.stack[1] != labels["again"]) {
+			t.Fatalf("stack %x", s.stack)
+		}
+	}
+
+	var b bytes.Buffer
+	check(p.WriteProfile(&b, "call.bin"))
+	gz, err := gzip.NewReader(&b)
+	check(err)
+	dat, err := ioutil.ReadAll(gz)
+	check(err)
+	for _, want := range []string{"main.store", "main.main", "steps", "call.bin"} {
+		if !strings.Contains(string(dat), want) {
+			t.Fatalf("profile is missing %q", want)
+		}
+	}
+}
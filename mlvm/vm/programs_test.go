@@ -0,0 +1,312 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/oracle"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+
+	"mlvm/asm"
+)
+
+// small hand written programs, so the runner can be tested without the mlgo
+// binaries
+
+func loadAsm(src string) func(mu uc.Unicorn, ram map[uint32](uint32)) {
+	dat := asm.MustAssemble(0, src)
+	return func(mu uc.Unicorn, ram map[uint32](uint32)) {
+		ZeroRegisters(ram)
+		LoadBytesToUnicorn(mu, dat, ram, 0)
+		SyncRegs(mu, ram)
+	}
+}
+
+// runAsm runs a program to the end, and returns the final ram
+func runAsm(t *testing.T, basedir string, src string) *ChunkedUnicorn {
+	initTest()
+	ram := make(map[uint32](uint32))
+	c := GetChunkedUnicorn(basedir, ram)
+	loadAsm(src)(c.Mu, ram)
+	check(c.RunTo(-1))
+	SyncRegs(c.Mu, ram)
+	if !c.Exited {
+		t.Fatal("program didn't exit")
+	}
+	return c
+}
+
+// stepAsm runs a program to the end with StepMIPS instead
+func stepAsm(t *testing.T, src string) map[uint32](uint32) {
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	LoadData(asm.MustAssemble(0, src), ram, 0)
+	stepRam(t, ram, "")
+	return ram
+}
+
+// stepRam steps ram to the end with StepMIPS, with the oracle reading the
+// preimages in root
+func stepRam(t *testing.T, ram map[uint32](uint32), root string) {
+	for i := 0; ram[REG_PC] != HALT_PC; i++ {
+		if i == 100000 {
+			t.Fatal("program didn't exit")
+		}
+		if _, err := StepMIPS(&RamStepMemory{Ram: ram, Root: root}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// copyHashProgram is the subroutines a guest needs for 4020: sethash puts the
+// hash at $a0 at ORACLE_HASH_ADDR, and copy8 copies the 8 words at $a0 to $a1,
+// which is how a hash read from the oracle window gets out of it before it's
+// set
+const copyHashProgram = `
+sethash:
+	li $a1, 0x30001000
+copy8:
+	li $t9, 8
+copy8loop:
+	lw $t8, 0($a0)
+	sw $t8, 0($a1)
+	addiu $a0, $a0, 4
+	addiu $t9, $t9, -1
+	bne $t9, $zero, copy8loop
+	addiu $a1, $a1, 4
+	jr $ra
+	nop
+`
+
+// readBytes is n bytes of ram from addr
+func readBytes(ram map[uint32](uint32), addr uint32, n int) []byte {
+	dat := make([]byte, n)
+	for i := range dat {
+		a := addr + uint32(i)
+		dat[i] = byte(ram[a&^3] >> (24 - 8*(a&3)))
+	}
+	return dat
+}
+
+const exitProgram = `
+	li $v0, 4246
+	syscall
+`
+
+const storesProgram = `
+	li $s0, 0x10000
+	li $t0, 0x11223344
+	sw $t0, 0($s0)
+	sb $t0, 5($s0)
+	sh $t0, 10($s0)
+	swl $t0, 13($s0)
+	swr $t0, 18($s0)
+	sb $t0, 23($s0)
+	sh $t0, 24($s0)
+	lb $s1, 5($s0)
+	lhu $s2, 10($s0)
+	lw $s3, 12($s0)
+	lwl $s4, 17($s0)
+	lwr $s4, 20($s0)
+` + exitProgram
+
+func TestAsmStores(t *testing.T) {
+	want := map[uint32]uint32{
+		0x10000:           0x11223344,
+		0x10004:           0x00440000,
+		0x10008:           0x00003344,
+		0x1000c:           0x00112233,
+		0x10010:           0x22334400,
+		0x10014:           0x00000044,
+		0x10018:           0x33440000,
+		REG_OFFSET + 17*4: 0x44,
+		REG_OFFSET + 18*4: 0x3344,
+		REG_OFFSET + 19*4: 0x00112233,
+		REG_OFFSET + 20*4: 0x33440000,
+	}
+
+	c := runAsm(t, "", storesProgram)
+	stepped := stepAsm(t, storesProgram)
+	for addr, value := range want {
+		if c.Ram[addr] != value {
+			t.Fatalf("unicorn has %x at %x, want %x", c.Ram[addr], addr, value)
+		}
+		if stepped[addr] != value {
+			t.Fatalf("StepMIPS has %x at %x, want %x", stepped[addr], addr, value)
+		}
+	}
+	if RamToTrie(c.Ram) != RamToTrie(stepped) {
+		t.Fatal("unicorn and StepMIPS end on different roots")
+	}
+
+	initTest()
+	check(DiffStepsWithUnicorn("", loadAsm(storesProgram), 0, 100))
+}
+
+// brk to BRK_START leaves the break at 0, but on chain it's a leaf from then on
+const brkStartProgram = `
+	li $a0, 0x40000000
+	li $v0, 4045
+	syscall
+	li $a0, 0
+	li $v0, 4045
+	syscall
+` + exitProgram
+
+func TestAsmBrkStart(t *testing.T) {
+	c := runAsm(t, "", brkStartProgram)
+	if _, ok := c.Ram[REG_BRK]; !ok {
+		t.Fatal("brk to BRK_START left no break in ram")
+	}
+	stepped := stepAsm(t, brkStartProgram)
+	if v, ok := stepped[REG_BRK]; !ok || v != 0 {
+		t.Fatalf("StepMIPS break %x %v", v, ok)
+	}
+	initTest()
+	check(DiffStepsWithUnicorn("", loadAsm(brkStartProgram), 0, 100))
+}
+
+func TestAsmSyscalls(t *testing.T) {
+	basedir := t.TempDir()
+	oracle.SetRoot(basedir)
+	preimage := []byte("hello oracle!")
+	hash := crypto.Keccak256Hash(preimage)
+	check(ioutil.WriteFile(fmt.Sprintf("%s/%s", basedir, hash), preimage, 0644))
+
+	src := `
+	li $v0, 4090        # mmap
+	li $a1, 0x1000
+	syscall
+	move $s0, $v0
+	li $v0, 4090
+	syscall
+	move $s1, $v0
+	li $v0, 4045        # brk
+	syscall
+	move $s2, $v0
+
+	la $t0, hash        # point the oracle at the preimage
+	li $t1, 0x30001000
+	li $t2, 8
+copy:
+	lw $t3, 0($t0)
+	sw $t3, 0($t1)
+	addiu $t0, $t0, 4
+	addiu $t2, $t2, -1
+	bne $t2, $zero, copy
+	addiu $t1, $t1, 4
+	li $v0, 4020
+	syscall
+	li $t0, 0x31000000
+	lw $s3, 0($t0)
+	lw $s4, 4($t0)
+
+	li $v0, 4004        # write it out
+	li $a0, 1
+	addiu $a1, $t0, 4
+	move $a2, $s3
+	syscall
+` + exitProgram + `
+hash:
+`
+	for i := 0; i < 32; i += 4 {
+		src += fmt.Sprintf("\t.word 0x%x\n", hash[i:i+4])
+	}
+
+	c := runAsm(t, basedir, src)
+	for reg, value := range map[uint32]uint32{
+		16: 0x20000000,
+		17: 0x20001000,
+		18: 0x40000000,
+		19: uint32(len(preimage)),
+		20: 0x68656c6c,
+	} {
+		if got := c.Ram[REG_OFFSET+reg*4]; got != value {
+			t.Fatalf("$%s is %x, want %x", asm.RegName(reg), got, value)
+		}
+	}
+	if c.Ram[REG_HEAP] != 0x2000 {
+		t.Fatalf("heap is %x", c.Ram[REG_HEAP])
+	}
+	if c.Ram[REG_PC] != HALT_PC+4 {
+		t.Fatalf("exited at %x", c.Ram[REG_PC])
+	}
+}
+
+const loopProgram = `
+	li $v0, 7
+	li $t0, 1000
+loop:
+	addiu $t0, $t0, -1
+	bne $t0, $zero, loop
+	nop
+	li $t1, 0x30000804
+	sw $v0, 0($t1)
+` + exitProgram
+
+func TestAsmCheckpoints(t *testing.T) {
+	initTest()
+	want := make(map[int]common.Hash)
+	ram := make(map[uint32](uint32))
+	mu := GetHookedUnicorn("", ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
+		if step%500 == 0 {
+			SyncRegs(mu, ram)
+			want[step] = RamToTrie(ram)
+		}
+	})
+	loadAsm(loopProgram)(mu, ram)
+	check(mu.Start(0, 0x5ead0004))
+
+	initTest()
+	ram = make(map[uint32](uint32))
+	c := GetChunkedUnicorn("", ram)
+	loadAsm(loopProgram)(c.Mu, ram)
+	basedir := t.TempDir()
+	var got []int
+	runChunked(c, -1, -1, 500, func(step int) {
+		got = append(got, step)
+		WriteCheckpoint(ram, fmt.Sprintf("%s/checkpoint_%d.json", basedir, step), step)
+	})
+
+	// 2 + 3*1000 + 5 steps, and the nop at HALT_PC
+	if c.Step != 3008 {
+		t.Fatalf("exited after %d steps", c.Step)
+	}
+	if len(got) != 6 {
+		t.Fatalf("checkpoints at %v", got)
+	}
+	for _, step := range got {
+		dat, err := ioutil.ReadFile(fmt.Sprintf("%s/checkpoint_%d.json", basedir, step))
+		check(err)
+		j, err := TrieFromJson(dat)
+		check(err)
+		if j.Step != step || j.Root != want[step] {
+			t.Fatalf("checkpoint %d has step %d root %s", step, j.Step, j.Root)
+		}
+	}
+}
+
+func TestAsmFaults(t *testing.T) {
+	run := func(regfault int) uint32 {
+		initTest()
+		ram := make(map[uint32](uint32))
+		c := GetChunkedUnicorn("", ram)
+		loadAsm(loopProgram)(c.Mu, ram)
+		runChunked(c, -1, regfault, 0, nil)
+		return ram[0x30000804]
+	}
+
+	if out := run(-1); out != 7 {
+		t.Fatalf("output %x", out)
+	}
+	if out := run(100); out != 0xbabababa {
+		t.Fatalf("output with regfault %x", out)
+	}
+	t.Setenv("OUTPUTFAULT", "1")
+	if out := run(-1); out != 0xbabababa {
+		t.Fatalf("output with OUTPUTFAULT %x", out)
+	}
+}
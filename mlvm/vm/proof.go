@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// TrieProof holds the trie nodes needed to read some words from Root. Nodes
+// are in the order MIPSMemory walks them and can be passed as is to
+// callWithTrieNodes or one by one to AddTrieNode.
+type TrieProof struct {
+	Root   common.Hash       `json:"root"`
+	Values map[string]string `json:"values"`
+	Nodes  []hexutil.Bytes   `json:"nodes"`
+}
+
+// RegisterAddrs are the words SyncRegs writes: the 32 GPRs, PC, HI, LO, heap
+// and brk
+func RegisterAddrs() []uint32 {
+	var addrs []uint32
+	for addr := REG_OFFSET; addr <= REG_BRK; addr += 4 {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// ProveAddresses collects the nodes from Preimages proving the words at addrs
+// under root, each node at most once. Words missing from the trie read as
+// zero, and their proof is the path up to where the key diverges.
+func ProveAddresses(root common.Hash, addrs []uint32) (*TrieProof, error) {
+	proof := &TrieProof{Root: root, Values: make(map[string]string)}
+	seen := make(map[common.Hash]bool)
+	for _, addr := range addrs {
+		if addr&3 != 0 {
+			return nil, fmt.Errorf("address %x isn't 32-bit aligned", addr)
+		}
+		value, _, err := TrieGet(root, addr, func(hash common.Hash) ([]byte, error) {
+			node, ok := Preimages[hash]
+			if !ok {
+				return nil, &MissingNodeError{hash}
+			}
+			if !seen[hash] {
+				seen[hash] = true
+				proof.Nodes = append(proof.Nodes, node)
+			}
+			return node, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		proof.Values[fmt.Sprintf("0x%08x", addr)] = fmt.Sprintf("0x%08x", value)
+	}
+	return proof, nil
+}
+
+// ProveCheckpoint is ProveAddresses against the root of a checkpoint file
+func ProveCheckpoint(fn string, addrs []uint32) (*TrieProof, error) {
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	j, err := TrieFromJson(dat)
+	if err != nil {
+		return nil, err
+	}
+	return ProveAddresses(j.Root, addrs)
+}
+
+func (p *TrieProof) Json() []byte {
+	b, err := json.MarshalIndent(p, "", "  ")
+	check(err)
+	return b
+}
@@ -0,0 +1,78 @@
+package vm
+
+import (
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// exit_group jumps to HALT_PC, which is also where MIPS.sol stops stepping
+const HALT_PC = 0x5ead0000
+
+// Largest number of instructions handed to unicorn in one go. Everything from
+// HALT_PC up to HALT_PC+4*CHUNK_MAX is kept as a nop sled, so after exit_group
+// the rest of a chunk is spent sliding down it and the final pc tells how many
+// steps were left over.
+const CHUNK_MAX = 1 << 20
+
+const SLED_END = HALT_PC + 4*CHUNK_MAX
+
+// ChunkedUnicorn runs the guest using unicorn's instruction count limit instead
+// of a HOOK_CODE callback, so nothing is done in Go between step boundaries.
+type ChunkedUnicorn struct {
+	Mu  uc.Unicorn
+	Ram map[uint32](uint32)
+
+	// Step is the number of instructions executed so far. Once Exited is set it
+	// equals the lastStep reported by the per instruction callback path, which
+	// also counts the nop executed at HALT_PC.
+	Step   int
+	Exited bool
+}
+
+func GetChunkedUnicorn(root string, ram map[uint32](uint32)) *ChunkedUnicorn {
+	mu := GetHookedUnicorn(root, ram, nil)
+	HookRamWrites(mu, ram)
+	// the sled is only ever fetched from, it never makes it into ram
+	check(mu.MemWrite(HALT_PC, make([]byte, SLED_END-HALT_PC)))
+	return &ChunkedUnicorn{Mu: mu, Ram: ram}
+}
+
+// RunTo executes until Step reaches target or the program exits. A negative
+// target runs to the end. A syscall that faults, see syscallFault, comes back
+// as its *SyscallError or *MemoryError with the step of the syscall, and the
+// machine can't be run on after it.
+func (c *ChunkedUnicorn) RunTo(target int) error {
+	for !c.Exited && (target < 0 || c.Step < target) {
+		n := CHUNK_MAX
+		if target >= 0 && target-c.Step < n {
+			n = target - c.Step
+		}
+		pc, _ := c.Mu.RegRead(uc.MIPS_REG_PC)
+		inChunk = true
+		err := c.Mu.StartWithOptions(pc, SLED_END, &uc.UcOptions{Count: uint64(n)})
+		inChunk = false
+		if err != nil {
+			return err
+		}
+		pc, _ = c.Mu.RegRead(uc.MIPS_REG_PC)
+		if chunkFault != nil {
+			// the syscall was sent to HALT_PC like exit_group, so it was the
+			// last instruction before the sled
+			err := chunkFault
+			chunkFault = nil
+			setFaultStep(err, c.Step+n-int(pc-HALT_PC)/4-1)
+			return err
+		}
+		if pc > HALT_PC && pc <= SLED_END {
+			// exited inside this chunk, don't count the sled except for the
+			// first nop, and stop where Start(0, 0x5ead0004) would have.
+			// pc == HALT_PC is still a valid step, the callback path saw it too
+			c.Step += n - int(pc-HALT_PC)/4 + 1
+			c.Exited = true
+			c.Mu.RegWrite(uc.MIPS_REG_PC, HALT_PC+4)
+		} else {
+			c.Step += n
+		}
+		steps = c.Step
+	}
+	return nil
+}
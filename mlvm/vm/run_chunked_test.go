@@ -0,0 +1,195 @@
+package vm
+
+import (
+	"fmt"
+	"testing"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+
+	"mlvm/asm"
+)
+
+func loadMNISTProgram(mu uc.Unicorn, ram map[uint32](uint32)) {
+	ZeroRegisters(ram)
+	LoadMappedFileUnicorn(mu, "../../mlgo/examples/mnist_mips/mlgo.bin", ram, 0)
+	LoadInputData(mu, "../../mlgo/examples/mnist/models/mnist/input_7", ram)
+	LoadModel(mu, "../../mlgo/examples/mnist/models/mnist/ggml-model-small-f32-big-endian.bin", ram)
+	SyncRegs(mu, ram)
+}
+
+// the chunked runner has to stop on exactly the same steps as the callback
+func TestChunkedMatchesCallback(t *testing.T) {
+	target := 1000003
+
+	initTest()
+	ram := make(map[uint32](uint32))
+	var want map[uint32](uint32)
+	lastStep := 0
+	mu := GetHookedUnicorn("", ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
+		if step == target {
+			SyncRegs(mu, ram)
+			want = make(map[uint32](uint32))
+			for k, v := range ram {
+				want[k] = v
+			}
+		}
+		lastStep = step + 1
+	})
+	loadMNISTProgram(mu, ram)
+	mu.Start(0, 0x5ead0004)
+	wantRoot := RamToTrie(want)
+	wantFinal := RamToTrie(ram)
+
+	initTest()
+	ram = make(map[uint32](uint32))
+	c := GetChunkedUnicorn("", ram)
+	loadMNISTProgram(c.Mu, ram)
+	check(c.RunTo(target))
+	SyncRegs(c.Mu, ram)
+	if c.Step != target {
+		t.Fatalf("stopped at %d, want %d", c.Step, target)
+	}
+	if root := RamToTrie(ram); root != wantRoot {
+		t.Fatalf("root at %d is %s, want %s", target, root, wantRoot)
+	}
+
+	check(c.RunTo(-1))
+	fmt.Println("total steps: ", c.Step)
+	if c.Step != lastStep {
+		t.Fatalf("exited at %d, want %d", c.Step, lastStep)
+	}
+	if root := RamToTrie(ram); root != wantFinal {
+		t.Fatalf("final root is %s, want %s", root, wantFinal)
+	}
+}
+
+// RunTo has to stop where the callback path does when the next instruction is
+// a branch delay slot, and on either side of exit_group. In loopProgram the
+// first bne is step 3 with its delay slot at 4, exit_group is step 3006 and the
+// nop at HALT_PC is 3007.
+func TestChunkedAsmTargets(t *testing.T) {
+	targets := []int{3, 4, 5, 3005, 3006, 3007, 3008}
+
+	initTest()
+	want := make(map[int]map[uint32](uint32))
+	ram := make(map[uint32](uint32))
+	mu := GetHookedUnicorn("", ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
+		for _, target := range targets {
+			if step == target {
+				SyncRegs(mu, ram)
+				want[step] = copyRam(ram)
+			}
+		}
+	})
+	loadAsm(loopProgram)(mu, ram)
+	check(mu.Start(0, 0x5ead0004))
+	SyncRegs(mu, ram)
+	want[3008] = copyRam(ram)
+
+	compare := func(what string, target int, got map[uint32](uint32)) {
+		if g, w := RegistersFromRam(got), RegistersFromRam(want[target]); g != w {
+			t.Fatalf("%s to %d: registers %+v, want %+v", what, target, g, w)
+		}
+		if RamToTrie(got) != RamToTrie(want[target]) {
+			t.Fatalf("%s to %d: different root", what, target)
+		}
+	}
+
+	for _, target := range targets {
+		initTest()
+		ram := make(map[uint32](uint32))
+		c := GetChunkedUnicorn("", ram)
+		loadAsm(loopProgram)(c.Mu, ram)
+		check(c.RunTo(target))
+		SyncRegs(c.Mu, ram)
+		if c.Step != target {
+			t.Fatalf("RunTo(%d) stopped at %d", target, c.Step)
+		}
+		compare("RunTo", target, ram)
+
+		// StepMIPS runs a branch and its delay slot as one step, so it can't
+		// stop in a delay slot, and it never runs the nop at HALT_PC
+		stepped := make(map[uint32](uint32))
+		ZeroRegisters(stepped)
+		LoadData(asm.MustAssemble(0, loopProgram), stepped, 0)
+		n := 0
+		for n < target && stepped[REG_PC] != HALT_PC {
+			if DecodeInsn(stepped[stepped[REG_PC]]).HasDelaySlot() {
+				n++
+			}
+			_, err := StepMIPS(&RamStepMemory{Ram: stepped})
+			check(err)
+			n++
+		}
+		if n == target {
+			if stepped[REG_PC] != ram[REG_PC] {
+				t.Fatalf("StepMIPS to %d is at %x, RunTo at %x", target, stepped[REG_PC], ram[REG_PC])
+			}
+			if g, w := RegistersFromRam(stepped).GPR, RegistersFromRam(ram).GPR; g != w {
+				t.Fatalf("StepMIPS to %d: registers %x, RunTo %x", target, g, w)
+			}
+		}
+	}
+
+	// and the same going from one target to the next
+	initTest()
+	ram = make(map[uint32](uint32))
+	c := GetChunkedUnicorn("", ram)
+	loadAsm(loopProgram)(c.Mu, ram)
+	for _, target := range targets {
+		check(c.RunTo(target))
+		SyncRegs(c.Mu, ram)
+		compare("consecutive RunTo", target, ram)
+	}
+}
+
+// faultProgram loops 10 times before a syscall, step 32, that ends the run
+func faultProgram(syscall string) string {
+	return `
+	li $t0, 10
+loop:
+	addiu $t0, $t0, -1
+	bne $t0, $zero, loop
+	nop
+` + syscall + exitProgram
+}
+
+func TestChunkedFaultStep(t *testing.T) {
+	StrictSyscalls = true
+	defer func() { StrictSyscalls = false }()
+
+	for _, c := range []struct {
+		name    string
+		syscall string
+		step    int
+	}{
+		{"unknown", "\tli $v0, 4321\n\tsyscall\n", 32},
+		{"mmap", "\tli $a1, 0x7ffff000\n\tli $v0, 4090\n\tsyscall\n", 34},
+		{"mmap past 4GiB", "\tli $a0, 0xd0000000\n\tli $a1, 0x40000000\n\tli $v0, 4090\n\tsyscall\n", 36},
+	} {
+		// the fault in the first chunk, in a later one, and at the start of one
+		for _, chunks := range [][]int{{-1}, {10, -1}, {3, 5, -1}, {c.step, -1}} {
+			initTest()
+			ram := make(map[uint32](uint32))
+			u := GetChunkedUnicorn("", ram)
+			loadAsm(faultProgram(c.syscall))(u.Mu, ram)
+			var err error
+			for _, target := range chunks {
+				if err = u.RunTo(target); err != nil {
+					break
+				}
+			}
+			step := -1
+			switch e := err.(type) {
+			case *SyscallError:
+				step = e.Step
+			case *MemoryError:
+				step = e.Step
+			}
+			if step != c.step {
+				t.Fatalf("%s in chunks %v: %v, want step %d", c.name, chunks, err, c.step)
+			}
+			u.Mu.Close()
+		}
+	}
+}
@@ -2,13 +2,11 @@ package vm
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/fatih/color"
 	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
@@ -22,6 +20,7 @@ func check(err error) {
 
 var steps int = 0
 var heap_start uint64 = 0
+var brk_size uint64 = 0
 
 func WriteBytes(fd int, bytes []byte) {
 	printer := color.New(color.FgWhite).SprintFunc()
@@ -48,13 +47,14 @@ func WriteRam(ram map[uint32](uint32), addr uint32, value uint32) {
 var REG_OFFSET uint32 = 0xc0000000
 var REG_PC uint32 = REG_OFFSET + 0x20*4
 var REG_HEAP uint32 = REG_OFFSET + 0x23*4
+var REG_BRK uint32 = REG_OFFSET + 0x24*4
 
 func SyncRegs(mu uc.Unicorn, ram map[uint32](uint32)) {
 	pc, _ := mu.RegRead(uc.MIPS_REG_PC)
 	//fmt.Printf("%d uni %x\n", step, pc)
-	WriteRam(ram, 0xc0000080, uint32(pc))
+	WriteRam(ram, REG_PC, uint32(pc))
 
-	addr := uint32(0xc0000000)
+	addr := REG_OFFSET
 	for i := uc.MIPS_REG_ZERO; i < uc.MIPS_REG_ZERO+32; i++ {
 		reg, _ := mu.RegRead(i)
 		WriteRam(ram, addr, uint32(reg))
@@ -63,102 +63,58 @@ func SyncRegs(mu uc.Unicorn, ram map[uint32](uint32)) {
 
 	reg_hi, _ := mu.RegRead(uc.MIPS_REG_HI)
 	reg_lo, _ := mu.RegRead(uc.MIPS_REG_LO)
-	WriteRam(ram, REG_OFFSET+0x21*4, uint32(reg_hi))
-	WriteRam(ram, REG_OFFSET+0x22*4, uint32(reg_lo))
+	WriteRam(ram, REG_HI, uint32(reg_hi))
+	WriteRam(ram, REG_LO, uint32(reg_lo))
 
 	WriteRam(ram, REG_HEAP, uint32(heap_start))
+	// the break only joins the state once brk moves it, older states don't
+	// have the word at all
+	if _, ok := ram[REG_BRK]; ok {
+		WriteRam(ram, REG_BRK, uint32(brk_size))
+	}
 }
 
-func GetHookedUnicorn(root string, ram map[uint32](uint32), callback func(int, uc.Unicorn, map[uint32](uint32))) uc.Unicorn {
-	mu, err := uc.NewUnicorn(uc.ARCH_MIPS, uc.MODE_32|uc.MODE_BIG_ENDIAN)
-	check(err)
-
+// HookRamWrites mirrors every guest store into ram, so the trie can be built
+// without reading back the whole unicorn address space
+func HookRamWrites(mu uc.Unicorn, ram map[uint32](uint32)) {
 	_, outputfault := os.LookupEnv("OUTPUTFAULT")
 
-	mu.HookAdd(uc.HOOK_INTR, func(mu uc.Unicorn, intno uint32) {
-		if intno != 17 {
-			log.Fatal("invalid interrupt ", intno, " at step ", steps)
+	mu.HookAdd(uc.HOOK_MEM_WRITE, func(mu uc.Unicorn, access int, addr64 uint64, size int, value int64) {
+		rt := value
+		rs := addr64 & 3
+		addr := uint32(addr64 & 0xFFFFFFFC)
+		if outputfault && addr == MAGIC_ADDR+4 {
+			fmt.Printf("injecting output fault over %x\n", rt)
+			rt = 0xbabababa
 		}
-		syscall_no, _ := mu.RegRead(uc.MIPS_REG_V0)
-		v0 := uint64(0)
-		if syscall_no == 4020 {
-			// load the preimage from blockchain data
-			// but for pure execution, we may not need it
-			// unless we need to load some data, for example, parameters in DNN?
-			oracle_hash, _ := mu.MemRead(0x30001000, 0x20)
-			hash := common.BytesToHash(oracle_hash)
-			key := fmt.Sprintf("%s/%s", root, hash)
-			value, err := ioutil.ReadFile(key)
-			// check(err)
-			if err == nil {
-				tmp := []byte{0, 0, 0, 0}
-				binary.BigEndian.PutUint32(tmp, uint32(len(value)))
-				mu.MemWrite(0x31000000, tmp)
-				mu.MemWrite(0x31000004, value)
-	
-				WriteRam(ram, 0x31000000, uint32(len(value)))
-				value = append(value, 0, 0, 0)
-				for i := uint32(0); i < ram[0x31000000]; i += 4 {
-					WriteRam(ram, 0x31000004+i, binary.BigEndian.Uint32(value[i:i+4]))
-				}
-			}
-
-		} else if syscall_no == 4004 {
-			fd, _ := mu.RegRead(uc.MIPS_REG_A0)
-			buf, _ := mu.RegRead(uc.MIPS_REG_A1)
-			count, _ := mu.RegRead(uc.MIPS_REG_A2)
-			bytes, _ := mu.MemRead(buf, count)
-			WriteBytes(int(fd), bytes)
-		} else if syscall_no == 4090 {
-			a0, _ := mu.RegRead(uc.MIPS_REG_A0)
-			sz, _ := mu.RegRead(uc.MIPS_REG_A1)
-			if a0 == 0 {
-				v0 = 0x20000000 + heap_start
-				heap_start += sz
-			} else {
-				v0 = a0
-			}
-		} else if syscall_no == 4045 {
-			v0 = 0x40000000
-		} else if syscall_no == 4120 {
-			v0 = 1
-		} else if syscall_no == 4246 {
-			// exit group
-			mu.RegWrite(uc.MIPS_REG_PC, 0x5ead0000)
+		//fmt.Printf("%X(%d) = %x (at step %d)\n", addr, size, value, steps)
+		if size == 1 {
+			mem := ram[addr]
+			val := uint32((rt & 0xFF) << (24 - (rs&3)*8))
+			mask := 0xFFFFFFFF ^ uint32(0xFF<<(24-(rs&3)*8))
+			WriteRam(ram, uint32(addr), (mem&mask)|val)
+		} else if size == 2 {
+			mem := ram[addr]
+			val := uint32((rt & 0xFFFF) << (16 - (rs&2)*8))
+			mask := 0xFFFFFFFF ^ uint32(0xFFFF<<(16-(rs&2)*8))
+			WriteRam(ram, uint32(addr), (mem&mask)|val)
+		} else if size == 4 {
+			WriteRam(ram, uint32(addr), uint32(rt))
 		} else {
-			//fmt.Println("syscall", syscall_no)
+			log.Fatal("bad size write to ram")
 		}
-		mu.RegWrite(uc.MIPS_REG_V0, v0)
-		mu.RegWrite(uc.MIPS_REG_A3, 0)
-	}, 0, 0)
 
-	if callback != nil {
-		mu.HookAdd(uc.HOOK_MEM_WRITE, func(mu uc.Unicorn, access int, addr64 uint64, size int, value int64) {
-			rt := value
-			rs := addr64 & 3
-			addr := uint32(addr64 & 0xFFFFFFFC)
-			if outputfault && addr == 0x30000804 {
-				fmt.Printf("injecting output fault over %x\n", rt)
-				rt = 0xbabababa
-			}
-			//fmt.Printf("%X(%d) = %x (at step %d)\n", addr, size, value, steps)
-			if size == 1 {
-				mem := ram[addr]
-				val := uint32((rt & 0xFF) << (24 - (rs&3)*8))
-				mask := 0xFFFFFFFF ^ uint32(0xFF<<(24-(rs&3)*8))
-				WriteRam(ram, uint32(addr), (mem&mask)|val)
-			} else if size == 2 {
-				mem := ram[addr]
-				val := uint32((rt & 0xFFFF) << (16 - (rs&2)*8))
-				mask := 0xFFFFFFFF ^ uint32(0xFFFF<<(16-(rs&2)*8))
-				WriteRam(ram, uint32(addr), (mem&mask)|val)
-			} else if size == 4 {
-				WriteRam(ram, uint32(addr), uint32(rt))
-			} else {
-				log.Fatal("bad size write to ram")
-			}
+	}, 0, 0x80000000)
+}
 
-		}, 0, 0x80000000)
+func GetHookedUnicorn(root string, ram map[uint32](uint32), callback func(int, uc.Unicorn, map[uint32](uint32))) uc.Unicorn {
+	mu, err := uc.NewUnicorn(uc.ARCH_MIPS, uc.MODE_32|uc.MODE_BIG_ENDIAN)
+	check(err)
+
+	hookSyscalls(mu, root, ram)
+
+	if callback != nil {
+		HookRamWrites(mu, ram)
 
 		mu.HookAdd(uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
 			callback(steps, mu, ram)
@@ -221,7 +177,7 @@ func RunUnicorn(fn string, ram map[uint32](uint32), checkIO bool, callback func(
 		// check(err)
 		if err == nil {
 			real := append([]byte{0x13, 0x37, 0xf0, 0x0d}, outputs...)
-			output, _ := mu.MemRead(0x30000800, 0x44)
+			output, _ := mu.MemRead(uint64(MAGIC_ADDR), 0x44)
 			if bytes.Compare(real, output) != 0 {
 				log.Fatal("mismatch output")
 			} else {
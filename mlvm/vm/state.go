@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"mlvm/asm"
+)
+
+// Registers is the register block at 0xC0000000 laid out by ZeroRegisters and
+// SyncRegs: the 32 GPRs, then pc, hi, lo, the heap pointer and the break
+type Registers struct {
+	GPR  [32]uint32
+	PC   uint32
+	HI   uint32
+	LO   uint32
+	Heap uint32
+	Brk  uint32
+}
+
+// State is the machine state a checkpoint commits to
+type State struct {
+	Registers
+	Exited bool
+	Step   int
+	NodeID int
+}
+
+func RegistersFromRam(ram map[uint32](uint32)) Registers {
+	var r Registers
+	for i := range r.GPR {
+		r.GPR[i] = ram[REG_OFFSET+uint32(i)*4]
+	}
+	r.PC = ram[REG_PC]
+	r.HI = ram[REG_HI]
+	r.LO = ram[REG_LO]
+	r.Heap = ram[REG_HEAP]
+	r.Brk = ram[REG_BRK]
+	return r
+}
+
+// StateFromRam decodes the registers, the step and node aren't in ram
+func StateFromRam(ram map[uint32](uint32)) *State {
+	r := RegistersFromRam(ram)
+	// MIPS.sol stops at HALT_PC, unicorn one nop past it
+	return &State{Registers: r, Exited: r.PC == HALT_PC || r.PC == HALT_PC+4}
+}
+
+// StateFromCheckpoint decodes the state a checkpoint file commits to
+func StateFromCheckpoint(fn string) (*State, error) {
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	j, err := TrieFromJson(dat)
+	if err != nil {
+		return nil, err
+	}
+	s := StateFromRam(RamFromTrie(j.Root))
+	s.Step = j.Step
+	s.NodeID = j.NodeID
+	return s, nil
+}
+
+// names are the register names of the register block, in order
+func (r *Registers) names() []string {
+	names := make([]string, 0, 37)
+	for i := uint32(0); i < 32; i++ {
+		names = append(names, "$"+asm.RegName(i))
+	}
+	return append(names, "pc", "hi", "lo", "heap", "brk")
+}
+
+func (r *Registers) words() []*uint32 {
+	words := make([]*uint32, 0, 37)
+	for i := range r.GPR {
+		words = append(words, &r.GPR[i])
+	}
+	return append(words, &r.PC, &r.HI, &r.LO, &r.Heap, &r.Brk)
+}
+
+// MarshalJSON writes the registers as an object of hex strings in block
+// order. The break is left out until brk has moved it.
+func (r Registers) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, name := range r.names() {
+		if name == "brk" && r.Brk == 0 {
+			continue
+		}
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%q:\"0x%08x\"", name, *r.words()[i])
+	}
+	b.WriteString("}")
+	return b.Bytes(), nil
+}
+
+func (r *Registers) UnmarshalJSON(dat []byte) error {
+	var values map[string]string
+	if err := json.Unmarshal(dat, &values); err != nil {
+		return err
+	}
+	words := r.words()
+	for i, name := range r.names() {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return fmt.Errorf("register %s: %v", name, err)
+		}
+		*words[i] = uint32(v)
+	}
+	return nil
+}
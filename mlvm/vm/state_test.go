@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+func TestStateFromCheckpoint(t *testing.T) {
+	initTest()
+	basedir := t.TempDir()
+	oracle.SetRoot(basedir)
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	ram[REG_OFFSET+2*4] = 4246
+	ram[REG_OFFSET+29*4] = 0x7fffd000
+	ram[REG_PC] = HALT_PC
+	ram[REG_HI] = 1
+	ram[REG_LO] = 2
+	ram[REG_HEAP] = 0x20001000
+	fn := CheckpointPath(basedir, 3, 77)
+	check(os.MkdirAll(basedir+"/checkpoint", 0755))
+	WriteCheckpointWithNodeID(ram, fn, 77, 3, 10)
+
+	s, err := StateFromCheckpoint(fn)
+	check(err)
+	want := State{Exited: true, Step: 77, NodeID: 3}
+	want.GPR[2] = 4246
+	want.GPR[29] = 0x7fffd000
+	want.PC, want.HI, want.LO, want.Heap = HALT_PC, 1, 2, 0x20001000
+	if *s != want {
+		t.Fatalf("state %+v, want %+v", *s, want)
+	}
+
+	dat, err := ioutil.ReadFile(fn)
+	check(err)
+	if !strings.Contains(string(dat), `"registers":{"$zero":"0x00000000","$at":"0x00000000","$v0":"0x00001096"`) ||
+		!strings.Contains(string(dat), `"pc":"0x5ead0000","hi":"0x00000001","lo":"0x00000002","heap":"0x20001000"}`) {
+		t.Fatalf("registers section missing from %s", dat)
+	}
+	var j Jtree
+	check(json.Unmarshal(dat, &j))
+	if j.Registers == nil || *j.Registers != want.Registers {
+		t.Fatalf("registers read back as %+v", j.Registers)
+	}
+}
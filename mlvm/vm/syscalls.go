@@ -0,0 +1,242 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/ethereum/go-ethereum/common"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// SyscallMachine is the state a syscall sees. The registers are read and
+// written at their addresses in the register block, REG_OFFSET+4*n, the way
+// MIPS.sol has them, so one handler runs under unicorn and StepMIPS alike.
+type SyscallMachine interface {
+	Read(addr uint32) uint32
+	Write(addr uint32, value uint32)
+}
+
+// SyscallArg is argument i, $a0 to $a3
+func SyscallArg(m SyscallMachine, i uint32) uint32 {
+	return m.Read(REG_OFFSET + (4+i)*4)
+}
+
+// SyscallHandler is one syscall. Run is the syscall as MIPS.sol does it and
+// has to be deterministic, it returns $v0. Host, when set, runs before Run
+// under unicorn only, for I/O that MIPS.sol doesn't do.
+type SyscallHandler struct {
+	Name string
+	Run  func(m SyscallMachine) uint32
+	Host func(mu uc.Unicorn, root string, ram map[uint32](uint32))
+	// Exit halts the program once the syscall is done
+	Exit bool
+}
+
+// Syscalls are the handlers by syscall number. Anything not in here returns
+// 0, unless StrictSyscalls is set.
+var Syscalls = map[uint32]*SyscallHandler{
+	4004: {Name: "write", Host: hostWrite},
+	4020: {Name: "preimage", Host: hostPreimage},
+	4045: {Name: "brk", Run: runBrk, Host: hostBrk},
+	4090: {Name: "mmap", Run: runMmap, Host: hostMmap},
+	// clone isn't supported
+	4120: {Name: "clone", Run: func(m SyscallMachine) uint32 { return 1 }},
+	4246: {Name: "exit_group", Exit: true},
+}
+
+// builtin syscalls are inline in MIPS.sol, they can't be registered over
+var builtinSyscalls = map[uint32]bool{4004: true, 4020: true, 4045: true, 4090: true, 4120: true, 4246: true}
+
+// StrictSyscalls fails the run on a syscall with no handler, instead of
+// returning 0 from it. MIPS.sol always returns 0, so StepMIPS isn't strict.
+var StrictSyscalls bool
+
+// RegisterSyscall adds a syscall for the guest. It must also be registered
+// with MIPS.RegisterSyscall on chain, by a contract doing exactly what Run
+// does, or the steps that call it can't be proven.
+func RegisterSyscall(syscallNo uint32, h *SyscallHandler) error {
+	if builtinSyscalls[syscallNo] {
+		return fmt.Errorf("syscall %d is builtin", syscallNo)
+	}
+	if _, ok := Syscalls[syscallNo]; ok {
+		return fmt.Errorf("syscall %d is already registered", syscallNo)
+	}
+	if h.Run == nil {
+		return fmt.Errorf("syscall %d has no Run", syscallNo)
+	}
+	Syscalls[syscallNo] = h
+	return nil
+}
+
+type SyscallError struct {
+	SyscallNo uint32
+	Step      int
+	PC        uint32
+}
+
+func (e *SyscallError) Error() string {
+	return fmt.Sprintf("unknown syscall %d at step %d pc %x", e.SyscallNo, e.Step, e.PC)
+}
+
+// RunSyscall runs the syscall in $v0 and writes back $v0 and $a3 as MIPS.sol
+// does. It returns true when the program exited.
+func RunSyscall(m SyscallMachine) bool {
+	v0 := uint32(0)
+	h, ok := Syscalls[m.Read(REG_OFFSET+2*4)]
+	if ok && h.Run != nil {
+		v0 = h.Run(m)
+	}
+	m.Write(REG_OFFSET+2*4, v0)
+	m.Write(REG_OFFSET+7*4, 0)
+	return ok && h.Exit
+}
+
+func hostWrite(mu uc.Unicorn, root string, ram map[uint32](uint32)) {
+	fd, _ := mu.RegRead(uc.MIPS_REG_A0)
+	buf, _ := mu.RegRead(uc.MIPS_REG_A1)
+	count, _ := mu.RegRead(uc.MIPS_REG_A2)
+	bytes, _ := mu.MemRead(buf, count)
+	WriteBytes(int(fd), bytes)
+}
+
+// hostPreimage loads the preimage of the hash at ORACLE_HASH_ADDR from root,
+// for the guest to read at ORACLE_ADDR. On chain the window is MMIO over
+// MIPSMemory's preimages and isn't in the trie, so it only goes into
+// unicorn's memory and not into ram. StepMIPS reads the same words through
+// StepMemory.Preimage.
+func hostPreimage(mu uc.Unicorn, root string, ram map[uint32](uint32)) {
+	oracle_hash, _ := mu.MemRead(uint64(ORACLE_HASH_ADDR), 0x20)
+	hash := common.BytesToHash(oracle_hash)
+	key := fmt.Sprintf("%s/%s", root, hash)
+	value, err := ioutil.ReadFile(key)
+	if err != nil {
+		return
+	}
+	tmp := []byte{0, 0, 0, 0}
+	binary.BigEndian.PutUint32(tmp, uint32(len(value)))
+	mu.MemWrite(uint64(ORACLE_ADDR), tmp)
+	// MIPS.sol reads the last word zero padded, not whatever a longer
+	// preimage left after it
+	mu.MemWrite(uint64(ORACLE_ADDR+4), append(value, make([]byte, (4-len(value)%4)%4)...))
+}
+
+// unicornMachine is the register block of unicorn's registers and the heap
+// pointers, and memory mirrored into ram
+type unicornMachine struct {
+	mu  uc.Unicorn
+	ram map[uint32](uint32)
+}
+
+func (m *unicornMachine) reg(addr uint32) (int, bool) {
+	if addr < REG_OFFSET || addr >= REG_OFFSET+0x23*4 {
+		return 0, false
+	}
+	switch i := int(addr-REG_OFFSET) / 4; i {
+	case 0x20:
+		return uc.MIPS_REG_PC, true
+	case 0x21:
+		return uc.MIPS_REG_HI, true
+	case 0x22:
+		return uc.MIPS_REG_LO, true
+	default:
+		return uc.MIPS_REG_ZERO + i, true
+	}
+}
+
+func (m *unicornMachine) Read(addr uint32) uint32 {
+	if addr == REG_HEAP {
+		return uint32(heap_start)
+	}
+	if addr == REG_BRK {
+		return uint32(brk_size)
+	}
+	if reg, ok := m.reg(addr); ok {
+		value, _ := m.mu.RegRead(reg)
+		return uint32(value)
+	}
+	dat, err := m.mu.MemRead(uint64(addr), 4)
+	check(err)
+	return binary.BigEndian.Uint32(dat)
+}
+
+func (m *unicornMachine) Write(addr uint32, value uint32) {
+	if addr == REG_HEAP {
+		heap_start = uint64(value)
+		return
+	}
+	if addr == REG_BRK {
+		// MIPS.sol writes the leaf on every brk that moves the break, even
+		// to BRK_START where the size stays 0
+		brk_size = uint64(value)
+		WriteRam(m.ram, REG_BRK, value)
+		return
+	}
+	if reg, ok := m.reg(addr); ok {
+		m.mu.RegWrite(reg, uint64(value))
+		return
+	}
+	dat := make([]byte, 4)
+	binary.BigEndian.PutUint32(dat, value)
+	check(m.mu.MemWrite(uint64(addr), dat))
+	// host writes don't go through the write hook
+	WriteRam(m.ram, addr, value)
+}
+
+// inChunk is set while ChunkedUnicorn runs a chunk, and chunkFault is the
+// first fault a syscall ran into in it
+var inChunk bool
+var chunkFault error
+
+// syscallFault stops the run on a *SyscallError or *MemoryError. Outside of
+// a chunk the per instruction callback has already counted the syscall, so
+// its step is one back. Inside one nothing has counted it yet, so the fault
+// is left for RunTo, which works the step out from how far down the sled the
+// rest of the chunk got.
+func syscallFault(err error) {
+	if inChunk {
+		if chunkFault == nil {
+			chunkFault = err
+		}
+		return
+	}
+	setFaultStep(err, steps-1)
+	log.Fatal(err)
+}
+
+func setFaultStep(err error, step int) {
+	switch e := err.(type) {
+	case *SyscallError:
+		e.Step = step
+	case *MemoryError:
+		e.Step = step
+	}
+}
+
+// hookSyscalls handles the guest's syscalls with Syscalls
+func hookSyscalls(mu uc.Unicorn, root string, ram map[uint32](uint32)) {
+	m := &unicornMachine{mu, ram}
+	mu.HookAdd(uc.HOOK_INTR, func(mu uc.Unicorn, intno uint32) {
+		if intno != 17 {
+			log.Fatal("invalid interrupt ", intno, " at step ", steps)
+		}
+		syscallNo, _ := mu.RegRead(uc.MIPS_REG_V0)
+		h, ok := Syscalls[uint32(syscallNo)]
+		if !ok && StrictSyscalls {
+			pc, _ := mu.RegRead(uc.MIPS_REG_PC)
+			syscallFault(&SyscallError{uint32(syscallNo), 0, uint32(pc)})
+		}
+		if ok && h.Host != nil && chunkFault == nil {
+			h.Host(mu, root, ram)
+		}
+		if chunkFault != nil {
+			// the rest of the chunk goes down the sled, see RunTo
+			mu.RegWrite(uc.MIPS_REG_PC, HALT_PC)
+			return
+		}
+		if RunSyscall(m) {
+			mu.RegWrite(uc.MIPS_REG_PC, HALT_PC)
+		}
+	}, 0, 0)
+}
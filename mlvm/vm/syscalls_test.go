@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"testing"
+)
+
+func stepSyscall(t *testing.T, ram map[uint32](uint32), syscallNo uint32, a0 uint32, a1 uint32) {
+	ram[REG_PC] = 0x1000
+	ram[0x1000] = 0x0000000c // syscall
+	ram[REG_OFFSET+2*4] = syscallNo
+	ram[REG_OFFSET+4*4] = a0
+	ram[REG_OFFSET+5*4] = a1
+	ram[REG_OFFSET+7*4] = 0x77
+	if _, err := StepMIPS(&RamStepMemory{Ram: ram}); err != nil {
+		t.Fatal(err)
+	}
+	if ram[REG_OFFSET+7*4] != 0 {
+		t.Fatal("$a3 not cleared")
+	}
+}
+
+func TestSyscallBuiltins(t *testing.T) {
+	initTest()
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+
+	ram[REG_HEAP] = 0x100
+	stepSyscall(t, ram, 4090, 0, 0x2000)
+	if ram[REG_OFFSET+2*4] != HEAP_START+0x100 || ram[REG_HEAP] != 0x2100 {
+		t.Fatalf("mmap %x heap %x", ram[REG_OFFSET+2*4], ram[REG_HEAP])
+	}
+	stepSyscall(t, ram, 4045, 0, 0)
+	if ram[REG_OFFSET+2*4] != BRK_START {
+		t.Fatalf("brk %x", ram[REG_OFFSET+2*4])
+	}
+	// unknown syscalls return 0 on chain, strict or not
+	StrictSyscalls = true
+	defer func() { StrictSyscalls = false }()
+	stepSyscall(t, ram, 4321, 0, 0)
+	if ram[REG_OFFSET+2*4] != 0 || ram[REG_PC] != 0x1004 {
+		t.Fatalf("unknown %x pc %x", ram[REG_OFFSET+2*4], ram[REG_PC])
+	}
+	stepSyscall(t, ram, 4246, 0, 0)
+	if ram[REG_PC] != HALT_PC {
+		t.Fatalf("exit pc %x", ram[REG_PC])
+	}
+}
+
+func TestRegisterSyscall(t *testing.T) {
+	initTest()
+	if err := RegisterSyscall(4090, &SyscallHandler{Run: runMmap}); err == nil {
+		t.Fatal("registered over mmap")
+	}
+	if err := RegisterSyscall(5000, &SyscallHandler{Name: "nothing"}); err == nil {
+		t.Fatal("registered without Run")
+	}
+
+	// stores a0+a1 at 0x2000 and returns the sum doubled
+	double := &SyscallHandler{Name: "double", Run: func(m SyscallMachine) uint32 {
+		sum := SyscallArg(m, 0) + SyscallArg(m, 1)
+		m.Write(0x2000, sum)
+		return 2 * sum
+	}}
+	check(RegisterSyscall(5000, double))
+	defer delete(Syscalls, 5000)
+	if err := RegisterSyscall(5000, double); err == nil {
+		t.Fatal("registered twice")
+	}
+
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	stepSyscall(t, ram, 5000, 20, 1)
+	if ram[REG_OFFSET+2*4] != 42 || ram[0x2000] != 21 || ram[REG_PC] != 0x1004 {
+		t.Fatalf("v0 %d mem %d pc %x", ram[REG_OFFSET+2*4], ram[0x2000], ram[REG_PC])
+	}
+}
@@ -0,0 +1,342 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// A trace file is "MLTR", the version and the first step, followed by one
+// record per step:
+//   uvarint length of the rest of the record
+//   pc, insn                      uint32
+//   reg                           uint8, REG_NONE if nothing is written
+//   value                         uint32, only when reg is written
+//   count of memory writes        uint8
+//   count * (addr uint32, size uint8, value uint32)
+// all big endian. Next to it, <trace>.idx holds the stride and the offset of
+// every stride'th record as uint64s, so a reader can seek to a step.
+
+const TRACE_MAGIC = "MLTR"
+const TRACE_VERSION = 1
+const TRACE_INDEX_STRIDE = 4096
+
+// registers that aren't GPRs are numbered by their slot in the register block
+const REG_NONE = 0xff
+const TRACE_REG_HI = 0x21
+const TRACE_REG_LO = 0x22
+
+// TraceFile turns on the tracer for MIPSRun and MIPSRunCompatible
+var TraceFile string
+
+type TraceMemWrite struct {
+	Addr  uint32
+	Size  uint8
+	Value uint32
+}
+
+type TraceRecord struct {
+	Step      int
+	PC        uint32
+	Insn      uint32
+	Reg       uint8
+	RegValue  uint32
+	MemWrites []TraceMemWrite
+}
+
+// DestReg is the register an instruction writes, for mult and div that's LO
+func (i Insn) DestReg() uint8 {
+	reg := uint8(REG_NONE)
+	switch {
+	case i.Opcode == 0:
+		switch {
+		case i.Func == 0x08 || i.Func == 0x0f:
+		case i.Func == 0x0c:
+			reg = 2
+		case i.Func == 0x11:
+			reg = TRACE_REG_HI
+		case i.Func == 0x13 || (i.Func >= 0x18 && i.Func < 0x1c):
+			reg = TRACE_REG_LO
+		default:
+			reg = uint8(i.Rd)
+		}
+	case i.Opcode == 3:
+		reg = 31
+	case i.Opcode == 0x1c:
+		reg = uint8(i.Rd)
+	case (i.Opcode >= 8 && i.Opcode < 0x10) || (i.Opcode >= 0x20 && i.Opcode < 0x28) || i.Opcode == 0x30 || i.Opcode == 0x38:
+		reg = uint8(i.Rt)
+	}
+	if reg == 0 {
+		return REG_NONE
+	}
+	return reg
+}
+
+func regRead(mu uc.Unicorn, reg uint8) uint32 {
+	var value uint64
+	switch reg {
+	case TRACE_REG_HI:
+		value, _ = mu.RegRead(uc.MIPS_REG_HI)
+	case TRACE_REG_LO:
+		value, _ = mu.RegRead(uc.MIPS_REG_LO)
+	default:
+		value, _ = mu.RegRead(uc.MIPS_REG_ZERO + int(reg))
+	}
+	return uint32(value)
+}
+
+// Tracer records every step unicorn runs. A step's register write is only
+// known once the next one starts, so each record is written one step late.
+type Tracer struct {
+	f       *os.File
+	w       *bufio.Writer
+	offset  int64
+	index   []int64
+	step    int
+	first   int
+	pending *TraceRecord
+	mu      uc.Unicorn
+	err     error
+}
+
+// NewTracer traces mu into fn, numbering the steps from step
+func NewTracer(mu uc.Unicorn, fn string, step int) (*Tracer, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{f: f, w: bufio.NewWriter(f), step: step, first: step, mu: mu}
+	header := make([]byte, 12)
+	copy(header, TRACE_MAGIC)
+	binary.BigEndian.PutUint32(header[4:], TRACE_VERSION)
+	binary.BigEndian.PutUint32(header[8:], uint32(step))
+	t.write(header)
+
+	mu.HookAdd(uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
+		// the nop sled of the chunked runner isn't part of the program
+		if addr > HALT_PC && addr <= SLED_END {
+			return
+		}
+		t.flush()
+		insn, _ := mu.MemRead(addr, 4)
+		t.pending = &TraceRecord{Step: t.step, PC: uint32(addr), Insn: binary.BigEndian.Uint32(insn)}
+		t.step++
+	}, 0, 0x80000000)
+	mu.HookAdd(uc.HOOK_MEM_WRITE, func(mu uc.Unicorn, access int, addr uint64, size int, value int64) {
+		if t.pending != nil {
+			t.pending.MemWrites = append(t.pending.MemWrites, TraceMemWrite{uint32(addr), uint8(size), uint32(value)})
+		}
+	}, 0, 0x80000000)
+	return t, nil
+}
+
+func (t *Tracer) write(b []byte) {
+	if t.err != nil {
+		return
+	}
+	_, t.err = t.w.Write(b)
+	t.offset += int64(len(b))
+}
+
+// flush writes out the pending record, now that its register write is done
+func (t *Tracer) flush() {
+	r := t.pending
+	if r == nil {
+		return
+	}
+	t.pending = nil
+	r.Reg = DecodeInsn(r.Insn).DestReg()
+	if r.Reg != REG_NONE {
+		r.RegValue = regRead(t.mu, r.Reg)
+	}
+	if (r.Step-t.first)%TRACE_INDEX_STRIDE == 0 {
+		t.index = append(t.index, t.offset)
+	}
+	body := encodeTraceRecord(r)
+	t.write(binary.AppendUvarint(nil, uint64(len(body))))
+	t.write(body)
+}
+
+func encodeTraceRecord(r *TraceRecord) []byte {
+	b := binary.BigEndian.AppendUint32(nil, r.PC)
+	b = binary.BigEndian.AppendUint32(b, r.Insn)
+	b = append(b, r.Reg)
+	if r.Reg != REG_NONE {
+		b = binary.BigEndian.AppendUint32(b, r.RegValue)
+	}
+	if len(r.MemWrites) > 0xff {
+		r.MemWrites = r.MemWrites[:0xff]
+	}
+	b = append(b, uint8(len(r.MemWrites)))
+	for _, m := range r.MemWrites {
+		b = binary.BigEndian.AppendUint32(b, m.Addr)
+		b = append(b, m.Size)
+		b = binary.BigEndian.AppendUint32(b, m.Value)
+	}
+	return b
+}
+
+// Close writes the last step and the index
+func (t *Tracer) Close() error {
+	t.flush()
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	if err := t.f.Close(); t.err == nil {
+		t.err = err
+	}
+	if t.err != nil {
+		return t.err
+	}
+
+	idx := binary.BigEndian.AppendUint64(nil, TRACE_INDEX_STRIDE)
+	for _, offset := range t.index {
+		idx = binary.BigEndian.AppendUint64(idx, uint64(offset))
+	}
+	return os.WriteFile(t.f.Name()+".idx", idx, 0644)
+}
+
+// TraceReader reads back a trace, in order or from any step
+type TraceReader struct {
+	f      *os.File
+	r      *bufio.Reader
+	first  int
+	step   int
+	stride int
+	index  []int64
+}
+
+func OpenTrace(fn string) (*TraceReader, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if string(header[:4]) != TRACE_MAGIC || binary.BigEndian.Uint32(header[4:]) != TRACE_VERSION {
+		f.Close()
+		return nil, fmt.Errorf("%s isn't a version %d trace", fn, TRACE_VERSION)
+	}
+	tr := &TraceReader{f: f, r: bufio.NewReader(f), first: int(binary.BigEndian.Uint32(header[8:]))}
+	tr.step = tr.first
+
+	// without the index it can still be read, just not seeked quickly
+	if idx, err := os.ReadFile(fn + ".idx"); err == nil && len(idx) >= 8 {
+		tr.stride = int(binary.BigEndian.Uint64(idx))
+		for i := 8; i+8 <= len(idx); i += 8 {
+			tr.index = append(tr.index, int64(binary.BigEndian.Uint64(idx[i:])))
+		}
+	}
+	return tr, nil
+}
+
+// First is the step the trace starts at
+func (tr *TraceReader) First() int {
+	return tr.first
+}
+
+// Next returns the record of the next step, or io.EOF after the last one
+func (tr *TraceReader) Next() (*TraceRecord, error) {
+	size, err := binary.ReadUvarint(tr.r)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(tr.r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r, err := decodeTraceRecord(body)
+	if err != nil {
+		return nil, fmt.Errorf("step %d: %v", tr.step, err)
+	}
+	r.Step = tr.step
+	tr.step++
+	return r, nil
+}
+
+var errBadTraceRecord = errors.New("bad trace record")
+
+func decodeTraceRecord(b []byte) (*TraceRecord, error) {
+	if len(b) < 10 {
+		return nil, errBadTraceRecord
+	}
+	r := &TraceRecord{PC: binary.BigEndian.Uint32(b), Insn: binary.BigEndian.Uint32(b[4:]), Reg: b[8]}
+	b = b[9:]
+	if r.Reg != REG_NONE {
+		if len(b) < 5 {
+			return nil, errBadTraceRecord
+		}
+		r.RegValue = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+	n := int(b[0])
+	b = b[1:]
+	if len(b) != 9*n {
+		return nil, errBadTraceRecord
+	}
+	for i := 0; i < n; i++ {
+		r.MemWrites = append(r.MemWrites, TraceMemWrite{binary.BigEndian.Uint32(b), b[4], binary.BigEndian.Uint32(b[5:])})
+		b = b[9:]
+	}
+	return r, nil
+}
+
+// Seek makes step the next one Next returns
+func (tr *TraceReader) Seek(step int) error {
+	if step < tr.first {
+		return fmt.Errorf("trace starts at step %d", tr.first)
+	}
+	if tr.stride > 0 && len(tr.index) > 0 {
+		i := (step - tr.first) / tr.stride
+		if i >= len(tr.index) {
+			i = len(tr.index) - 1
+		}
+		if _, err := tr.f.Seek(tr.index[i], io.SeekStart); err != nil {
+			return err
+		}
+		tr.r.Reset(tr.f)
+		tr.step = tr.first + i*tr.stride
+	} else if step < tr.step {
+		if _, err := tr.f.Seek(12, io.SeekStart); err != nil {
+			return err
+		}
+		tr.r.Reset(tr.f)
+		tr.step = tr.first
+	}
+	for tr.step < step {
+		if _, err := tr.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tr *TraceReader) Close() error {
+	return tr.f.Close()
+}
+
+// startTrace attaches a tracer if TraceFile is set
+func startTrace(mu uc.Unicorn) *Tracer {
+	if TraceFile == "" {
+		return nil
+	}
+	t, err := NewTracer(mu, TraceFile, 0)
+	check(err)
+	return t
+}
+
+func stopTrace(t *Tracer) {
+	if t != nil {
+		check(t.Close())
+		fmt.Println("wrote trace to", TraceFile)
+	}
+}
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"io"
+	"testing"
+)
+
+// traceAsm runs a program to the end with the tracer on
+func traceAsm(t *testing.T, src string) (string, *ChunkedUnicorn) {
+	initTest()
+	fn := t.TempDir() + "/program.trace"
+	ram := make(map[uint32](uint32))
+	c := GetChunkedUnicorn("", ram)
+	loadAsm(src)(c.Mu, ram)
+	tracer, err := NewTracer(c.Mu, fn, 0)
+	check(err)
+	check(c.RunTo(-1))
+	check(tracer.Close())
+	return fn, c
+}
+
+func TestTrace(t *testing.T) {
+	fn, c := traceAsm(t, loopProgram)
+
+	tr, err := OpenTrace(fn)
+	check(err)
+	defer tr.Close()
+	var records []*TraceRecord
+	for {
+		r, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+		records = append(records, r)
+	}
+	if len(records) != c.Step {
+		t.Fatalf("%d records for %d steps", len(records), c.Step)
+	}
+
+	// li $t0, 1000 and the first time round the loop
+	if r := records[1]; r.PC != 4 || r.Reg != 8 || r.RegValue != 1000 {
+		t.Fatalf("step 1 is %+v", r)
+	}
+	if r := records[2]; r.Reg != 8 || r.RegValue != 999 {
+		t.Fatalf("step 2 is %+v", r)
+	}
+	if r := records[3]; r.Reg != REG_NONE || len(r.MemWrites) != 0 {
+		t.Fatalf("the branch is %+v", r)
+	}
+	var stores []*TraceRecord
+	for _, r := range records {
+		if len(r.MemWrites) > 0 {
+			stores = append(stores, r)
+		}
+	}
+	if len(stores) != 1 || stores[0].MemWrites[0] != (TraceMemWrite{0x30000804, 4, 7}) {
+		t.Fatalf("stores %+v", stores)
+	}
+	if last := records[len(records)-1]; last.PC != HALT_PC {
+		t.Fatalf("last step at %x", last.PC)
+	}
+
+	for _, step := range []int{2000, 5, len(records) - 1} {
+		check(tr.Seek(step))
+		r, err := tr.Next()
+		check(err)
+		if r.Step != step || r.PC != records[step].PC || r.RegValue != records[step].RegValue {
+			t.Fatalf("seek to %d gave %+v", step, r)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"mlvm/asm"
+)
+
+// TraceDiff is where two traces first part ways. Before holds the steps
+// leading up to it, which both traces agree on, and A and B the divergent
+// step and what follows in each. A trace that ended early has fewer records.
+type TraceDiff struct {
+	Step   int
+	Before []*TraceRecord
+	A      []*TraceRecord
+	B      []*TraceRecord
+}
+
+func sameTraceRecord(a, b *TraceRecord) bool {
+	if a.PC != b.PC || a.Insn != b.Insn || a.Reg != b.Reg || a.RegValue != b.RegValue || len(a.MemWrites) != len(b.MemWrites) {
+		return false
+	}
+	for i := range a.MemWrites {
+		if a.MemWrites[i] != b.MemWrites[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// readTrace returns up to count records, stopping early at the end
+func readTrace(tr *TraceReader, count int) ([]*TraceRecord, error) {
+	var records []*TraceRecord
+	for len(records) < count {
+		r, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// DiffTraces walks both traces from the later of their first steps and
+// returns the first step they differ at, or nil if they are the same
+func DiffTraces(a, b *TraceReader, context int) (*TraceDiff, error) {
+	start := a.First()
+	if b.First() > start {
+		start = b.First()
+	}
+	if err := a.Seek(start); err != nil {
+		return nil, err
+	}
+	if err := b.Seek(start); err != nil {
+		return nil, err
+	}
+
+	var before []*TraceRecord
+	for {
+		ra, erra := a.Next()
+		rb, errb := b.Next()
+		if erra == io.EOF && errb == io.EOF {
+			return nil, nil
+		}
+		if erra != nil && erra != io.EOF {
+			return nil, erra
+		}
+		if errb != nil && errb != io.EOF {
+			return nil, errb
+		}
+		if ra != nil && rb != nil && sameTraceRecord(ra, rb) {
+			before = append(before, ra)
+			if len(before) > context {
+				before = before[1:]
+			}
+			continue
+		}
+
+		d := &TraceDiff{Before: before}
+		for _, side := range []struct {
+			r       *TraceRecord
+			tr      *TraceReader
+			records *[]*TraceRecord
+		}{{ra, a, &d.A}, {rb, b, &d.B}} {
+			if side.r == nil {
+				continue
+			}
+			d.Step = side.r.Step
+			rest, err := readTrace(side.tr, context)
+			if err != nil {
+				return nil, err
+			}
+			*side.records = append([]*TraceRecord{side.r}, rest...)
+		}
+		return d, nil
+	}
+}
+
+// String renders a step as its disassembly and what it wrote
+func (r *TraceRecord) String() string {
+	var effects []string
+	switch {
+	case r.Reg == TRACE_REG_HI:
+		effects = append(effects, fmt.Sprintf("hi=%08x", r.RegValue))
+	case r.Reg == TRACE_REG_LO:
+		effects = append(effects, fmt.Sprintf("lo=%08x", r.RegValue))
+	case r.Reg != REG_NONE:
+		effects = append(effects, fmt.Sprintf("$%s=%08x", asm.RegName(uint32(r.Reg)), r.RegValue))
+	}
+	for _, m := range r.MemWrites {
+		effects = append(effects, fmt.Sprintf("[%08x]/%d=%x", m.Addr, m.Size, m.Value))
+	}
+	return fmt.Sprintf("%10d  %08x:  %08x  %-28s %s", r.Step, r.PC, r.Insn, asm.Disassemble(r.PC, r.Insn), strings.Join(effects, " "))
+}
+
+func (d *TraceDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "traces diverge at step %d\n\n", d.Step)
+	for _, r := range d.Before {
+		fmt.Fprintf(&b, "   %s\n", r)
+	}
+	for _, side := range []struct {
+		name    string
+		records []*TraceRecord
+	}{{"a", d.A}, {"b", d.B}} {
+		fmt.Fprintf(&b, "\n%s:\n", side.name)
+		if len(side.records) == 0 {
+			b.WriteString("   trace ended\n")
+		}
+		for i, r := range side.records {
+			marker := "  "
+			if i == 0 {
+				marker = "=>"
+			}
+			fmt.Fprintf(&b, "%s %s\n", marker, r)
+		}
+	}
+	return b.String()
+}
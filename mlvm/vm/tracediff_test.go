@@ -0,0 +1,49 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTraceDiff(t *testing.T) {
+	fa, _ := traceAsm(t, loopProgram)
+	fb, _ := traceAsm(t, strings.Replace(loopProgram, "sw $v0", "sw $t0", 1))
+	a, err := OpenTrace(fa)
+	check(err)
+	defer a.Close()
+	b, err := OpenTrace(fb)
+	check(err)
+	defer b.Close()
+
+	d, err := DiffTraces(a, b, 4)
+	check(err)
+	// 2 + 3*1000 steps of loop, then the lui and ori of li
+	if d == nil || d.Step != 3004 {
+		t.Fatalf("diff %+v", d)
+	}
+	if len(d.Before) != 4 || d.Before[3].Step != 3003 {
+		t.Fatalf("context before %+v", d.Before)
+	}
+	if d.A[0].MemWrites[0].Value != 7 || d.B[0].MemWrites[0].Value != 0 {
+		t.Fatalf("stores %+v and %+v", d.A[0], d.B[0])
+	}
+	out := d.String()
+	for _, want := range []string{
+		"traces diverge at step 3004",
+		"sw $v0, 0($t1)",
+		"sw $t0, 0($t1)",
+		"[30000804]/4=7",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("diff is missing %q:\n%s", want, out)
+		}
+	}
+
+	check(a.Seek(0))
+	c, err := OpenTrace(fa)
+	check(err)
+	defer c.Close()
+	if d, err := DiffTraces(a, c, 4); err != nil || d != nil {
+		t.Fatalf("a trace differs from itself: %v %v", d, err)
+	}
+}
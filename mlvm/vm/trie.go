@@ -24,6 +24,10 @@ type Jtree struct {
 	NodeID	  int                    `json:"nodeid"`
 	NodeCount int                    `json:"nodeCount"`
 	Preimages map[common.Hash][]byte `json:"preimages"`
+	// only for reading, the root already commits to them
+	Registers *Registers `json:"registers,omitempty"`
+	// the memory layout, in golden checkpoints
+	Layout *Layout `json:"layout,omitempty"`
 }
 
 func TrieToJson(root common.Hash, step int) []byte {
@@ -38,12 +42,35 @@ func TrieToJsonWithNodeID(root common.Hash, step int, nodeID int, nodeCount int)
 	return b
 }
 
-func TrieFromJson(dat []byte) (common.Hash, int) {
-	var j Jtree
-	err := json.Unmarshal(dat, &j)
+// CheckpointToJson is TrieToJsonWithNodeID with the registers of ram spelled out
+func CheckpointToJson(ram map[uint32](uint32), root common.Hash, step int, nodeID int, nodeCount int) []byte {
+	regs := RegistersFromRam(ram)
+	j := Jtree{Preimages: Preimages, Step: step, NodeID: nodeID, NodeCount: nodeCount, Root: root, Registers: &regs}
+	if step == -1 {
+		// golden
+		layout := GuestLayout
+		j.Layout = &layout
+	}
+	b, err := json.Marshal(j)
 	check(err)
+	return b
+}
+
+// TrieFromJson loads a checkpoint's trie into Preimages and returns the
+// checkpoint. The layout of a golden checkpoint is checked but not switched
+// to, that's up to the caller.
+func TrieFromJson(dat []byte) (*Jtree, error) {
+	var j Jtree
+	if err := json.Unmarshal(dat, &j); err != nil {
+		return nil, err
+	}
+	if j.Layout != nil {
+		if err := j.Layout.Validate(); err != nil {
+			return nil, fmt.Errorf("layout: %v", err)
+		}
+	}
 	Preimages = j.Preimages
-	return j.Root, j.Step
+	return &j, nil
 }
 
 // TODO: this is copied from the oracle
@@ -114,7 +141,7 @@ func RamFromTrie(root common.Hash) map[uint32](uint32) {
 		if tni.Leaf() {
 			tk := binary.BigEndian.Uint32(tni.LeafKey())
 			tv := binary.BigEndian.Uint32(tni.LeafBlob())
-			ram[tk*4] = tv
+			WriteRam(ram, tk*4, tv)
 		}
 	}
 	return ram
@@ -123,12 +150,10 @@ func RamFromTrie(root common.Hash) map[uint32](uint32) {
 func RamToTrie(ram map[uint32](uint32)) common.Hash {
 	mt := trie.NewStackTrie(PreimageKeyValueWriter{})
 
-	sram := make([]uint64, len(ram))
+	sram := make([]uint64, 0, len(ram))
 
-	i := 0
 	for k, v := range ram {
-		sram[i] = (uint64(k) << 32) | uint64(v)
-		i += 1
+		sram = append(sram, (uint64(k) << 32) | uint64(v))
 	}
 	sort.Slice(sram, func(i, j int) bool { return sram[i] < sram[j] })
 
@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// subtries below this many nibbles of the key are hashed in their own goroutine
+const PARALLEL_NIBBLES = 2
+
+// emptyRoot is the root of a trie with nothing in it
+var emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+var preimagesLock sync.Mutex
+
+func putPreimage(hash common.Hash, enc []byte) {
+	preimagesLock.Lock()
+	Preimages[hash] = enc
+	preimagesLock.Unlock()
+}
+
+// RamToTrieParallel computes the same root and Preimages as RamToTrie, but
+// sorts and hashes the 256 subtries under each two nibble key prefix
+// concurrently, so it scales with the number of cores on large memories.
+func RamToTrieParallel(ram map[uint32](uint32)) common.Hash {
+	// bucket on the first byte of the trie key, concatenated buckets are sorted
+	// as soon as each bucket is
+	var offsets [257]int
+	for k := range ram {
+		offsets[(k>>2)>>24+1]++
+	}
+	for i := 1; i < len(offsets); i++ {
+		offsets[i] += offsets[i-1]
+	}
+	sram := make([]uint64, offsets[256])
+	next := offsets
+	for k, v := range ram {
+		b := (k >> 2) >> 24
+		sram[next[b]] = (uint64(k>>2) << 32) | uint64(v)
+		next[b]++
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for b := 0; b < 256; b++ {
+		bucket := sram[offsets[b]:offsets[b+1]]
+		if len(bucket) < 2 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			sort.Slice(bucket, func(i, j int) bool { return bucket[i] < bucket[j] })
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	if len(sram) == 0 {
+		return emptyRoot
+	}
+
+	// the root is always hashed and stored, even when it's short
+	enc := encodeTrieNode(sram, 0)
+	root := crypto.Keccak256Hash(enc)
+	putPreimage(root, enc)
+	return root
+}
+
+func keyNibble(kv uint64, depth int) byte {
+	return byte(kv>>(60-4*depth)) & 0xf
+}
+
+// encodeTrieNode returns the rlp of the node holding the sorted kvs, whose
+// keys all agree on their first depth nibbles
+func encodeTrieNode(kvs []uint64, depth int) []byte {
+	if len(kvs) == 1 {
+		return rlpList(rlpString(compactKey(kvs[0], depth, 8, true)), rlpString(valueBytes(kvs[0])))
+	}
+
+	// sorted, so the first and the last key bound the shared prefix
+	end := depth
+	for keyNibble(kvs[0], end) == keyNibble(kvs[len(kvs)-1], end) {
+		end++
+	}
+	if end > depth {
+		return rlpList(rlpString(compactKey(kvs[0], depth, end, false)), trieRef(encodeBranch(kvs, end)))
+	}
+	return encodeBranch(kvs, depth)
+}
+
+func encodeBranch(kvs []uint64, depth int) []byte {
+	var children [16][]byte
+	var wg sync.WaitGroup
+	for len(kvs) > 0 {
+		n := keyNibble(kvs[0], depth)
+		i := sort.Search(len(kvs), func(i int) bool { return keyNibble(kvs[i], depth) > n })
+		child := kvs[:i]
+		if depth < PARALLEL_NIBBLES {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				children[n] = trieRef(encodeTrieNode(child, depth+1))
+			}()
+		} else {
+			children[n] = trieRef(encodeTrieNode(child, depth+1))
+		}
+		kvs = kvs[i:]
+	}
+	wg.Wait()
+
+	items := make([][]byte, 17)
+	for i, c := range children {
+		if c == nil {
+			c = rlpString(nil)
+		}
+		items[i] = c
+	}
+	items[16] = rlpString(nil)
+	return rlpList(items...)
+}
+
+// trieRef embeds nodes shorter than a hash and stores the rest as preimages
+func trieRef(enc []byte) []byte {
+	if len(enc) < 32 {
+		return enc
+	}
+	hash := crypto.Keccak256Hash(enc)
+	putPreimage(hash, enc)
+	return rlpString(hash.Bytes())
+}
+
+// compactKey is the hex prefix encoding of nibbles [from, to) of the key
+func compactKey(kv uint64, from int, to int, leaf bool) []byte {
+	buf := make([]byte, (to-from)/2+1)
+	if leaf {
+		buf[0] = 0x20
+	}
+	if (to-from)&1 == 1 {
+		buf[0] |= 0x10 | keyNibble(kv, from)
+		from++
+	}
+	for i := 1; from < to; from += 2 {
+		buf[i] = keyNibble(kv, from)<<4 | keyNibble(kv, from+1)
+		i++
+	}
+	return buf
+}
+
+func valueBytes(kv uint64) []byte {
+	return []byte{byte(kv >> 24), byte(kv >> 16), byte(kv >> 8), byte(kv)}
+}
+
+func rlpHeader(small byte, size int) []byte {
+	if size < 56 {
+		return []byte{small + byte(size)}
+	}
+	var lenBytes []byte
+	for s := size; s > 0; s >>= 8 {
+		lenBytes = append([]byte{byte(s)}, lenBytes...)
+	}
+	return append([]byte{small + 55 + byte(len(lenBytes))}, lenBytes...)
+}
+
+func rlpString(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return []byte{b[0]}
+	}
+	return append(rlpHeader(0x80, len(b)), b...)
+}
+
+func rlpList(items ...[]byte) []byte {
+	size := 0
+	for _, item := range items {
+		size += len(item)
+	}
+	ret := rlpHeader(0xc0, size)
+	for _, item := range items {
+		ret = append(ret, item...)
+	}
+	return ret
+}
@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/oracle"
+)
+
+func randomRam(n int, seed int64) map[uint32](uint32) {
+	r := rand.New(rand.NewSource(seed))
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	for len(ram) < n+36 {
+		// cluster most of the addresses like a real program does
+		addr := r.Uint32() & 0xFFFFFFFC
+		if r.Intn(4) != 0 {
+			addr = 0x31000000 + (r.Uint32()&0xFFFF)*4
+		}
+		ram[addr] = r.Uint32() >> uint(r.Intn(32))
+	}
+	return ram
+}
+
+func TestRamToTrieParallel(t *testing.T) {
+	for i, n := range []int{0, 1, 2, 17, 1000, 100000} {
+		ram := randomRam(n, int64(i))
+
+		Preimages = make(map[common.Hash][]byte)
+		want := RamToTrie(ram)
+		wantPreimages := Preimages
+
+		Preimages = make(map[common.Hash][]byte)
+		got := RamToTrieParallel(ram)
+		if got != want {
+			t.Fatalf("%d entries: root %s, want %s", len(ram), got, want)
+		}
+		if !reflect.DeepEqual(Preimages, wantPreimages) {
+			t.Fatalf("%d entries: %d preimages, want %d", len(ram), len(Preimages), len(wantPreimages))
+		}
+	}
+}
+
+func llamaNodeRam(b *testing.B) map[uint32](uint32) {
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	LoadMappedFile(MIPS_PROGRAM, ram, 0)
+	LoadMappedFile("../../mlgo/examples/llama/data/node_1253", ram, INPUT_ADDR+4)
+	b.Logf("ram entries %d", len(ram))
+	return ram
+}
+
+func BenchmarkRamToTrie(b *testing.B) {
+	ram := llamaNodeRam(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Preimages = make(map[common.Hash][]byte)
+		RamToTrie(ram)
+	}
+}
+
+func BenchmarkRamToTrieParallel(b *testing.B) {
+	ram := llamaNodeRam(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Preimages = make(map[common.Hash][]byte)
+		RamToTrieParallel(ram)
+	}
+}
+
+// zero words that were written stay leaves, the way MIPSMemory.WriteMemory
+// leaves them
+func TestZeroWordsStayLeaves(t *testing.T) {
+	initTest()
+	defer initTest()
+	oracle.SetRoot(t.TempDir())
+
+	ram := randomRam(1000, 7)
+	nonzero := 0
+	for k, v := range ram {
+		if v != 0 {
+			WriteRam(ram, k, 0)
+			if _, ok := ram[k]; !ok {
+				t.Fatalf("zero write to %x left ram", k)
+			}
+			nonzero++
+			break
+		}
+	}
+	if nonzero == 0 {
+		t.Fatal("test ram has no non zero words")
+	}
+	root := RamToTrie(ram)
+	if RamToTrieParallel(ram) != root {
+		t.Fatal("parallel root differs")
+	}
+	if !reflect.DeepEqual(RamFromTrie(root), ram) {
+		t.Fatal("zero words don't round trip")
+	}
+}
+
+func TestProveAddresses(t *testing.T) {
+	initTest()
+	ram := randomRam(1000, 11)
+	root := RamToTrie(ram)
+
+	addrs := append(RegisterAddrs(), 0x31000000, 0x7ffffffc)
+	proof, err := ProveAddresses(root, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the proof alone has to be enough to read every address back
+	nodes := make([][]byte, len(proof.Nodes))
+	for i, node := range proof.Nodes {
+		nodes[i] = node
+	}
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		value, err := (&MPTCommitment{}).Verify(root, addr, nodes)
+		if err != nil {
+			t.Fatalf("%x: %v", addr, err)
+		}
+		if value != ram[addr] {
+			t.Fatalf("%x proved %x, want %x", addr, value, ram[addr])
+		}
+	}
+	for _, node := range proof.Nodes {
+		if seen[string(node)] {
+			t.Fatal("node included twice")
+		}
+		seen[string(node)] = true
+	}
+}
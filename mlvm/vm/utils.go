@@ -9,7 +9,7 @@ import (
 var ministart time.Time
 
 func ZeroRegisters(ram map[uint32](uint32)) {
-	for i := uint32(0xC0000000); i < 0xC0000000+36*4; i += 4 {
+	for i := REG_OFFSET; i < REG_OFFSET+36*4; i += 4 {
 		WriteRam(ram, i, 0)
 	}
 }
@@ -0,0 +1,391 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// PartialTrie is a state trie known only through the nodes handed to it,
+// like MIPSMemory's view of the state. It's a StepMemory, so a step can be
+// run on it to get the post root without the rest of the state.
+type PartialTrie struct {
+	nodes     map[common.Hash][]byte
+	preimages map[common.Hash][]byte
+	root      trieNode
+}
+
+// trieNode is one of nil, hashNode, *fullNode or *shortNode
+type trieNode interface{}
+
+// hashNode is a child that hasn't been decoded yet
+type hashNode common.Hash
+
+type fullNode struct {
+	children [16]trieNode
+}
+
+// shortNode is a leaf when value is set, otherwise an extension
+type shortNode struct {
+	key   []byte
+	child trieNode
+	value []byte
+}
+
+var ErrMissingPreimage = errors.New("missing preimage")
+
+func NewPartialTrie(root common.Hash, nodes [][]byte) *PartialTrie {
+	t := &PartialTrie{
+		nodes:     make(map[common.Hash][]byte),
+		preimages: make(map[common.Hash][]byte),
+		root:      hashNode(root),
+	}
+	for _, node := range nodes {
+		t.nodes[crypto.Keccak256Hash(node)] = node
+	}
+	return t
+}
+
+func (t *PartialTrie) AddPreimage(dat []byte) {
+	t.preimages[crypto.Keccak256Hash(dat)] = dat
+}
+
+func addrNibbles(addr uint32) []byte {
+	key := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		key[i] = byte((addr >> 2) >> (28 - 4*i) & 0xf)
+	}
+	return key
+}
+
+func (t *PartialTrie) resolve(n trieNode) (trieNode, error) {
+	hash, ok := n.(hashNode)
+	if !ok {
+		return n, nil
+	}
+	enc, ok := t.nodes[common.Hash(hash)]
+	if !ok {
+		return nil, &MissingNodeError{common.Hash(hash)}
+	}
+	return decodeTrieNode(enc)
+}
+
+func decodeTrieNode(enc []byte) (trieNode, error) {
+	elems, _, err := rlp.SplitList(enc)
+	if err != nil {
+		return nil, err
+	}
+	c, err := rlp.CountValues(elems)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == 17 {
+		n := &fullNode{}
+		for i := 0; i < 16; i++ {
+			if n.children[i], err = decodeTrieRef(firstItem(elems)); err != nil {
+				return nil, err
+			}
+			if _, _, elems, err = rlp.Split(elems); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	}
+	if c == 2 {
+		_, compact, rest, err := rlp.Split(elems)
+		if err != nil {
+			return nil, err
+		}
+		key, leaf := compactToNibbles(compact)
+		n := &shortNode{key: key}
+		if leaf {
+			_, val, _, err := rlp.Split(rest)
+			if err != nil {
+				return nil, err
+			}
+			n.value = val
+		} else if n.child, err = decodeTrieRef(firstItem(rest)); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return nil, ErrBadProof
+}
+
+func decodeTrieRef(ref []byte) (trieNode, error) {
+	kind, val, _, err := rlp.Split(ref)
+	if err != nil {
+		return nil, err
+	}
+	if kind == rlp.List {
+		// short nodes are embedded in their parent
+		return decodeTrieNode(ref)
+	}
+	if len(val) == 32 {
+		return hashNode(common.BytesToHash(val)), nil
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	return nil, ErrBadProof
+}
+
+func (t *PartialTrie) ReadWord(addr uint32) (uint32, error) {
+	n, key := t.root, addrNibbles(addr)
+	for {
+		var err error
+		if n, err = t.resolve(n); err != nil {
+			return 0, err
+		}
+		switch nn := n.(type) {
+		case nil:
+			return 0, nil
+		case *fullNode:
+			if len(key) == 0 {
+				return 0, ErrBadProof
+			}
+			n, key = nn.children[key[0]], key[1:]
+		case *shortNode:
+			if len(nn.key) > len(key) || string(nn.key) != string(key[:len(nn.key)]) {
+				// missing leaves read as zero
+				return 0, nil
+			}
+			key = key[len(nn.key):]
+			if nn.value != nil {
+				if len(key) != 0 || len(nn.value) != 4 {
+					return 0, ErrBadProof
+				}
+				return binary.BigEndian.Uint32(nn.value), nil
+			}
+			n = nn.child
+		}
+	}
+}
+
+// WriteWord always leaves a leaf, even for zero, like Lib_MerkleTrie.update
+func (t *PartialTrie) WriteWord(addr uint32, value uint32) error {
+	val := make([]byte, 4)
+	binary.BigEndian.PutUint32(val, value)
+	root, err := t.insert(t.root, addrNibbles(addr), val)
+	if err != nil {
+		return err
+	}
+	t.root = root
+	return nil
+}
+
+func (t *PartialTrie) insert(n trieNode, key []byte, value []byte) (trieNode, error) {
+	n, err := t.resolve(n)
+	if err != nil {
+		return nil, err
+	}
+	switch nn := n.(type) {
+	case nil:
+		return &shortNode{key: key, value: value}, nil
+	case *fullNode:
+		// the nodes come from the witness, which can run past the key
+		if len(key) == 0 {
+			return nil, ErrBadProof
+		}
+		child, err := t.insert(nn.children[key[0]], key[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		cp := *nn
+		cp.children[key[0]] = child
+		return &cp, nil
+	case *shortNode:
+		m := 0
+		for m < len(nn.key) && m < len(key) && nn.key[m] == key[m] {
+			m++
+		}
+		if m == len(nn.key) {
+			if nn.value != nil {
+				if m != len(key) {
+					return nil, ErrBadProof
+				}
+				return &shortNode{key: key, value: value}, nil
+			}
+			child, err := t.insert(nn.child, key[m:], value)
+			if err != nil {
+				return nil, err
+			}
+			return &shortNode{key: nn.key, child: child}, nil
+		}
+
+		if m == len(key) {
+			return nil, ErrBadProof
+		}
+		// split at the first nibble that differs
+		branch := &fullNode{}
+		if nn.value != nil || m+1 < len(nn.key) {
+			branch.children[nn.key[m]] = &shortNode{key: nn.key[m+1:], child: nn.child, value: nn.value}
+		} else {
+			branch.children[nn.key[m]] = nn.child
+		}
+		branch.children[key[m]] = &shortNode{key: key[m+1:], value: value}
+		if m == 0 {
+			return branch, nil
+		}
+		return &shortNode{key: key[:m], child: branch}, nil
+	}
+	return nil, ErrBadProof
+}
+
+func (t *PartialTrie) Preimage(hash common.Hash) ([]byte, error) {
+	dat, ok := t.preimages[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrMissingPreimage, hash)
+	}
+	return dat, nil
+}
+
+// Root hashes the trie as it is now, nodes never decoded keep their hash
+func (t *PartialTrie) Root() common.Hash {
+	switch n := t.root.(type) {
+	case nil:
+		return emptyRoot
+	case hashNode:
+		return common.Hash(n)
+	}
+	return crypto.Keccak256Hash(encodePartialNode(t.root))
+}
+
+// encodePartialNode returns the rlp of n, or for a hashNode just its hash
+func encodePartialNode(n trieNode) []byte {
+	switch nn := n.(type) {
+	case hashNode:
+		return nn[:]
+	case *fullNode:
+		items := make([][]byte, 17)
+		for i, c := range nn.children {
+			items[i] = partialRef(c)
+		}
+		items[16] = rlpString(nil)
+		return rlpList(items...)
+	case *shortNode:
+		compact := nibblesToCompact(nn.key, nn.value != nil)
+		if nn.value != nil {
+			return rlpList(rlpString(compact), rlpString(nn.value))
+		}
+		return rlpList(rlpString(compact), partialRef(nn.child))
+	}
+	return nil
+}
+
+func partialRef(n trieNode) []byte {
+	if n == nil {
+		return rlpString(nil)
+	}
+	enc := encodePartialNode(n)
+	if _, ok := n.(hashNode); ok {
+		return rlpString(enc)
+	}
+	if len(enc) < 32 {
+		return enc
+	}
+	return rlpString(crypto.Keccak256(enc))
+}
+
+func nibblesToCompact(nibbles []byte, leaf bool) []byte {
+	buf := make([]byte, len(nibbles)/2+1)
+	if leaf {
+		buf[0] = 0x20
+	}
+	if len(nibbles)&1 == 1 {
+		buf[0] |= 0x10 | nibbles[0]
+		nibbles = nibbles[1:]
+	}
+	for i := 0; i < len(nibbles); i += 2 {
+		buf[i/2+1] = nibbles[i]<<4 | nibbles[i+1]
+	}
+	return buf
+}
+
+// VerifyStep runs the step of a witness using nothing but its pre root, nodes
+// and preimages, and returns the post root. A witness that's short of nodes
+// fails with a MissingNodeError.
+func VerifyStep(w *StepWitness) (common.Hash, error) {
+	nodes := make([][]byte, len(w.Nodes))
+	for i, node := range w.Nodes {
+		nodes[i] = node
+	}
+	t := NewPartialTrie(w.PreRoot, nodes)
+	for _, p := range w.Preimages {
+		t.AddPreimage(p.Data)
+	}
+	if _, err := StepMIPS(t); err != nil {
+		return common.Hash{}, err
+	}
+	return t.Root(), nil
+}
+
+// DiffStepsWithUnicorn runs count steps starting at from both through unicorn
+// and through VerifyStep on the witness of each, and returns an error for the
+// first step where they end up on different roots. load puts the program in.
+func DiffStepsWithUnicorn(basedir string, load func(mu uc.Unicorn, ram map[uint32](uint32)), from int, count int) error {
+	roots := make(map[int]common.Hash)
+	var witnesses []*StepWitness
+	var werr error
+	ram := make(map[uint32](uint32))
+	mu := GetHookedUnicorn(basedir, ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
+		if step < from {
+			return
+		}
+		// a delay slot can push the post state of the last step one further
+		if step > from+count+1 || werr != nil {
+			mu.Stop()
+			return
+		}
+		SyncRegs(mu, ram)
+		roots[step] = RamToTrie(ram)
+		// MIPS.sol doesn't step past HALT_PC, unicorn runs its nop and stops
+		if step < from+count && ram[REG_PC] != HALT_PC {
+			w, err := BuildStepWitness(roots[step], step, copyRam(ram), basedir)
+			if err != nil {
+				werr = err
+				return
+			}
+			witnesses = append(witnesses, w)
+		}
+	})
+	load(mu, ram)
+	mu.Start(0, 0x5ead0004)
+	if werr != nil {
+		return werr
+	}
+
+	for _, w := range witnesses {
+		root, err := VerifyStep(w)
+		if err != nil {
+			return fmt.Errorf("step %d at %x: %v", w.Step, w.PC, err)
+		}
+		next := w.Step + 1
+		if w.Insn.HasDelaySlot() {
+			next++
+		}
+		want, ok := roots[next]
+		if !ok {
+			return fmt.Errorf("step %d at %x: unicorn stopped before step %d", w.Step, w.PC, next)
+		}
+		if root != want {
+			return fmt.Errorf("step %d at %x (%08x): verifier got %s, unicorn %s", w.Step, w.PC, w.Insn.Word, root, want)
+		}
+	}
+	fmt.Println("verified", len(witnesses), "steps from", from)
+	return nil
+}
+
+func copyRam(ram map[uint32](uint32)) map[uint32](uint32) {
+	cp := make(map[uint32](uint32))
+	for k, v := range ram {
+		cp[k] = v
+	}
+	return cp
+}
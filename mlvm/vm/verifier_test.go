@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/oracle"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestPartialTrieWrites(t *testing.T) {
+	initTest()
+	r := rand.New(rand.NewSource(7))
+	ram := randomRam(2000, 7)
+	root := RamToTrie(ram)
+
+	var nodes [][]byte
+	for _, node := range Preimages {
+		nodes = append(nodes, node)
+	}
+	pt := NewPartialTrie(root, nodes)
+	for i := 0; i < 500; i++ {
+		addr := r.Uint32() & 0xFFFFFFFC
+		if i&1 == 0 {
+			// overwrite one that's already there
+			for addr = range ram {
+				break
+			}
+		}
+		value := r.Uint32()
+		ram[addr] = value
+		check(pt.WriteWord(addr, value))
+		if got, _ := pt.ReadWord(addr); got != value {
+			t.Fatalf("read back %x from %x, want %x", got, addr, value)
+		}
+	}
+	if pt.Root() != RamToTrie(ram) {
+		t.Fatalf("partial trie root %s, want %s", pt.Root(), RamToTrie(ram))
+	}
+}
+
+// a witness whose nodes don't end where the 8 nibble keys do is a bad proof,
+// not a panic
+func TestPartialTrieBadDepth(t *testing.T) {
+	branch, err := rlp.EncodeToBytes(make([][]byte, 17))
+	check(err)
+	for name, node := range map[string][]interface{}{
+		// an extension over all 8 nibbles of address 0 to a branch
+		"branch past the key": {[]byte{0x00, 0, 0, 0, 0}, rlp.RawValue(branch)},
+		// an extension over 9 nibbles
+		"extension past the key": {[]byte{0x10, 0, 0, 0, 0}, rlp.RawValue(branch)},
+		// a leaf 3 nibbles deep
+		"leaf short of the key": {[]byte{0x30, 0}, []byte{1, 2, 3, 4}},
+	} {
+		enc, err := rlp.EncodeToBytes(node)
+		check(err)
+		pt := NewPartialTrie(crypto.Keccak256Hash(enc), [][]byte{enc})
+		if err := pt.WriteWord(0, 1); !errors.Is(err, ErrBadProof) {
+			t.Errorf("%s: write gave %v", name, err)
+		}
+	}
+}
+
+func TestVerifyStep(t *testing.T) {
+	initTest()
+	oracle.SetRoot(t.TempDir())
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	ram[REG_PC] = 0x1000
+	ram[REG_OFFSET+8*4] = 0x1234
+	ram[0x1000] = 0x0c000800 // jal 0x2000
+	ram[0x1004] = 0xad080100 // sw $t0, 0x100($t0)
+	w, err := BuildStepWitness(RamToTrie(ram), 0, ram, "")
+	check(err)
+
+	root, err := VerifyStep(w)
+	check(err)
+	if root != w.PostRoot {
+		t.Fatalf("verified %s, witness has %s", root, w.PostRoot)
+	}
+
+	w.Nodes = w.Nodes[:len(w.Nodes)-1]
+	var missing *MissingNodeError
+	if _, err := VerifyStep(w); !errors.As(err, &missing) {
+		t.Fatalf("short witness gave %v", err)
+	}
+	w.Nodes = nil
+	if _, err := VerifyStep(w); !errors.As(err, &missing) || missing.Hash != w.PreRoot {
+		t.Fatalf("empty witness gave %v", err)
+	}
+}
+
+func TestVerifierMatchesUnicorn(t *testing.T) {
+	for _, from := range []int{0, 1000000} {
+		initTest()
+		oracle.SetRoot(t.TempDir())
+		check(DiffStepsWithUnicorn("", loadMNISTProgram, from, 200))
+	}
+}
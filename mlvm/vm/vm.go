@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"strconv"
 
@@ -14,27 +15,19 @@ import (
 )
 
 func WriteCheckpoint(ram map[uint32](uint32), fn string, step int) {
-	trieroot := RamToTrie(ram)
-	dat := TrieToJson(trieroot, step)
+	trieroot := RamToTrieParallel(ram)
+	dat := CheckpointToJson(ram, trieroot, step, 0, 0)
 	fmt.Printf("writing %s len %d with root %s\n", fn, len(dat), trieroot)
 	ioutil.WriteFile(fn, dat, 0644)
 }
 
 func WriteCheckpointWithNodeID(ram map[uint32](uint32), fn string, step int, nodeID int, nodeCount int) {
-	trieroot := RamToTrie(ram)
-	dat := TrieToJsonWithNodeID(trieroot, step, nodeID, nodeCount)
+	trieroot := RamToTrieParallel(ram)
+	dat := CheckpointToJson(ram, trieroot, step, nodeID, nodeCount)
 	fmt.Printf("writing %s len %d with root %s\n", fn, len(dat), trieroot)
 	ioutil.WriteFile(fn, dat, 0644)
 }
 
-// memory layout in MIPS
-const (
-	INPUT_ADDR = 0x31000000
-	OUTPUT_ADDR = 0x32000000
-	MODEL_ADDR = 0x33000000
-	MAGIC_ADDR = 0x30000800
-)
-
 const (
 	MIPS_PROGRAM = "../../mlgo/ml_mips/ml_mips.bin"
 )
@@ -64,6 +57,9 @@ func LoadModel(mu uc.Unicorn, file string, ram map[uint32](uint32)) {
 	}
 	modelSize := len(modelBytes)
 	fmt.Println("modelSize: ", modelSize)
+	if uint64(MODEL_ADDR)+4+uint64(modelSize) > uint64(MODEL_END) {
+		log.Fatalf("model of %d bytes runs past the model region at %x", modelSize, MODEL_END)
+	}
 	rawSize := IntToBytes(modelSize)
 	fmt.Println("rawSize: ", rawSize)
 	LoadBytesToUnicorn(mu, rawSize, ram, MODEL_ADDR)
@@ -77,8 +73,8 @@ func LoadInputData(mu uc.Unicorn, file string, ram map[uint32](uint32)) error {
 		fmt.Println(err)
 		return err
 	}
-	if len(buf) >= 10 * 1024 * 1024 {
-		fmt.Println("data too large")
+	if uint64(len(buf)) + 4 > uint64(GuestLayout.Input.End - INPUT_ADDR) {
+		fmt.Println("data too large, page it through the oracle with -pagedInput")
 		return errors.New("data too large")
 	}
 	//buf is the data
@@ -103,6 +99,18 @@ type Params struct {
 	NodeID int
 
 	MIPSVMCompatible bool
+	CheckpointEvery int
+	Trace string
+	Profile string
+	ProfilePeriod int
+	StrictSyscalls bool
+	MemoryMap string
+	MemoryLimit uint64
+	Layout string
+	PagedInput bool
+	InputChunkSize uint32
+	CommittedModel bool
+	ModelChunkSize uint32
 }
 
 func ParseParams() *Params {
@@ -119,6 +127,18 @@ func ParseParams() *Params {
 	var nodeID int
 
 	var mipsVMCompatible bool
+	var checkpointEvery int
+	var trace string
+	var profile string
+	var profilePeriod int
+	var strictSyscalls bool
+	var memoryMap string
+	var memoryLimit uint64
+	var layout string
+	var pagedInput bool
+	var inputChunkSize uint
+	var committedModel bool
+	var modelChunkSize uint
 
 	defaultBasedir := os.Getenv("BASEDIR")
 	if len(defaultBasedir) == 0 {
@@ -126,7 +146,7 @@ func ParseParams() *Params {
 	}
 	flag.StringVar(&basedir, "basedir", defaultBasedir, "Directory to read inputs, write outputs, and cache preimage oracle data.")
 	flag.IntVar(&target, "target", -1, "Target number of instructions to execute in the trace. If < 0 will execute until termination")
-	flag.StringVar(&programPath, "program", MIPS_PROGRAM, "Path to binary file containing the program to run")
+	flag.StringVar(&programPath, "program", MIPS_PROGRAM, "Path to the program to run, a MIPS ELF or a flat binary loaded at 0")
 	flag.StringVar(&modelPath, "model", "", "Path to binary file containing the AI model")
 	flag.StringVar(&inputPath, "data", "", "Path to binary file containing the input of AI model")
 	flag.BoolVar(&outputGolden, "outputGolden", false, "Do not read any inputs and instead produce a snapshot of the state prior to execution. Written to <basedir>/golden.json")
@@ -137,6 +157,18 @@ func ParseParams() *Params {
 	flag.IntVar(&nodeID, "nodeID", 0, "The current nodeID")
 	
 	flag.BoolVar(&mipsVMCompatible, "mipsVMCompatible", false, "compatible for MIPS VM")
+	flag.IntVar(&checkpointEvery, "checkpointEvery", 0, "Also write a checkpoint every N steps on the way to the target. 0 disables")
+	flag.StringVar(&trace, "trace", "", "Write a binary trace of every step to this file, with an index next to it in <trace>.idx")
+	flag.StringVar(&profile, "profile", "", "Write a pprof profile of the guest's steps by function to this file")
+	flag.IntVar(&profilePeriod, "profilePeriod", 1, "Sample every N steps for -profile, 1 counts every step")
+	flag.BoolVar(&strictSyscalls, "strictSyscalls", false, "Fail on syscalls with no handler instead of returning 0 from them")
+	flag.StringVar(&memoryMap, "memoryMap", "", "Heaps as mmap=start-end,brk=start-end, the default is mmap=0x20000000-0x30000000,brk=0x40000000-0x5ead0000")
+	flag.Uint64Var(&memoryLimit, "memoryLimit", 0, "Fail once the heaps hold more than this many bytes. 0 disables")
+	flag.BoolVar(&pagedInput, "pagedInput", false, "Only put the hash of the input in memory, the guest pages it in through the preimage oracle")
+	flag.UintVar(&inputChunkSize, "inputChunkSize", 1 << 20, "Bytes per chunk of a paged input")
+	flag.BoolVar(&committedModel, "committedModel", false, "Only put the Merkle root of the model in memory, the guest pulls weight chunks through the preimage oracle")
+	flag.UintVar(&modelChunkSize, "modelChunkSize", 1 << 20, "Bytes per chunk of a committed model")
+	flag.StringVar(&layout, "layout", "", "Memory layout manifest (json) of the guest, the default layout if empty. See mlvm layout")
 	flag.Parse()
 
 	params := &Params{
@@ -151,12 +183,30 @@ func ParseParams() *Params {
 		ModelName: modelName,
 		NodeID: nodeID,
 		MIPSVMCompatible: mipsVMCompatible,
+		CheckpointEvery: checkpointEvery,
+		Trace: trace,
+		Profile: profile,
+		ProfilePeriod: profilePeriod,
+		StrictSyscalls: strictSyscalls,
+		MemoryMap: memoryMap,
+		MemoryLimit: memoryLimit,
+		Layout: layout,
+		PagedInput: pagedInput,
+		InputChunkSize: uint32(inputChunkSize),
+		CommittedModel: committedModel,
+		ModelChunkSize: uint32(modelChunkSize),
 	}
 
 	return params
 }
 
 func Run() {
+	if len(os.Args) > 1 {
+		if command, ok := Commands[os.Args[1]]; ok {
+			check(command(os.Args[2:]))
+			return
+		}
+	}
 	params := ParseParams()
 	RunWithParams(params)
 }
@@ -173,9 +223,31 @@ func RunWithParams(params *Params) {
 	lastLayer := params.LastLayer
 	modelName := params.ModelName
 	nodeID := params.NodeID
+	TraceFile = params.Trace
+	ProfileFile = params.Profile
+	ProfilePeriod = params.ProfilePeriod
+	StrictSyscalls = params.StrictSyscalls
+	PagedInput = params.PagedInput
+	if params.InputChunkSize != 0 {
+		InputChunkSize = params.InputChunkSize
+	}
+	CommittedModel = params.CommittedModel
+	if params.ModelChunkSize != 0 {
+		ModelChunkSize = params.ModelChunkSize
+	}
+	if params.Layout != "" {
+		layout, err := ReadLayout(params.Layout)
+		check(err)
+		check(SetLayout(layout))
+	}
+	memory, err := ParseMemoryMap(params.MemoryMap)
+	check(err)
+	memory.Limit = params.MemoryLimit
+	check(memory.Validate())
+	Memory = memory
 
 	if params.MIPSVMCompatible {
-		MIPSRunCompatible(basedir, target, programPath, modelPath, inputPath, outputGolden)
+		MIPSRunCompatible(basedir, target, programPath, modelPath, inputPath, outputGolden, params.CheckpointEvery)
 		return
 	}
 
@@ -186,10 +258,10 @@ func RunWithParams(params *Params) {
 			fmt.Println("layer run error: ", err)
 			return
 		}
-		MIPSRun(basedir + "/checkpoint", 0, id, programPath, nodeFile, true, nodeCount)
+		MIPSRun(basedir + "/checkpoint", 0, id, programPath, nodeFile, true, nodeCount, 0)
 	} else {
 		// the lastLayer
-		MIPSRun(basedir + "/checkpoint", target, nodeID, programPath, inputPath, outputGolden, 0)
+		MIPSRun(basedir + "/checkpoint", target, nodeID, programPath, inputPath, outputGolden, 0, params.CheckpointEvery)
 	}
 	
 
@@ -243,44 +315,62 @@ func saveDataToFile(data []byte, filename string) error {
 	return nil
 }
 
-func MIPSRun(basedir string, target int, nodeID int, programPath string, inputPath string, outputGolden bool, nodeCount int) {
-	regfault := -1
-	regfault_str, regfault_valid := os.LookupEnv("REGFAULT")
-	if regfault_valid {
-		regfault, _ = strconv.Atoi(regfault_str)
-	}
-
-	// step 1, generate the checkpoints every million steps using unicorn
-	ram := make(map[uint32](uint32))
-
-	lastStep := 1
-	reachFinalState := true // if the target >= total step, the targt will not be saved
+// runChunked stops at every boundary that needs host side work (the register
+// fault, every checkpointEvery steps and the target) and runs freely in between
+func runChunked(c *ChunkedUnicorn, target int, regfault int, checkpointEvery int, checkpoint func(step int)) {
+	for !c.Exited {
+		if c.Step == regfault {
+			fmt.Printf("regfault at step %d\n", c.Step)
+			c.Mu.RegWrite(uc.MIPS_REG_V0, 0xbabababa)
+		}
+		if c.Step == target || (checkpointEvery > 0 && c.Step > 0 && c.Step%checkpointEvery == 0) {
+			SyncRegs(c.Mu, c.Ram)
+			checkpoint(c.Step)
+		}
+		if c.Step == target {
+			return
+		}
 
-	mu := GetHookedUnicorn(basedir, ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
-		if step == regfault {
-			fmt.Printf("regfault at step %d\n", step)
-			mu.RegWrite(uc.MIPS_REG_V0, 0xbabababa)
+		next := target
+		if regfault > c.Step && (next < 0 || regfault < next) {
+			next = regfault
 		}
-		if step == target {
-			reachFinalState = false
-			SyncRegs(mu, ram)
-			fn := fmt.Sprintf("%s/checkpoint_%d_%d.json", basedir, nodeID, step)
-			WriteCheckpointWithNodeID(ram, fn, step, nodeID, nodeCount)
-			if step == target {
-				// done
-				mu.RegWrite(uc.MIPS_REG_PC, 0x5ead0004)
+		if checkpointEvery > 0 {
+			boundary := (c.Step/checkpointEvery + 1) * checkpointEvery
+			if next < 0 || boundary < next {
+				next = boundary
 			}
 		}
-		lastStep = step + 1
-	})
+		check(c.RunTo(next))
+	}
+}
+
+// loadNodeUnicorn sets up the program with a node's input, as MIPSRun runs it
+func loadNodeUnicorn(basedir string, programPath string, inputPath string) *ChunkedUnicorn {
+	ram := make(map[uint32](uint32))
+	c := GetChunkedUnicorn(basedir, ram)
 
 	ZeroRegisters(ram)
 	// not ready for golden yet
-	LoadMappedFileUnicorn(mu, programPath, ram, 0)
+	LoadProgramUnicorn(c.Mu, programPath, ram)
 	// load input
 	if inputPath != "" {
-		LoadInputData(mu, inputPath, ram)
+		check(LoadInput(c.Mu, inputPath, ram, basedir))
+	}
+	return c
+}
+
+func MIPSRun(basedir string, target int, nodeID int, programPath string, inputPath string, outputGolden bool, nodeCount int, checkpointEvery int) {
+	regfault := -1
+	regfault_str, regfault_valid := os.LookupEnv("REGFAULT")
+	if regfault_valid {
+		regfault, _ = strconv.Atoi(regfault_str)
 	}
+
+	// step 1, generate the checkpoints every million steps using unicorn
+	c := loadNodeUnicorn(basedir, programPath, inputPath)
+	mu := c.Mu
+	ram := c.Ram
 	
 	if outputGolden {
 		WriteCheckpointWithNodeID(ram, fmt.Sprintf("%s/%d_golden.json", basedir, nodeID), -1, nodeID, nodeCount)
@@ -291,10 +381,19 @@ func MIPSRun(basedir string, target int, nodeID int, programPath string, inputPa
 	// do not need if we just run pure computation task
 	// LoadMappedFileUnicorn(mu, fmt.Sprintf("%s/input", basedir), ram, 0x30000000)
 
-	mu.Start(0, 0x5ead0004)
-
+	tracer := startTrace(mu)
+	profiler := startProfile(mu)
+	runChunked(c, target, regfault, checkpointEvery, func(step int) {
+		fn := fmt.Sprintf("%s/checkpoint_%d_%d.json", basedir, nodeID, step)
+		WriteCheckpointWithNodeID(ram, fn, step, nodeID, nodeCount)
+	})
+	stopTrace(tracer)
+	stopProfile(profiler, programPath)
+	lastStep := c.Step
+	fmt.Println(HeapReport())
 
-	if reachFinalState {
+	// if the target >= total step, the targt will not be saved
+	if c.Exited {
 		fmt.Printf("reach the final state, total step: %d, target: %d\n", lastStep, target)
 		WriteCheckpointWithNodeID(ram, fmt.Sprintf("%s/checkpoint_%d_%d.json", basedir, nodeID, lastStep), lastStep, nodeID, nodeCount)
 	}
@@ -307,7 +406,7 @@ func MIPSRun(basedir string, target int, nodeID int, programPath string, inputPa
 	}
 }
 
-func MIPSRunCompatible(basedir string, target int, programPath string, modelPath string, inputPath string, outputGolden bool) {
+func MIPSRunCompatible(basedir string, target int, programPath string, modelPath string, inputPath string, outputGolden bool, checkpointEvery int) {
 	regfault := -1
 	regfault_str, regfault_valid := os.LookupEnv("REGFAULT")
 	if regfault_valid {
@@ -317,35 +416,17 @@ func MIPSRunCompatible(basedir string, target int, programPath string, modelPath
 	// step 1, generate the checkpoints every million steps using unicorn
 	ram := make(map[uint32](uint32))
 
-	lastStep := 1
-	reachFinalState := true // if the target >= total step, the targt will not be saved
-
-	mu := GetHookedUnicorn(basedir, ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
-		if step == regfault {
-			fmt.Printf("regfault at step %d\n", step)
-			mu.RegWrite(uc.MIPS_REG_V0, 0xbabababa)
-		}
-		if step == target {
-			reachFinalState = false
-			SyncRegs(mu, ram)
-			fn := fmt.Sprintf("%s/checkpoint_%d.json", basedir, step)
-			WriteCheckpoint(ram, fn, step)
-			if step == target {
-				// done
-				mu.RegWrite(uc.MIPS_REG_PC, 0x5ead0004)
-			}
-		}
-		lastStep = step + 1
-	})
+	c := GetChunkedUnicorn(basedir, ram)
+	mu := c.Mu
 
 	ZeroRegisters(ram)
 	// not ready for golden yet
-	LoadMappedFileUnicorn(mu, programPath, ram, 0)
+	LoadProgramUnicorn(mu, programPath, ram)
 	// load input
 	if inputPath != "" {
-		LoadInputData(mu, inputPath, ram)
+		check(LoadInput(mu, inputPath, ram, basedir))
 	}
-	LoadModel(mu, modelPath, ram)
+	check(LoadWeights(mu, modelPath, ram, basedir))
 	
 	
 	if outputGolden {
@@ -358,10 +439,20 @@ func MIPSRunCompatible(basedir string, target int, programPath string, modelPath
 	// LoadMappedFileUnicorn(mu, fmt.Sprintf("%s/input", basedir), ram, 0x30000000)
 
 	SyncRegs(mu, ram)
-	mu.Start(0, 0x5ead0004)
+	tracer := startTrace(mu)
+	profiler := startProfile(mu)
+	runChunked(c, target, regfault, checkpointEvery, func(step int) {
+		fn := fmt.Sprintf("%s/checkpoint_%d.json", basedir, step)
+		WriteCheckpoint(ram, fn, step)
+	})
+	stopTrace(tracer)
+	stopProfile(profiler, programPath)
 	SyncRegs(mu, ram)
+	lastStep := c.Step
+	fmt.Println(HeapReport())
 
-	if reachFinalState {
+	// if the target >= total step, the targt will not be saved
+	if c.Exited {
 		fmt.Printf("reach the final state, total step: %d, target: %d\n", lastStep, target)
 		WriteCheckpoint(ram, fmt.Sprintf("%s/checkpoint_%d.json", basedir, lastStep), lastStep)
 	}
@@ -370,6 +461,6 @@ func MIPSRunCompatible(basedir string, target int, programPath string, modelPath
 
 		fmt.Println("lastStep: ", lastStep)
 		WriteCheckpoint(ram, fmt.Sprintf("%s/checkpoint_final.json", basedir), lastStep)
-		fmt.Printf("PC: %x\n", ram[0xC0000080])
+		fmt.Printf("PC: %x\n", ram[REG_PC])
 	}
-}
\ No newline at end of file
+}
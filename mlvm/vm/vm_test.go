@@ -9,7 +9,8 @@ import (
 func initTest() {
 	Preimages = make(map[common.Hash][]byte)
 	steps = 0
-	heap_start = 0
+	ResetHeap()
+	SetLayout(DefaultLayout())
 }
 
 func TestVM(t *testing.T){
@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Insn is a MIPS instruction word split into its fields
+type Insn struct {
+	Word   uint32 `json:"word"`
+	Opcode uint32 `json:"opcode"`
+	Rs     uint32 `json:"rs"`
+	Rt     uint32 `json:"rt"`
+	Rd     uint32 `json:"rd"`
+	Shamt  uint32 `json:"shamt"`
+	Func   uint32 `json:"func"`
+	Imm    uint32 `json:"imm"`
+	Target uint32 `json:"target"`
+}
+
+func DecodeInsn(word uint32) Insn {
+	return Insn{
+		Word:   word,
+		Opcode: word >> 26,
+		Rs:     (word >> 21) & 0x1f,
+		Rt:     (word >> 16) & 0x1f,
+		Rd:     (word >> 11) & 0x1f,
+		Shamt:  (word >> 6) & 0x1f,
+		Func:   word & 0x3f,
+		Imm:    word & 0xffff,
+		Target: word & 0x03ffffff,
+	}
+}
+
+// HasDelaySlot is true for the jumps and branches, which MIPS.Step runs
+// together with the instruction after them
+func (i Insn) HasDelaySlot() bool {
+	return i.Opcode == 1 || (i.Opcode >= 2 && i.Opcode < 8) || (i.Opcode == 0 && (i.Func == 8 || i.Func == 9))
+}
+
+type WitnessPreimage struct {
+	Data   hexutil.Bytes `json:"data"`
+	Offset uint32        `json:"offset"`
+}
+
+// StepWitness is everything MIPS.Step needs to go from PreRoot to PostRoot:
+// Nodes for callWithTrieNodes, and Preimages for AddPreimage when the step
+// reads the oracle.
+type StepWitness struct {
+	Step      int               `json:"step"`
+	PreRoot   common.Hash       `json:"preRoot"`
+	PostRoot  common.Hash       `json:"postRoot"`
+	PC        uint32            `json:"pc"`
+	Insn      Insn              `json:"insn"`
+	Asm       string            `json:"asm"`
+	Nodes     []hexutil.Bytes   `json:"nodes"`
+	Preimages []WitnessPreimage `json:"preimages"`
+}
+
+// BuildStepWitness steps ram (the state under root, with its nodes in
+// Preimages) once, the way MIPS.sol does, with the oracle reading from the
+// preimage dir preimages. ram is left at the post state.
+// Unicorn counts a delay slot as a step of its own, so when Insn has one the
+// post state is the checkpoint two steps on.
+func BuildStepWitness(root common.Hash, step int, ram map[uint32](uint32), preimages string) (*StepWitness, error) {
+	pc := ram[REG_PC]
+	w := &StepWitness{Step: step, PreRoot: root, PC: pc, Insn: DecodeInsn(ram[pc]), Asm: DisassembleAt(ram, pc)}
+
+	mem := &RamStepMemory{Ram: ram, Root: preimages}
+	access, err := StepMIPS(mem)
+	if err != nil {
+		return nil, fmt.Errorf("step %d at %x: %v", step, pc, err)
+	}
+
+	// the nodes are only needed on the paths into the pre state, anything the
+	// step writes is hashed on chain as it goes
+	proof, err := ProveAddresses(root, access.Addrs)
+	if err != nil {
+		return nil, err
+	}
+	w.Nodes = proof.Nodes
+
+	seen := make(map[PreimageRead]bool)
+	for _, pr := range access.Preimages {
+		if seen[pr] {
+			continue
+		}
+		seen[pr] = true
+		dat, err := mem.Preimage(pr.Hash)
+		if err != nil {
+			return nil, err
+		}
+		w.Preimages = append(w.Preimages, WitnessPreimage{dat, pr.Offset})
+	}
+
+	w.PostRoot = RamToTrieParallel(ram)
+	return w, nil
+}
+
+// WitnessCheckpoint builds the witness for the step after a checkpoint. The
+// preimages are in the checkpoint's dir, where the runs write both.
+func WitnessCheckpoint(fn string) (*StepWitness, error) {
+	root, step, ram, err := LoadCheckpoint(fn)
+	if err != nil {
+		return nil, err
+	}
+	return BuildStepWitness(root, step, ram, filepath.Dir(fn))
+}
+
+func (w *StepWitness) Json() []byte {
+	b, err := json.MarshalIndent(w, "", "  ")
+	check(err)
+	return b
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/oracle"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// the witness nodes alone have to be enough to read every word the step does
+func checkWitnessNodes(t *testing.T, w *StepWitness, addrs []uint32) {
+	proof := make([][]byte, len(w.Nodes))
+	for i, node := range w.Nodes {
+		proof[i] = node
+	}
+	for _, addr := range addrs {
+		if _, err := (&MPTCommitment{}).Verify(w.PreRoot, addr, proof); err != nil {
+			t.Fatalf("step %d: reading %x: %v", w.Step, addr, err)
+		}
+	}
+}
+
+func TestStepWitnessJal(t *testing.T) {
+	initTest()
+	oracle.SetRoot(t.TempDir())
+	ram := make(map[uint32](uint32))
+	ZeroRegisters(ram)
+	ram[REG_PC] = 0x1000
+	ram[REG_OFFSET+8*4] = 0x1234
+	ram[0x1000] = 0x0c000800 // jal 0x2000
+	ram[0x1004] = 0xad080100 // sw $t0, 0x100($t0)
+	root := RamToTrie(ram)
+
+	w, err := BuildStepWitness(root, 7, copyRam(ram), "")
+	check(err)
+	if !w.Insn.HasDelaySlot() || w.PC != 0x1000 || w.Asm != "jal 0x2000" {
+		t.Fatalf("decoded %+v at %x", w.Insn, w.PC)
+	}
+
+	want := copyRam(ram)
+	want[REG_PC] = 0x2000
+	want[REG_LR] = 0x1008
+	want[0x1334] = 0x1234
+	if w.PostRoot != RamToTrie(want) {
+		t.Fatalf("post root %s, want %s", w.PostRoot, RamToTrie(want))
+	}
+	checkWitnessNodes(t, w, []uint32{REG_PC, 0x1000, 0x1004, REG_OFFSET + 8*4, 0x1334, REG_LR})
+}
+
+// the witness post state has to be where unicorn goes next
+func TestStepWitnessMatchesUnicorn(t *testing.T) {
+	count := 50
+
+	initTest()
+	oracle.SetRoot(t.TempDir())
+	roots := make([]common.Hash, count+2)
+	var witnesses []*StepWitness
+	ram := make(map[uint32](uint32))
+	mu := GetHookedUnicorn("", ram, func(step int, mu uc.Unicorn, ram map[uint32](uint32)) {
+		if step >= len(roots) {
+			return
+		}
+		SyncRegs(mu, ram)
+		roots[step] = RamToTrie(ram)
+		if step < count {
+			w, err := BuildStepWitness(roots[step], step, copyRam(ram), "")
+			check(err)
+			witnesses = append(witnesses, w)
+		}
+	})
+	loadMNISTProgram(mu, ram)
+	mu.Start(0, 0x5ead0004)
+
+	for _, w := range witnesses {
+		next := w.Step + 1
+		if w.Insn.HasDelaySlot() {
+			next++
+		}
+		if w.PostRoot != roots[next] {
+			t.Fatalf("step %d (%08x at %x): post root %s, unicorn has %s", w.Step, w.Insn.Word, w.PC, w.PostRoot, roots[next])
+		}
+		if len(w.Nodes) == 0 {
+			t.Fatalf("step %d has no nodes", w.Step)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-const { deployed, getTrieNodesForCall, getTrieAtStep } = require("../scripts/lib")
+const { deployed, getStepWitness } = require("../scripts/lib")
 
 async function main() {
   let [c, m, mm] = await deployed()
@@ -24,21 +24,14 @@ async function main() {
     cdat = c.interface.encodeFunctionData("denyStateTransition", [challengeId])
   }
 
-  let startTrie = getTrieAtStep(step)
-  let finalTrie = getTrieAtStep(step+1)
-  let preimages = Object.assign({}, startTrie['preimages'], finalTrie['preimages']);
-
-  let nodes = await getTrieNodesForCall(c, c.address, cdat, preimages)
-  for (n of nodes) {
-    await mm.AddTrieNode(n)
+  let witness = getStepWitness(step)
+  console.log("step", step, "pc", witness.pc.toString(16), "nodes", witness.nodes.length)
+  for (p of witness.preimages) {
+    await mm.AddPreimage(p.data, p.offset)
   }
 
-  let ret
-  if (isChallenger) {
-    ret = await c.confirmStateTransition(challengeId)
-  } else {
-    ret = await c.denyStateTransition(challengeId)
-  }
+  // the nodes go in with the call, so this is a single transaction
+  let ret = await c.callWithTrieNodes(c.address, cdat, witness.nodes)
 
   let receipt = await ret.wait()
   console.log(receipt.events.map((x) => x.event))
@@ -110,6 +110,22 @@ async function getTrieNodesForCall(c, caddress, cdat, preimages) {
   return nodes
 }
 
+// nodes proving the words at addrs in a checkpoint, ready for callWithTrieNodes
+function getTrieNodesForAddrs(checkpoint, addrs, regs=false) {
+  let cmd = "mlvm/mlvm proof --checkpoint="+checkpoint + " --addr="+addrs.map(x => "0x"+x.toString(16)).join(",")
+  if (regs) {
+    cmd += " --regs"
+  }
+  return JSON.parse(child_process.execSync(cmd))["nodes"]
+}
+
+// everything MIPS.Step needs to run the step after the checkpoint at step
+function getStepWitness(step) {
+  getTrieAtStep(step)
+  const fn = basedir+"/checkpoint_"+step.toString()+".json"
+  return JSON.parse(child_process.execSync("mlvm/mlvm witness --checkpoint="+fn + " --basedir="+basedir))
+}
+
 function getTrieAtStep(step) {
   const fn = basedir+"/checkpoint_"+step.toString()+".json"
 
@@ -139,4 +155,4 @@ async function writeMemory(mm, root, addr, data, bytes32=false) {
   return root
 }
 
-module.exports = { basedir, deploy, deployed, getTrieNodesForCall, getBlockRlp, getTrieAtStep, writeMemory, MissingHashError }
+module.exports = { basedir, deploy, deployed, getTrieNodesForCall, getTrieNodesForAddrs, getBlockRlp, getTrieAtStep, getStepWitness, writeMemory, MissingHashError }
@@ -49,6 +49,29 @@ describe("MIPSMemory contract", function () {
     root = await writeMemory(mm, root, 0, 1)
     root = await writeMemory(mm, root, 0, 2)
   })
+  it("missing leaf reads as zero", async function() {
+    // mlvm leaves zero words that were never written out of the trie
+    let root = "0x56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421"
+    expect(await mm.ReadMemory(root, 0)).to.equal(0)
+
+    root = await writeMemory(mm, root, 0, 1)
+    root = await writeMemory(mm, root, 0x40, 2)
+
+    expect(await mm.ReadMemory(root, 4)).to.equal(0)
+    expect(await mm.ReadMemory(root, 0x3c)).to.equal(0)
+    expect(await mm.ReadMemory(root, 0x7fffd00c)).to.equal(0)
+  })
+  it("zero write still adds a leaf", async function() {
+    // WriteMemory can't delete, which is why mlvm keeps written zero words
+    // as leaves
+    let root = "0x56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421"
+    root = await writeMemory(mm, root, 0, 1)
+    const elided = root
+
+    root = await writeMemory(mm, root, 4, 0)
+    expect(await mm.ReadMemory(root, 4)).to.equal(0)
+    expect(root).to.not.equal(elided)
+  })
   it("fuzzing should be okay", async function() {
     let root = "0x56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421"
     let kv = {}